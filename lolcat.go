@@ -2,25 +2,515 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/mattn/go-runewidth"
 	"github.com/nsf/termbox-go"
 )
 
-// BufferLineCount is the number of lines of buffer to keep in memory from logcat.
+// BufferLineCount is the default number of lines of buffer to keep in memory from logcat.
 const BufferLineCount = 1000
 
+// bufferLines is the number of lines of buffer we keep in memory for each device, from the -lines
+// flag.
+var bufferLines = BufferLineCount
+
+// logcatBuffers are the names of logcat's buffers that can be given to -buffer.
+var logcatBuffers = []string{"main", "system", "crash", "radio", "events", "kernel", "default", "all"}
+
+// logcatBuffer is which of logcat's buffers we read, from the -buffer flag: one of logcatBuffers or
+// several of them separated by commas. If it's empty, we read logcat's default buffers.
+var logcatBuffer string
+
+// ParseLogcatBuffer checks that the given -buffer value names only logcatBuffers, and returns it
+// tidied up for logcat's -b option.
+func ParseLogcatBuffer(str string) (string, error) {
+	var names []string
+	for _, name := range strings.Split(str, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, b := range logcatBuffers {
+			known = known || b == name
+		}
+		if !known {
+			return "", fmt.Errorf("unknown logcat buffer %q, expected one of %s",
+				name, strings.Join(logcatBuffers, ", "))
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ","), nil
+}
+
 // PreferredHorizontalThreshold ??
 const PreferredHorizontalThreshold = 5
 
+// DefaultPollInterval is how often we re-run 'adb devices' by default, looking for new devices.
+const DefaultPollInterval = 2 * time.Second
+
+// DefaultReconnectBackoff is how long we wait, by default, before the first attempt to reconnect
+// to a device whose logcat stream has ended.
+const DefaultReconnectBackoff = 500 * time.Millisecond
+
+// DefaultMaxReconnectBackoff is the default cap on the delay between reconnect attempts.
+const DefaultMaxReconnectBackoff = 30 * time.Second
+
+// DefaultForgetAfter is how long, by default, a device has to be missing from 'adb devices' before
+// we forget about it. It's long enough that a device that's rebooting keeps its lines.
+const DefaultForgetAfter = time.Minute
+
+// DefaultMaxDevices is the default for how many devices we'll stream logs from at once.
+const DefaultMaxDevices = 16
+
+// DefaultRateWarning is the default for how many lines a second a device has to be logging before
+// we warn that the display may lag behind.
+const DefaultRateWarning = 1000
+
+// rateWarning is how many lines a second a device has to be logging before we warn that the display
+// may lag behind, from the -rate-warning flag.
+var rateWarning = DefaultRateWarning
+
+// DefaultMaxFPS is the default for how many times a second we'll redraw the screen.
+const DefaultMaxFPS = 20
+
+// maxFPS is the most times a second we'll redraw the screen, from the -max-fps flag. If it's 0,
+// we redraw as often as anything changes.
+var maxFPS = DefaultMaxFPS
+
+// FrameLimiter spaces out renders so there's at least Interval between them. On a chatty device,
+// we'd otherwise redraw the whole screen for every few lines, which costs a lot of CPU for frames
+// nobody can see.
+type FrameLimiter struct {
+	Interval time.Duration
+	last     time.Time
+}
+
+// Wait returns how long we have to wait before we can render again. If it's 0, we can render now,
+// and it's counted as a render at the given time.
+func (f *FrameLimiter) Wait(now time.Time) time.Duration {
+	if wait := f.Interval - now.Sub(f.last); wait > 0 {
+		return wait
+	}
+	f.last = now
+	return 0
+}
+
+// maxDevices is the most devices we'll show in the device bar and stream logs from up front. Any
+// more are only streamed once they're selected, after which they keep streaming until they're
+// unplugged and forgotten.
+var maxDevices int
+
+// pollInterval is how often we re-run 'adb devices' to pick up newly attached devices, when 'adb
+// track-devices' isn't working (see pollDevices).
+var pollInterval time.Duration
+
+// forgetAfter is how long a device has to be missing from 'adb devices' before we stop trying to
+// reconnect to it and remove it from the device bar, from the -forget-after flag. If it's 0, we
+// never forget a device.
+var forgetAfter time.Duration
+
+// reconnectBackoff is the delay before the first attempt to reconnect to a device. It doubles on
+// every failed attempt, up to maxReconnectBackoff.
+var reconnectBackoff time.Duration
+
+// maxReconnectBackoff is the longest we'll wait between attempts to reconnect to a device.
+var maxReconnectBackoff time.Duration
+
+// exportFormat is the format that exportCurrentView writes lines in, one of exportFormats.
+var exportFormat string
+
+// exportFormats maps each of the supported export formats to the file extension we use for it.
+var exportFormats = map[string]string{
+	"raw":  "log",
+	"csv":  "csv",
+	"json": "json",
+}
+
+// markerMode is how we show the markers logcat prints when it switches between its buffers (see
+// IsBufferMarker): "styled" as a separator, "hide" to leave them out entirely, or "raw" to show
+// them like any other line.
+var markerMode = "styled"
+
+// IsBufferMarker returns true if the given line is one of the markers logcat prints when it
+// switches between its buffers, like "--------- beginning of main".
+func IsBufferMarker(line string) bool {
+	return strings.HasPrefix(line, "--------- ")
+}
+
+// reconnectedMarker is the line we add when we reconnect to a device after losing it. It looks like
+// one of logcat's own markers, so that it's shown (or hidden) the same way.
+const reconnectedMarker = "--------- reconnected"
+
+// freezeTrigger is the regex from -freeze-on. Once a line matches it, we keep freezeAfter more
+// lines and then stop accepting new ones until we're resumed, so that what led up to it (and what
+// came right after) doesn't get overwritten. It's nil if there's no trigger.
+var freezeTrigger *regexp.Regexp
+
+// freezeAfter is how many lines after the freezeTrigger line we keep before freezing.
+var freezeAfter int
+
+// lowLatency is true if we notify the UI of every line as soon as it arrives, even while logcat is
+// still giving us its history, rather than waiting for that to finish first.
+var lowLatency bool
+
+// adbPath is the adb binary we run, from the -adb flag. It's looked up on the PATH if it's just a
+// name.
+var adbPath = "adb"
+
+// safeMode is true if we're not allowed to run any external commands other than the adb commands
+// that we need to stream logs at all. See externalCommand.
+var safeMode bool
+
+// showLaunchMarker is true if we draw a separator between the lines that were already in logcat's
+// buffer when we connected to a device, and the lines that have been logged since.
+var showLaunchMarker = true
+
+// sortByTime is true if the lines on screen are sorted by their timestamp, rather than shown in the
+// order they arrived in.
+var sortByTime bool
+
+// pinnedTags are the tags whose most recent line is always shown at the top of the log area, from
+// the -pin flag.
+var pinnedTags []string
+
+// pinnedRows is how many rows the pinned lines get. If it's 0, they get one row per pinned tag.
+var pinnedRows int
+
+// syncSelection is true if the selected line (and how far we've scrolled back) stays the same when
+// we switch between views, as far as it can. Otherwise switching views goes back to following new
+// lines.
+var syncSelection bool
+
+// compactTabs is true if the tabs are separated by a single space rather than two, to fit more in.
+var compactTabs bool
+
+// showStatusRow is true if the match count, status messages and filter errors get a row of their
+// own above the editbox. Otherwise they're squeezed in beside the editbox and the tabs.
+var showStatusRow bool
+
+// Layout is which rows of the screen each part of the UI goes in. Everything that's drawn should
+// get its position from here, rather than working it out from the size of the screen.
+type Layout struct {
+	Width int
+
+	// DeviceBar is the row with the list of devices.
+	DeviceBar int
+
+	// PinnedTop is the first row of pinned lines. There's PinnedRows of them, followed by a
+	// separator, or none at all if nothing's pinned.
+	PinnedTop  int
+	PinnedRows int
+
+	// LogTop is the first row of log lines, and LogRows is how many of them there are.
+	LogTop  int
+	LogRows int
+
+	// SplitTop is the first row of the split pane (below a separator), and SplitRows is how many
+	// rows it has, or 0 if the screen isn't split.
+	SplitTop  int
+	SplitRows int
+
+	// StatusRow is the row for the match count and status messages, or -1 if there isn't one.
+	StatusRow int
+
+	// EditBox is the row with the filter (or a prompt) in it, and Tabs is the row with the views.
+	EditBox int
+	Tabs    int
+}
+
+// LogBottom returns the last row of log lines.
+func (l Layout) LogBottom() int {
+	return l.LogTop + l.LogRows - 1
+}
+
+// currentLayout works out the Layout for the current size of the screen and the parts of the UI
+// that are turned on.
+func currentLayout() Layout {
+	w, h := screen.Size()
+	l := Layout{Width: w, DeviceBar: 0, PinnedTop: 1, StatusRow: -1, EditBox: h - 2, Tabs: h - 1}
+	below := l.EditBox
+	if showStatusRow {
+		l.StatusRow = l.EditBox - 1
+		below = l.StatusRow
+	}
+
+	l.LogTop = l.PinnedTop
+	if len(pinnedTags) > 0 {
+		l.PinnedRows = len(pinnedTags)
+		if pinnedRows > 0 {
+			l.PinnedRows = pinnedRows
+		}
+		l.LogTop += l.PinnedRows + 1
+	}
+	if l.LogRows = below - l.LogTop; l.LogRows < 0 {
+		l.LogRows = 0
+	}
+	if splitDevice != nil && splitDevice != currentDevice() && l.LogRows >= 3 {
+		// The current device gets the extra row if there's an odd number, and there's a separator
+		// between the two.
+		l.SplitRows = (l.LogRows - 1) / 2
+		l.LogRows -= l.SplitRows + 1
+		l.SplitTop = l.LogTop + l.LogRows + 1
+	}
+	return l
+}
+
+// Glyphs are the characters we draw to show that something's been cut short. Terminals and fonts
+// that don't draw the defaults well can use ASCII ones instead, see ParseGlyphs.
+type Glyphs struct {
+	// MoreLeft and MoreRight are drawn at the ends of the filter when there's more of it than fits.
+	MoreLeft  string
+	MoreRight string
+
+	// Ellipsis is added to the end of a filter's name in its tab when it's too long.
+	Ellipsis string
+
+	// TagEllipsis is added to the end of a tag that's too long for its column in columnar mode.
+	TagEllipsis string
+
+	// LineCut is drawn at the right edge of a log line that's too long for the screen. It's empty
+	// by default, so long lines are just cut off.
+	LineCut string
+
+	// WrapMark is drawn at the start of the rows that a long line carries on to when wrapLines is
+	// turned on.
+	WrapMark string
+}
+
+// glyphPresets are the sets of Glyphs that can be chosen by name with -glyphs.
+var glyphPresets = map[string]Glyphs{
+	"unicode": {MoreLeft: "←", MoreRight: "→", Ellipsis: "...", TagEllipsis: "…", WrapMark: "↪ "},
+	"ascii":   {MoreLeft: "<", MoreRight: ">", Ellipsis: "...", TagEllipsis: "~", WrapMark: "> "},
+}
+
+// glyphs are the Glyphs we draw, from the -glyphs flag.
+var glyphs = glyphPresets["unicode"]
+
+// ParseGlyphs parses a comma-separated list of a preset's name (see glyphPresets) and/or
+// "name=glyph" pairs that override single glyphs, e.g. "ascii,line-cut=>". The names are
+// more-left, more-right, ellipsis, tag-ellipsis, line-cut and wrap-mark. Anything not given is the
+// same as the unicode preset.
+func ParseGlyphs(str string) (Glyphs, error) {
+	g := glyphPresets["unicode"]
+	fields := map[string]*string{
+		"more-left":    &g.MoreLeft,
+		"more-right":   &g.MoreRight,
+		"ellipsis":     &g.Ellipsis,
+		"tag-ellipsis": &g.TagEllipsis,
+		"line-cut":     &g.LineCut,
+		"wrap-mark":    &g.WrapMark,
+	}
+	for _, item := range strings.Split(str, ",") {
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) == 1 {
+			preset, ok := glyphPresets[item]
+			if !ok {
+				return g, fmt.Errorf("unknown glyph preset: %s", item)
+			}
+			g = preset
+			continue
+		}
+		field, ok := fields[parts[0]]
+		if !ok {
+			return g, fmt.Errorf("unknown glyph: %s", parts[0])
+		}
+		if parts[0] != "line-cut" && parts[0] != "wrap-mark" && runewidth.StringWidth(parts[1]) == 0 {
+			return g, fmt.Errorf("%s can't be empty", parts[0])
+		}
+		*field = parts[1]
+	}
+	if runewidth.StringWidth(g.MoreLeft) != 1 || runewidth.StringWidth(g.MoreRight) != 1 {
+		return g, errors.New("more-left and more-right must be a single character")
+	}
+	return g, nil
+}
+
+// Keyword is a word that's colored wherever it appears in a line, regardless of case.
+type Keyword struct {
+	Word  string
+	Color termbox.Attribute
+}
+
+// keywords are the words we color in every line, from the -keywords flag.
+var keywords []Keyword
+
+// continuationColor is the color we draw lines that carry on from the line before in (e.g. the
+// frames of a stack trace, see IsContinuation), or termbox.ColorDefault to draw them like any other.
+var continuationColor termbox.Attribute
+
+// savedContinuationColor is the continuationColor to go back to when it's toggled back on.
+var savedContinuationColor = termbox.ColorDefault
+
+// levelColors is true if we draw each line in a color that depends on its level (see LevelColor),
+// from the -level-colors flag.
+var levelColors = true
+
+// LevelColor returns the color to draw a line with the given level in: warnings are yellow, errors
+// and fatals are red, debug and verbose lines are dimmed and everything else is the default. Lines
+// that aren't in the "threadtime" format (e.g. the "--------- beginning of main" markers) have no
+// level, and are drawn in the default color too.
+func LevelColor(level byte) termbox.Attribute {
+	switch level {
+	case 'W':
+		return termbox.ColorYellow
+	case 'E', 'F':
+		return termbox.ColorRed
+	case 'D', 'V':
+		return termbox.AttrDim
+	}
+	return termbox.ColorDefault
+}
+
+// colorNames are the names of the colors that can be used in options like -keywords.
+var colorNames = map[string]termbox.Attribute{
+	"default": termbox.ColorDefault,
+	"gray":    termbox.ColorDarkGray,
+	"grey":    termbox.ColorDarkGray,
+	"black":   termbox.ColorBlack,
+	"red":     termbox.ColorRed,
+	"green":   termbox.ColorGreen,
+	"yellow":  termbox.ColorYellow,
+	"blue":    termbox.ColorBlue,
+	"magenta": termbox.ColorMagenta,
+	"cyan":    termbox.ColorCyan,
+	"white":   termbox.ColorWhite,
+}
+
+// ParseKeywords parses a comma-separated list of "word=color" pairs, like "FAIL=red,OK=green".
+func ParseKeywords(str string) ([]Keyword, error) {
+	var kws []Keyword
+	for _, pair := range strings.Split(str, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid keyword %q, expected word=color", pair)
+		}
+		color, ok := colorNames[strings.ToLower(parts[1])]
+		if !ok {
+			return nil, fmt.Errorf("unknown color %q", parts[1])
+		}
+		kws = append(kws, Keyword{Word: parts[0], Color: color})
+	}
+	return kws, nil
+}
+
+// KeywordHighlights returns the highlights for every occurrence of one of our keywords in the given
+// line, ignoring case.
+func KeywordHighlights(line string) []Highlight {
+	var highlights []Highlight
+	for _, kw := range keywords {
+		n := len(kw.Word)
+		for i := 0; i+n <= len(line); i++ {
+			if strings.EqualFold(line[i:i+n], kw.Word) {
+				highlights = append(highlights, Highlight{Start: i, End: i + n, Fg: kw.Color})
+				i += n - 1
+			}
+		}
+	}
+	return highlights
+}
+
+// matchColor is the color we draw the part of each line that the current view's filter matched
+// in, from the -match-color flag. If it's termbox.ColorDefault, matches aren't highlighted.
+var matchColor = termbox.ColorCyan
+
+// MatchHighlights returns the highlights for every part of the given line that the given filter
+// matches. There's none if there's no filter, or matchColor is turned off.
+func MatchHighlights(m Matcher, line string) []Highlight {
+	if m == nil || matchColor == termbox.ColorDefault {
+		return nil
+	}
+	var highlights []Highlight
+	for _, loc := range m.FindAllStringIndex(line, -1) {
+		if loc[1] > loc[0] {
+			highlights = append(highlights, Highlight{Start: loc[0], End: loc[1], Fg: matchColor | termbox.AttrBold})
+		}
+	}
+	return highlights
+}
+
+// showStats is true if we print some statistics (e.g. how many times we rendered) on exit.
+var showStats bool
+
+// PreviewDelay is how long we wait after the last key press before counting how many lines an
+// uncommitted filter (see -live) would match.
+const PreviewDelay = 150 * time.Millisecond
+
+// previewTimer fires PreviewDelay after the filter was last edited, and then previewReady tells the
+// main loop to count the lines it would match.
+var previewTimer *time.Timer
+var previewReady = make(chan struct{}, 1)
+
+// clearPreview throws away the preview of the filter being typed (see Device.preview), once it's
+// been committed or we've moved to a different view.
+func clearPreview() {
+	for _, d := range devices {
+		d.mutex.Lock()
+		d.preview = nil
+		d.mutex.Unlock()
+	}
+}
+
+// bottomLineNo is the line number of the line at the bottom of the screen when we've scrolled back,
+// or 0 if we're following new lines as they come in.
+var bottomLineNo int64
+
+// selectedLineNo is the line number of the line that's selected, or 0 if no line is selected.
+var selectedLineNo int64
+
+// wrappedLineNo is the line number of the line that's wrapped over as many rows as it needs, rather
+// than cut off at the edge of the screen like the others. It's only wrapped while it's selected.
+var wrappedLineNo int64
+
+// liveFilter is true if we update the current view's filter as it's typed, rather than waiting
+// for it to be committed.
+var liveFilter bool
+
+// completion is the dropdown list of completions we're currently offering for the "column:value"
+// token being typed into the editbox, or nil if there isn't one.
+var completion *Completion
+
+// MaxCompletionRows is the most completions we'll show in the dropdown at once.
+const MaxCompletionRows = 10
+
+// Completion is a dropdown list of possible values for a "column:value" token in the editbox.
+type Completion struct {
+	// start is the byte offset in the editbox of the (partial) value that we're completing.
+	start    int
+	items    []string
+	selected int
+}
+
+// statusMessage is a short message (e.g. the result of an export) that we show in the tab bar
+// until the next key is pressed.
+var statusMessage string
+
 // devices is the list of devices that we currently know about.
 var devices []*Device
 
@@ -48,7 +538,7 @@ type EditBox struct {
 // will never be reused (this means a LogView can reference expired lines without having to
 // update the views every time a line is expired).
 type LogBuffer struct {
-	lines []string
+	lines []LogEntry
 
 	// nextLineIndex is the index into the lines[] slice that the *next* log line will go.
 	nextLineIndex int
@@ -57,6 +547,129 @@ type LogBuffer struct {
 	// increments for every line that's added to the buffer, whereas nextLineIndex wraps around as
 	// the buffer fills up.
 	lineNo int64
+
+	// clearedLineNo is the most recent line when the buffer was last cleared. It and every line
+	// before it are treated as though they've expired.
+	clearedLineNo int64
+
+	// archive is where lines go when they're pushed out of lines by newer ones, so that we can keep
+	// more history than fits in lines. It's nil unless there's a -memory-budget.
+	archive *Archive
+}
+
+// ArchiveBlockLines is how many lines an Archive compresses together in each block. Bigger blocks
+// compress better, but we have to decompress a whole block to get at any one line.
+const ArchiveBlockLines = 256
+
+// memoryBudget is how many bytes of compressed lines each device's Archive can hold, from the
+// -memory-budget flag. If it's 0, we don't keep an archive.
+var memoryBudget int
+
+// Archive holds older lines compressed, in blocks of ArchiveBlockLines. Once the blocks add up to
+// more than the budget, the oldest are thrown away.
+type Archive struct {
+	budget int
+	blocks []archiveBlock
+	size   int
+
+	// pending are the lines that aren't in a block yet, the first of which is pendingLineNo.
+	// lastLineNo is the most recent line that was added.
+	pending       []string
+	pendingLineNo int64
+	lastLineNo    int64
+
+	// cached are the lines of the block we decompressed most recently, the first of which is
+	// cachedLineNo. Lines are usually read in order, so this saves decompressing it again for
+	// every line.
+	cached       []string
+	cachedLineNo int64
+
+	// writer compresses each block. It's kept around because they're expensive to create.
+	writer *flate.Writer
+}
+
+// archiveBlock is a block of consecutive lines, compressed with flate and separated by newlines.
+type archiveBlock struct {
+	firstLineNo int64
+	data        []byte
+}
+
+// NewArchive creates an Archive that keeps up to the given number of bytes of compressed lines.
+func NewArchive(budget int) *Archive {
+	return &Archive{budget: budget}
+}
+
+// Add adds the given line, which must be the line after the last one that was added.
+func (a *Archive) Add(lineNo int64, line string) {
+	if len(a.pending) == 0 {
+		a.pendingLineNo = lineNo
+	}
+	a.pending = append(a.pending, line)
+	a.lastLineNo = lineNo
+	if len(a.pending) < ArchiveBlockLines {
+		return
+	}
+
+	var buf bytes.Buffer
+	if a.writer == nil {
+		a.writer, _ = flate.NewWriter(&buf, flate.BestSpeed)
+	} else {
+		a.writer.Reset(&buf)
+	}
+	a.writer.Write([]byte(strings.Join(a.pending, "\n")))
+	a.writer.Close()
+	a.blocks = append(a.blocks, archiveBlock{firstLineNo: a.pendingLineNo, data: buf.Bytes()})
+	a.size += buf.Len()
+	a.pending = nil
+	for len(a.blocks) > 0 && a.size > a.budget {
+		a.size -= len(a.blocks[0].data)
+		a.blocks = a.blocks[1:]
+	}
+}
+
+// FirstLineNo returns the line number of the oldest line in the archive, or 0 if it's empty.
+func (a *Archive) FirstLineNo() int64 {
+	if len(a.blocks) > 0 {
+		return a.blocks[0].firstLineNo
+	}
+	if len(a.pending) > 0 {
+		return a.pendingLineNo
+	}
+	return 0
+}
+
+// Clear throws away every line in the archive.
+func (a *Archive) Clear() {
+	a.blocks = nil
+	a.size = 0
+	a.pending = nil
+	a.cached = nil
+}
+
+// Size returns how many bytes of compressed lines the archive is holding.
+func (a *Archive) Size() int {
+	return a.size
+}
+
+// GetLine returns the given line, and false if it isn't in the archive.
+func (a *Archive) GetLine(lineNo int64) (string, bool) {
+	first := a.FirstLineNo()
+	if first == 0 || lineNo < first || lineNo > a.lastLineNo {
+		return "", false
+	}
+	if len(a.pending) > 0 && lineNo >= a.pendingLineNo {
+		return a.pending[lineNo-a.pendingLineNo], true
+	}
+	if a.cached == nil || lineNo < a.cachedLineNo || lineNo >= a.cachedLineNo+int64(len(a.cached)) {
+		i := sort.Search(len(a.blocks), func(i int) bool { return a.blocks[i].firstLineNo > lineNo }) - 1
+		data, err := io.ReadAll(flate.NewReader(bytes.NewReader(a.blocks[i].data)))
+		if err != nil {
+			return "", false
+		}
+		a.cached = strings.Split(string(data), "\n")
+		a.cachedLineNo = a.blocks[i].firstLineNo
+	}
+	return a.cached[lineNo-a.cachedLineNo], true
 }
 
 // LogView is a "view" over a device's logs. There's a special view that represents all logs, and
@@ -65,651 +678,6499 @@ type LogView struct {
 	Name string
 
 	lb         *LogBuffer
-	filter     *regexp.Regexp
+	filter     Matcher
+	columns    []ColumnFilter
 	filterText string
 	index      []int64
-}
 
-// Device is all the stuff we know about a single attached device.
-type Device struct {
-	// ID is the identfiied of the device, that you'd pass to adb's "-s" parameter
-	ID string
+	// err is the error from parsing filterText, if it's not valid.
+	err error
 
-	// Name is the display name of the device, that we show in the UI.
-	Name string
+	// patterns matches any of the patterns in patternFile, if the filter has a "file:" token. We
+	// reload the file whenever it's modified after patternModTime.
+	patterns       *regexp.Regexp
+	patternFile    string
+	patternModTime time.Time
 
-	logBuffer *LogBuffer
-	logViews  []*LogView
+	// grouped is true if we match whole groups of lines (e.g. a stack trace) at a time: if any line
+	// in the group matches then we include every line in the group.
+	grouped bool
 
-	// mutex is used to synchronize access to the log buffer.
-	mutex *sync.Mutex
+	// groupStart is the line number of the first line in the most recent group, and groupMatched is
+	// true if we've already included that group in the index. Only used when grouped is true.
+	groupStart   int64
+	groupMatched bool
 
-	waiting bool
-	ping    chan int
+	// snapshot is true if this view is a frozen copy of another view's lines. It has its own
+	// LogBuffer holding those lines, and doesn't get any new ones.
+	snapshot bool
+
+	// lastViewedLineNo is the most recent line we've matched that the user has actually seen, so
+	// that we can tell them about any new matches while they're looking at a different view.
+	lastViewedLineNo int64
+
+	// autoExport is writing our matches to a file as they come in, or nil if it's not turned on.
+	autoExport *AutoExport
+
+	// baseline is the line we were marked at, only lines after it are matched. If it's 0, there's
+	// no baseline and every line can match.
+	baseline int64
+
+	// engine is how the free text part of the filter is matched, one of matchEngines.
+	engine string
+
+	// rateAlert goes off when we get too many new matches too quickly, or it's nil if we haven't
+	// got one.
+	rateAlert *RateAlert
+
+	// compareTo is another view of the same buffer, whose lines we're hiding so that only the lines
+	// we match and it doesn't are shown. It's nil if we're showing all our lines.
+	compareTo *LogView
+
+	// pkg is the package from the filter's "pkg:" token, if it's got one. pkgPIDs holds the last PID
+	// we saw it running as, whose lines we match (a PID from before it restarted might have been
+	// reused by some other process since), and pkgPID is the one it's running as now, or 0 if it's
+	// not running (in which case pkgErr says why). See followPackages.
+	pkg     string
+	pkgPIDs map[int]bool
+	pkgPID  int
+	pkgErr  error
+
+	// negate is true if we show the lines that don't match the filter, rather than the ones that do.
+	negate bool
+
+	// minLevel is the lowest level of line we show (one of LevelOrder), on top of the filter, or 0
+	// to show every level. See cycleMinLevel.
+	minLevel byte
+
+	// wrap is true if we wrap this view's long lines over as many rows as they need, rather than
+	// cutting them off. It starts out as wrapLines.
+	wrap bool
 }
 
-func (d *Device) appendLine(line string) {
-	d.mutex.Lock()
-	d.logBuffer.lines[d.logBuffer.nextLineIndex] = line
-	d.logBuffer.lineNo++
-	d.logBuffer.nextLineIndex++
-	if d.logBuffer.nextLineIndex >= len(d.logBuffer.lines) {
-		d.logBuffer.nextLineIndex = 0
+// LevelOrder is logcat's levels, from the least to the most important.
+const LevelOrder = "VDIWEF"
+
+// RateAlert goes off when a view gets more than Count new matches within Window, e.g. to spot an
+// error storm rather than a one-off error.
+type RateAlert struct {
+	Count  int
+	Window time.Duration
+
+	// times are when each of the matches in the last Window arrived, oldest first, and lastLineNo
+	// is the last of them.
+	times      []time.Time
+	lastLineNo int64
+
+	// firing is true while there's more than Count matches in the window.
+	firing bool
+}
+
+// ParseRateAlert parses a rate alert written as "count/window", e.g. "5/10s" for more than 5
+// matches in 10 seconds.
+func ParseRateAlert(str string) (*RateAlert, error) {
+	parts := strings.SplitN(str, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected count/window, e.g. 5/10s, got %q", str)
 	}
-	for _, lv := range d.logViews {
-		lv.AppendLine(line, d.logBuffer.lineNo)
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid count: %q", parts[0])
 	}
-	d.mutex.Unlock()
-
-	if d.waiting {
-		d.ping <- 1
+	window, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("invalid window: %q", parts[1])
 	}
+	return &RateAlert{Count: count, Window: window}, nil
 }
 
-// NewDevice creates a new instance of Device for the device with the given ID and name.
-func NewDevice(id, name string) *Device {
-	return &Device{
-		ID:   id,
-		Name: name,
-		logBuffer: &LogBuffer{
-			lines:         make([]string, BufferLineCount),
-			nextLineIndex: 0,
-			lineNo:        0,
-		},
-		mutex:   &sync.Mutex{},
-		ping:    make(chan int),
-		waiting: false,
+// Rate returns how many matches there's been in the last Window, and updates firing to match.
+func (ra *RateAlert) Rate(now time.Time) int {
+	i := 0
+	for i < len(ra.times) && now.Sub(ra.times[i]) > ra.Window {
+		i++
 	}
+	ra.times = ra.times[i:]
+	ra.firing = len(ra.times) > ra.Count
+	return len(ra.times)
 }
 
-// Open opens a connection to the given device via an adb command. Basically we start streaming
-// logcat output to the device's AbdContext.
-func (d *Device) Open() {
-	cmd := exec.Command("adb", "-s", d.ID, "logcat", "-v", "threadtime")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		panic("An error occurred reading output: " + err.Error())
-	}
-	scanner := bufio.NewScanner(stdout)
-	go func() {
-		lastTime := time.Now()
-		for scanner.Scan() {
-			if !d.waiting {
-				thisTime := time.Now()
-				if thisTime.UnixNano()-lastTime.UnixNano() > 500000000 {
-					// More than 1/2 second passed, we can start notifying listeners of new updates
-					d.waiting = true
-				}
-				lastTime = thisTime
-			}
-			d.appendLine(scanner.Text())
-		}
-		if err := scanner.Err(); err != nil {
-			panic("An error occurred reading output: " + err.Error())
-		}
-	}()
-	err = cmd.Start()
-	if err != nil {
-		panic("Error starting adb logcat: " + err.Error())
+// countNewMatches counts any lines we've matched since the last time it was called towards our
+// rateAlert. Returns true if that's set it off. You should only call this method when you've got
+// the device's mutex locked.
+func (lv *LogView) countNewMatches(now time.Time) bool {
+	ra := lv.rateAlert
+	i := sort.Search(len(lv.index), func(i int) bool { return lv.index[i] > ra.lastLineNo })
+	for ; i < len(lv.index); i++ {
+		ra.times = append(ra.times, now)
+		ra.lastLineNo = lv.index[i]
 	}
+	wasFiring := ra.firing
+	ra.Rate(now)
+	return ra.firing && !wasFiring
 }
 
-// LineNoToIndex converts the given line number to an index into the lines buffer.
-func (lb *LogBuffer) LineNoToIndex(lineNo int64) int {
-	index := lb.nextLineIndex - int(lb.lineNo-lineNo) - 1
-	if index < 0 {
-		index += len(lb.lines)
-	}
-	if index < 0 || index >= len(lb.lines) {
-		return -1
-	}
-	return index
+// Matcher matches the free text part of a filter (everything but the "column:value" tokens)
+// against a whole line.
+type Matcher interface {
+	MatchString(line string) bool
+
+	// FindAllStringIndex returns the start and end offsets of up to n of the matches in the line
+	// (or all of them, if n is negative), like regexp.Regexp's method of the same name.
+	FindAllStringIndex(line string, n int) [][]int
 }
 
-// GetLastLineNo returns the index of the last line in the log buffer.
-// You should only call this method when you've got the device's mutex locked.
-func (lb *LogBuffer) GetLastLineNo() int64 {
-	return lb.lineNo
+// matchEngines are the names of the ways a filter's text can be matched, see CompileMatcher.
+var matchEngines = []string{"regex", "fixed", "glob"}
+
+// matchEngine is the engine that new views use, from the -match flag.
+var matchEngine = "regex"
+
+// fixedMatcher matches lines that contain a fixed string.
+type fixedMatcher string
+
+func (m fixedMatcher) MatchString(line string) bool {
+	return strings.Contains(line, string(m))
 }
 
-// GetLines returns a slice of the lines from the given line number to the given line number.
-// You should only call this method when you've got the device's mutex locked.
-func (lb *LogBuffer) GetLines(from, to int64) []string {
-	if from < 0 {
-		from = 0
-	}
-	if from == to {
-		return make([]string, 0)
+func (m fixedMatcher) FindAllStringIndex(line string, n int) [][]int {
+	var locs [][]int
+	if m == "" {
+		return locs
 	}
-
-	// TODO: can we keep these in a buffer to avoid allocating the new array each time?
-	res := make([]string, int(to-from))
-	i := 0
-	for lineNo := to; lineNo > from; lineNo-- {
-		index := lb.LineNoToIndex(lineNo)
-		if index < 0 {
+	for offset := 0; n < 0 || len(locs) < n; {
+		i := strings.Index(line[offset:], string(m))
+		if i < 0 {
 			break
 		}
-		res[i] = lb.lines[index]
-		i++
+		start := offset + i
+		offset = start + len(m)
+		locs = append(locs, []int{start, offset})
 	}
-	return res
+	return locs
 }
 
-// AppendLine will append the given line number to our index if it matches the current filter.
-func (lv *LogView) AppendLine(line string, lineNo int64) {
-	if lv.filter.MatchString(line) {
-		lv.index = append(lv.index, lineNo)
+// CompileMatcher returns a Matcher for the given text using the given engine. A "regex" is a Go
+// regular expression, "fixed" is a plain string that's matched exactly, and "glob" is a string
+// where "*" matches any run of characters and "?" any single one. All of them match if the text is
+// found anywhere in the line.
+func CompileMatcher(engine, text string) (Matcher, error) {
+	switch engine {
+	case "regex", "":
+		return regexp.Compile(text)
+	case "fixed":
+		return fixedMatcher(text), nil
+	case "glob":
+		return regexp.Compile(GlobToRegex(text))
 	}
+	return nil, fmt.Errorf("unknown match engine: %s", engine)
 }
 
-// UpdateFilter refreshes the filter for the current LogView to be the given regex.
-func (lv *LogView) UpdateFilter(lb *LogBuffer, str string) {
-	runes := []rune(str)
+// GlobToRegex returns the regex that matches the same lines as the given "glob" filter, with
+// everything but "*" and "?" quoted.
+func GlobToRegex(text string) string {
+	var sb strings.Builder
+	for _, r := range text {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return sb.String()
+}
+
+// SetBaseline only matches lines after the given line from now on, or every line if it's 0.
+func (lv *LogView) SetBaseline(lineNo int64) {
+	lv.baseline = lineNo
+	lv.UpdateFilter(lv.lb, lv.filterText)
+}
+
+// AutoExport appends a view's new matches to a file, in the configured exportFormat, whenever
+// there's at least Threshold of them waiting to be written. The writing is done by a goroutine of
+// its own, so that the lines coming in from adb never wait on the disk.
+type AutoExport struct {
+	Path      string
+	Threshold int
+
+	file    *os.File
+	format  string
+	pending []string
+
+	// batches are the lines for the writer goroutine to write, and done is closed once it's
+	// written the last of them.
+	batches chan []string
+	done    chan struct{}
+
+	// lastLineNo is the most recent line we've queued up to be written.
+	lastLineNo int64
+
+	// mutex guards written, how many lines the writer goroutine has written, and err, the error
+	// that stopped it writing to the file, if any.
+	mutex   sync.Mutex
+	written int
+	err     error
+}
+
+// StartAutoExport creates a new file and starts appending the view's matches to it, from the next
+// one on. You should only call this method when you've got the device's mutex locked.
+func (lv *LogView) StartAutoExport(path string, threshold int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	ae := &AutoExport{
+		Path:       path,
+		Threshold:  threshold,
+		file:       f,
+		format:     exportFormat,
+		batches:    make(chan []string, 16),
+		done:       make(chan struct{}),
+		lastLineNo: lv.lb.GetLastLineNo(),
+	}
+	go ae.write()
+	lv.autoExport = ae
+	return nil
+}
+
+// StopAutoExport writes any pending matches and closes the file, returning the AutoExport so that
+// the caller can say how it went. You should only call this method when you've got the device's
+// mutex locked.
+func (lv *LogView) StopAutoExport() *AutoExport {
+	ae := lv.autoExport
+	lv.autoExport = nil
+	if len(ae.pending) > 0 {
+		ae.batches <- ae.pending
+	}
+	close(ae.batches)
+	<-ae.done
+	if err := ae.file.Close(); ae.err == nil {
+		ae.err = err
+	}
+	return ae
+}
+
+// write writes each batch of lines to the file, until batches is closed. Once there's been an
+// error, we stop writing.
+func (ae *AutoExport) write() {
+	defer close(ae.done)
+	for batch := range ae.batches {
+		ae.mutex.Lock()
+		failed := ae.err != nil
+		first := ae.written == 0
+		ae.mutex.Unlock()
+		if failed {
+			continue
+		}
+		err := writeLines(ae.file, ae.format, batch, first)
+		ae.mutex.Lock()
+		ae.err = err
+		ae.written += len(batch)
+		ae.mutex.Unlock()
+	}
+}
+
+// Status returns how many lines have been written so far, and the error that stopped us writing,
+// if any.
+func (ae *AutoExport) Status() (int, error) {
+	ae.mutex.Lock()
+	defer ae.mutex.Unlock()
+	return ae.written, ae.err
+}
+
+// queueNewMatches queues up any lines we've matched since the last time it was called, and writes
+// them once there's enough of them. You should only call this method when you've got the device's
+// mutex locked.
+func (lv *LogView) queueNewMatches() {
+	ae := lv.autoExport
+	i := sort.Search(len(lv.index), func(i int) bool { return lv.index[i] > ae.lastLineNo })
+	for _, lineNo := range lv.index[i:] {
+		if lv.lb.HasLine(lineNo) {
+			ae.pending = append(ae.pending, lv.lb.GetLine(lineNo))
+		}
+		ae.lastLineNo = lineNo
+	}
+	if len(ae.pending) >= ae.Threshold {
+		// If the writer's fallen behind, we just keep the lines pending until the next match.
+		select {
+		case ae.batches <- ae.pending:
+			ae.pending = nil
+		default:
+		}
+	}
+}
+
+// Device is all the stuff we know about a single attached device.
+type Device struct {
+	// ID is the identfiied of the device, that you'd pass to adb's "-s" parameter
+	ID string
+
+	// Name is the display name of the device, that we show in the UI.
+	Name string
+
+	logBuffer *LogBuffer
+	logViews  []*LogView
+
+	// mutex is used to synchronize access to the log buffer.
+	mutex *sync.Mutex
+
+	// opened is true once we've started streaming logs from the device. Devices past the
+	// -max-devices limit aren't opened until they're selected, and then they keep streaming (even
+	// once they're out of the device bar again) so that switching back to them doesn't lose lines.
+	opened bool
+
+	// waiting is true once we're notifying the main loop of new lines on ping, which is once logcat
+	// has given us its history (or straight away with -low-latency).
+	waiting bool
+
+	// ping has a value in it whenever there's new lines the main loop hasn't rendered yet. It's
+	// buffered, and we never block sending to it, so a burst of lines is a single ping and a busy (or
+	// uninterested) main loop never holds up reading from adb.
+	ping chan struct{}
+
+	// launchLineNo is the last line of the history that logcat gave us when we first connected,
+	// lines after it were logged while we've been watching.
+	launchLineNo int64
+
+	// pinned is the most recent line for each of the pinnedTags.
+	pinned map[string]string
+
+	// processes is the name of each process on the device, by PID, when processNames is turned on.
+	// Processes that have exited are kept, so that their lines still have a name.
+	processes map[int]string
+
+	// preview is the view that the filter being typed into the current view would give, if it were
+	// committed (see updatePreview). New lines are added to it like any other view, so its count
+	// stays up to date. It's nil if there's nothing to preview.
+	preview *LogView
+
+	// lineNos is reused by GetViewLineNos for the line numbers it returns, so that we're not
+	// allocating a new slice on every render.
+	lineNos []int64
+
+	// pid is the process that we've asked logcat to restrict itself to (see SetPID), which is
+	// running pidPackage. If it's 0 we stream logs from every process. If the device's logcat
+	// doesn't support --pid, pidUnsupported is set and we filter the lines ourselves instead.
+	pid            int
+	pidPackage     string
+	pidUnsupported bool
+
+	// cmd is the 'adb logcat' command that's currently streaming, if any.
+	cmd *exec.Cmd
+
+	// triggerLineNo is the line that matched freezeTrigger, or 0 if none has yet. Once freezeAfter
+	// more lines have come in, frozen is set and any more lines are dropped (and counted in
+	// droppedLines) until we're resumed.
+	triggerLineNo int64
+	frozen        bool
+	droppedLines  int
+
+	// notes are the notes that have been attached to lines, by line number in logBuffer.
+	notes map[int64]string
+
+	// alertPending is set when one of our views' rate alerts has just gone off, until we've rung
+	// the bell for it.
+	alertPending bool
+
+	// rate is how many lines a second we got over the last UpdateRate interval. rateLineNo and
+	// rateTime are the last line number and the time when it was last updated.
+	rate       int
+	rateLineNo int64
+	rateTime   time.Time
+
+	// state is the health of our connection to the device, which is shown in the device bar. See
+	// ConnectionState for how it changes.
+	state ConnectionState
+
+	// missingSince is when the device disappeared from 'adb devices', or zero if it's there. It's
+	// only used by the main loop, see forgetDevices.
+	missingSince time.Time
+
+	// closed is set once the device has been forgotten, to stop Open's loop from reconnecting.
+	closed bool
+
+	// err is why adb last stopped streaming (e.g. it couldn't be run at all, or the device went
+	// away), which is shown in the device bar until we get another line.
+	err error
+
+	// retry cuts short Open's wait before it next tries to reconnect, see Retry.
+	retry chan struct{}
+}
+
+// ConnectionState is the health of our connection to a device. A device starts out suspended,
+// until it's opened, when it's connecting. Once the first line comes in it's streaming, and when
+// adb exits it's reconnecting until the next stream starts. Separately, 'adb devices' can tell us
+// that a device is offline or unauthorized (or has gone away, which we treat as offline), and it
+// stays that way until 'adb devices' says it's back, or it sends us a line.
+type ConnectionState int
+
+const (
+	StateSuspended ConnectionState = iota
+	StateConnecting
+	StateStreaming
+	StateReconnecting
+	StateOffline
+	StateUnauthorized
+)
+
+// String returns the name of the state, as we show it in the device list.
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateStreaming:
+		return "streaming"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateOffline:
+		return "offline"
+	case StateUnauthorized:
+		return "unauthorized"
+	}
+	return "suspended"
+}
+
+// Glyph returns the glyph and color we draw in front of the device's name for the state.
+func (s ConnectionState) Glyph() (rune, termbox.Attribute) {
+	switch s {
+	case StateConnecting:
+		return '◌', termbox.ColorYellow
+	case StateStreaming:
+		return '●', termbox.ColorGreen
+	case StateReconnecting:
+		return '↻', termbox.ColorYellow
+	case StateOffline:
+		return '✕', termbox.ColorRed
+	case StateUnauthorized:
+		return '⚠', termbox.ColorRed
+	}
+	return '‖', termbox.ColorDefault
+}
+
+// setState moves the device to the given state. The stream's own transitions (connecting,
+// streaming and reconnecting) don't override what 'adb devices' has told us, except that getting a
+// line means the device is clearly fine. You should only call this method when you've got the
+// device's mutex locked.
+func (d *Device) setState(state ConnectionState) {
+	if (d.state == StateOffline || d.state == StateUnauthorized) &&
+		(state == StateConnecting || state == StateReconnecting) {
+		return
+	}
+	d.state = state
+}
+
+// SetAdbState updates the device's state from what 'adb devices' says about it: "device" if it's
+// ready to use, "offline", "unauthorized" and so on, or "" if it's not listed at all.
+func (d *Device) SetAdbState(adbState string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	switch adbState {
+	case "device":
+		if d.state == StateOffline || d.state == StateUnauthorized {
+			if d.opened {
+				d.state = StateReconnecting
+			} else {
+				d.state = StateSuspended
+			}
+		}
+	case "unauthorized":
+		d.state = StateUnauthorized
+	default:
+		d.state = StateOffline
+	}
+}
+
+// UpdateRate works out how many lines a second we've been getting since it was last called, from
+// how far the line number has moved on. Logcat's history doesn't count, so the rate is 0 until it's
+// caught up. Returns true if the rate has changed.
+func (d *Device) UpdateRate(now time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	rate := 0
+	if d.waiting && !d.rateTime.IsZero() {
+		if elapsed := now.Sub(d.rateTime).Seconds(); elapsed > 0 {
+			rate = int(float64(d.logBuffer.lineNo-d.rateLineNo)/elapsed + 0.5)
+		}
+	}
+	d.rateLineNo = d.logBuffer.lineNo
+	d.rateTime = now
+	changed := rate != d.rate
+	d.rate = rate
+	return changed
+}
+
+// HasRateAlerts returns true if any of our views has a rate alert, or one has just gone off. Rates
+// change as time passes, even without new lines, so we keep redrawing while there are any.
+func (d *Device) HasRateAlerts() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.alertPending {
+		return true
+	}
+	for _, lv := range d.logViews {
+		if lv.rateAlert != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// setRateAlert asks for the current filter's rate alert, as "count/window" (see ParseRateAlert),
+// and sets it. An empty answer turns it off.
+func setRateAlert() {
+	device := currentDevice()
+	if device == nil || viewIndex == 0 {
+		statusMessage = "Only filters can have rate alerts"
+		return
+	}
+	askPrompt("Alert when this filter matches more than (e.g. 5/10s, empty for never):", func(answer string) {
+		var ra *RateAlert
+		if answer != "" {
+			var err error
+			if ra, err = ParseRateAlert(answer); err != nil {
+				statusMessage = err.Error()
+				return
+			}
+		}
+		device.mutex.Lock()
+		defer device.mutex.Unlock()
+		lv := device.logViews[viewIndex-1]
+		if ra != nil {
+			// Only matches from now on count.
+			ra.lastLineNo = lv.GetLastLineNo()
+		}
+		lv.rateAlert = ra
+	})
+}
+
+// Resume starts accepting new lines again after we were frozen, and waits for the freezeTrigger
+// to match again. Returns how many lines were dropped while we were frozen.
+func (d *Device) Resume() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	dropped := d.droppedLines
+	d.triggerLineNo = 0
+	d.frozen = false
+	d.droppedLines = 0
+	return dropped
+}
+
+func (d *Device) appendLine(line string) {
+	if markerMode == "hide" && IsBufferMarker(line) {
+		return
+	}
+	d.mutex.Lock()
+	if d.frozen {
+		d.droppedLines++
+		d.mutex.Unlock()
+		return
+	}
+	e := NewLogEntry(line)
+	if d.pid != 0 && d.pidUnsupported && e.Parsed && e.PID != d.pid {
+		d.mutex.Unlock()
+		return
+	}
+	d.logBuffer.AddEntry(e)
+	if freezeTrigger != nil {
+		if d.triggerLineNo == 0 && freezeTrigger.MatchString(line) {
+			d.triggerLineNo = d.logBuffer.lineNo
+		}
+		if d.triggerLineNo != 0 && d.logBuffer.lineNo-d.triggerLineNo >= int64(freezeAfter) {
+			d.frozen = true
+		}
+	}
+	if d.preview != nil && d.preview.lb == d.logBuffer {
+		d.preview.AppendLine(e, d.logBuffer.lineNo)
+	}
+	for _, lv := range d.logViews {
+		if !lv.snapshot {
+			lv.AppendLine(e, d.logBuffer.lineNo)
+			if lv.autoExport != nil {
+				lv.queueNewMatches()
+			}
+			if lv.rateAlert != nil && lv.countNewMatches(time.Now()) {
+				d.alertPending = true
+			}
+		}
+	}
+	if len(pinnedTags) > 0 && e.Parsed {
+		for _, tag := range pinnedTags {
+			if e.Tag == tag {
+				d.pinned[tag] = line
+			}
+		}
+	}
+	notify := d.waiting
+	d.mutex.Unlock()
+
+	if notify {
+		select {
+		case d.ping <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ClearLocal throws away the lines we've got from the device so far, and empties all of its views
+// except snapshots. Unlike 'adb logcat -c', the device's own log buffer isn't touched.
+func (d *Device) ClearLocal() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.logBuffer.Clear()
+	for _, lv := range d.logViews {
+		if !lv.snapshot {
+			lv.index = nil
+			lv.groupMatched = false
+		}
+	}
+}
+
+// NewDevice creates a new instance of Device for the device with the given ID and name, with any
+// settings from the device's section of the config file (see DeviceSettings).
+func NewDevice(id, name string) *Device {
+	var archive *Archive
+	if memoryBudget > 0 {
+		archive = NewArchive(memoryBudget)
+	}
+	settings := deviceSettings[id]
+	if settings.Name != "" {
+		name = settings.Name
+	}
+	lines := bufferLines
+	if settings.Lines > 0 {
+		lines = settings.Lines
+	}
+	d := &Device{
+		ID:   id,
+		Name: name,
+		logBuffer: &LogBuffer{
+			lines:         make([]LogEntry, lines),
+			nextLineIndex: 0,
+			lineNo:        0,
+			archive:       archive,
+		},
+		mutex:   &sync.Mutex{},
+		ping:    make(chan struct{}, 1),
+		retry:   make(chan struct{}, 1),
+		pinned:  map[string]string{},
+		notes:   map[int64]string{},
+		waiting: false,
+	}
+	filters := append(append([]string(nil), startupFilters...), settings.Filters...)
+	for _, filter := range filters {
+		lv := &LogView{lb: d.logBuffer, engine: matchEngine, wrap: wrapLines}
+		lv.UpdateFilter(d.logBuffer, filter)
+		d.logViews = append(d.logViews, lv)
+	}
+	return d
+}
+
+// Open opens a connection to the given device via an adb command. Basically we start streaming
+// logcat output to the device's LogBuffer. If adb exits (the device was unplugged, the adb server
+// was restarted, etc) we keep trying to reconnect, backing off exponentially between attempts.
+func (d *Device) Open() {
+	d.opened = true
+	d.mutex.Lock()
+	d.setState(StateConnecting)
+	d.mutex.Unlock()
+	go func() {
+		backoff := Backoff{Initial: reconnectBackoff, Max: maxReconnectBackoff}
+		for {
+			n, err := d.stream()
+			if n > 0 {
+				// We were connected for a while, so start again from the initial delay.
+				backoff.Reset()
+			}
+			d.mutex.Lock()
+			closed := d.closed
+			if err == nil && !closed {
+				err = errors.New("adb logcat exited")
+			}
+			d.err = err
+			d.setState(StateReconnecting)
+			d.mutex.Unlock()
+			if closed {
+				return
+			}
+			select {
+			case <-time.After(backoff.Next()):
+			case <-d.retry:
+				backoff.Reset()
+			}
+		}
+	}()
+}
+
+// Retry makes Open try to reconnect straight away, rather than waiting out its backoff. It does
+// nothing if we're not waiting to reconnect.
+func (d *Device) Retry() {
+	select {
+	case d.retry <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops streaming logs from the device for good, once it's been forgotten. Open's loop exits
+// the next time adb does, which is straight away, since we kill it.
+func (d *Device) Close() {
+	d.mutex.Lock()
+	d.closed = true
+	d.restartStream()
+	d.mutex.Unlock()
+}
+
+// stream runs a single 'adb logcat' session, appending everything it outputs to our LogBuffer. It
+// returns when adb exits, with the number of lines that were read.
+func (d *Device) stream() (int, error) {
+	d.mutex.Lock()
+	pid := d.pid
+	if d.closed {
+		d.mutex.Unlock()
+		return 0, nil
+	}
+	cmd := adbCommand(d.logcatArgs()...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		d.mutex.Unlock()
+		return 0, fmt.Errorf("couldn't run adb: %v", err)
+	}
+	d.cmd = cmd
+	d.setState(StateConnecting)
+	d.mutex.Unlock()
+
+	n := 0
+	scanner := bufio.NewScanner(stdout)
+	lastTime := time.Now()
+	caughtUp := false
+	if lowLatency {
+		d.mutex.Lock()
+		d.waiting = true
+		d.mutex.Unlock()
+	}
+	for scanner.Scan() {
+		if !caughtUp {
+			thisTime := time.Now()
+			if n > 0 && thisTime.UnixNano()-lastTime.UnixNano() > 500000000 {
+				// More than 1/2 second passed, we can start notifying listeners of new updates. It
+				// also means logcat has finished giving us its history, and we're now getting lines
+				// as they're logged.
+				caughtUp = true
+				d.mutex.Lock()
+				d.waiting = true
+				// Only the first time: after a reconnect (or restarting the stream for -pid),
+				// the lines since we first connected are still the ones since launch.
+				if d.launchLineNo == 0 {
+					d.launchLineNo = d.logBuffer.lineNo
+				}
+				d.mutex.Unlock()
+			}
+			lastTime = thisTime
+		}
+		if n == 0 {
+			// If we lost the connection, mark where it came back, since logcat is about to give us
+			// its history again.
+			d.mutex.Lock()
+			reconnected := d.err != nil && d.logBuffer.Len() > 0
+			d.setState(StateStreaming)
+			d.err = nil
+			d.mutex.Unlock()
+			if reconnected {
+				d.appendLine(reconnectedMarker)
+			}
+		}
+		d.appendLine(scanner.Text())
+		n++
+	}
+	err = scanner.Err()
+	if waitErr := cmd.Wait(); err == nil {
+		err = waitErr
+	}
+
+	d.mutex.Lock()
+	d.cmd = nil
+	if n == 0 && pid != 0 && pid == d.pid && strings.Contains(stderr.String(), "pid") {
+		// Older versions of logcat don't know about --pid, so we'll do the filtering ourselves.
+		d.pidUnsupported = true
+	}
+	d.mutex.Unlock()
+	return n, adbError(err, stderr.String())
+}
+
+// adbError returns the error from running adb, with the last line it wrote to stderr (e.g. "error:
+// device 'emulator-5554' not found") in place of just its exit status, if it wrote anything.
+func adbError(err error, stderr string) error {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); err != nil && last != "" {
+		return errors.New(last)
+	}
+	return err
+}
+
+// SetPID restricts the logs we stream from the device to the given process, which is running the
+// given package. If pid is 0, we go back to streaming logs from every process. The stream is
+// restarted, and the lines we already have are cleared, since logcat will send us the process's
+// history again.
+func (d *Device) SetPID(pkg string, pid int) {
+	d.mutex.Lock()
+	d.pid = pid
+	d.pidPackage = pkg
+	d.pidUnsupported = false
+	d.restartStream()
+	d.mutex.Unlock()
+	d.ClearLocal()
+}
+
+// Reconnect kills the device's 'adb logcat' so that Open's loop starts a new one, clearing the
+// lines we've already got if clear is true.
+func (d *Device) Reconnect(clear bool) {
+	d.mutex.Lock()
+	d.restartStream()
+	d.mutex.Unlock()
+	if clear {
+		d.ClearLocal()
+	}
+}
+
+// restartStream kills the current 'adb logcat' so that Open's loop starts a new one. You should
+// only call this method when you've got the device's mutex locked.
+func (d *Device) restartStream() {
+	d.waiting = false
+	if d.cmd != nil && d.cmd.Process != nil {
+		d.cmd.Process.Kill()
+	}
+}
+
+// PIDOf returns the ID of the process that's running the given package on the device, using
+// 'adb shell pidof'. If there's more than one, the first is returned.
+func (d *Device) PIDOf(pkg string) (int, error) {
+	cmd, err := externalCommand(adbPath, "-s", d.ID, "shell", "pidof", pkg)
+	if err != nil {
+		return 0, err
+	}
+	out, err := cmd.Output()
+	fields := strings.Fields(string(out))
+	if err != nil || len(fields) == 0 {
+		return 0, fmt.Errorf("%s isn't running", pkg)
+	}
+	return strconv.Atoi(fields[0])
+}
+
+// pidUpdate is the result of looking up the PID of a package that a filter's following.
+type pidUpdate struct {
+	device *Device
+	pkg    string
+	pid    int
+	err    error
+}
+
+// resolving are the packages (by device ID and package name) whose PIDs we're looking up, so
+// that we don't start looking one up again before the last one's finished.
+var resolving = map[string]bool{}
+
+// lastResolved is when we last started looking up the followed packages' PIDs.
+var lastResolved time.Time
+
+// followPackages starts looking up the current PID of every package that a filter has a "pkg:"
+// token for, if it's been pollInterval since we last did. Each result is sent to updates, to be
+// applied with applyPIDUpdate.
+func followPackages(now time.Time, updates chan<- pidUpdate) {
+	if now.Sub(lastResolved) < pollInterval {
+		return
+	}
+	lastResolved = now
+	for _, d := range devices {
+		if !d.opened {
+			continue
+		}
+		d.mutex.Lock()
+		for _, lv := range d.logViews {
+			key := d.ID + "\x00" + lv.pkg
+			if lv.pkg == "" || resolving[key] {
+				continue
+			}
+			resolving[key] = true
+			go func(d *Device, pkg string) {
+				pid, err := d.PIDOf(pkg)
+				updates <- pidUpdate{d, pkg, pid, err}
+			}(d, lv.pkg)
+		}
+		d.mutex.Unlock()
+	}
+}
+
+// applyPIDUpdate updates every filter that's following the package with its current PID. If it's
+// a new PID (the package has started, or restarted), the filter's matches are found again so that
+// they're the new process's lines, including any it logged before we noticed.
+func applyPIDUpdate(u pidUpdate) {
+	delete(resolving, u.device.ID+"\x00"+u.pkg)
+	u.device.mutex.Lock()
+	defer u.device.mutex.Unlock()
+	for _, lv := range u.device.logViews {
+		if lv.pkg != u.pkg {
+			continue
+		}
+		lv.pkgPID = u.pid
+		lv.pkgErr = u.err
+		if u.err == nil && !lv.pkgPIDs[u.pid] {
+			lv.pkgPIDs = map[int]bool{u.pid: true}
+			lv.UpdateFilter(lv.lb, lv.filterText)
+		}
+	}
+}
+
+// processNames is true if we show the name of the process that logged each line (e.g.
+// "com.example.app") in place of its PID, from the -process-names flag. The names are looked up
+// with 'adb shell ps' every pollInterval while it's turned on.
+var processNames bool
+
+// Processes returns the name of every process running on the device, by PID, using 'adb shell ps'.
+func (d *Device) Processes() (map[int]string, error) {
+	// Before Android 8, ps doesn't take any options but lists every process anyway.
+	cmd, err := externalCommand(adbPath, "-s", d.ID, "shell", "ps -A -o PID,NAME 2>/dev/null || ps")
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("'adb shell ps' failed: %v", err)
+	}
+	return ParsePS(string(out)), nil
+}
+
+// ParsePS parses the output of ps into a map of process names by PID. The PID and NAME columns
+// are found from the header, so that it works with every version's columns, e.g.
+//
+//	USER      PID   PPID  VSIZE  RSS   WCHAN            PC  NAME
+//	u0_a120   4321  612   1634600 81240 SyS_epoll_ 0000000000 S com.example.app
+//
+// The name is always the last column, since some versions have an unlabelled state column.
+func ParsePS(out string) map[int]string {
+	processes := make(map[int]string)
+	lines := strings.Split(out, "\n")
+	pidColumn := -1
+	for i, field := range strings.Fields(lines[0]) {
+		if field == "PID" {
+			pidColumn = i
+		}
+	}
+	if pidColumn < 0 {
+		return processes
+	}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) <= pidColumn+1 {
+			continue
+		}
+		if pid, err := strconv.Atoi(fields[pidColumn]); err == nil {
+			processes[pid] = fields[len(fields)-1]
+		}
+	}
+	return processes
+}
+
+// processUpdate is the result of listing a device's processes.
+type processUpdate struct {
+	device    *Device
+	processes map[int]string
+	err       error
+}
+
+// listingProcesses are the devices whose processes we're listing, so that we don't start again
+// before the last one's finished. lastListedProcesses is when we last started.
+var listingProcesses = map[*Device]bool{}
+var lastListedProcesses time.Time
+
+// listProcesses starts listing the processes on every device we're streaming, if processNames is
+// turned on and it's been pollInterval since we last did. Each result is sent to updates, to be
+// applied with applyProcessUpdate.
+func listProcesses(now time.Time, updates chan<- processUpdate) {
+	if !processNames || now.Sub(lastListedProcesses) < pollInterval {
+		return
+	}
+	lastListedProcesses = now
+	for _, d := range devices {
+		if !d.opened || listingProcesses[d] {
+			continue
+		}
+		listingProcesses[d] = true
+		go func(d *Device) {
+			processes, err := d.Processes()
+			updates <- processUpdate{d, processes, err}
+		}(d)
+	}
+}
+
+// applyProcessUpdate keeps the device's new list of processes. The old one's kept if listing them
+// failed, since the names of processes that have exited are still useful for their old lines.
+func applyProcessUpdate(u processUpdate) {
+	delete(listingProcesses, u.device)
+	if u.err != nil {
+		statusMessage = u.err.Error()
+		return
+	}
+	u.device.mutex.Lock()
+	defer u.device.mutex.Unlock()
+	if u.device.processes == nil {
+		u.device.processes = make(map[int]string)
+	}
+	for pid, name := range u.processes {
+		u.device.processes[pid] = name
+	}
+}
+
+// toggleProcessNames switches between showing process names and PIDs. Turning names on lists the
+// processes straight away, rather than waiting for the next pollInterval.
+func toggleProcessNames() {
+	processNames = !processNames
+	if processNames {
+		lastListedProcesses = time.Time{}
+		statusMessage = "Showing process names in place of PIDs"
+	} else {
+		statusMessage = "Showing PIDs"
+	}
+}
+
+// WithProcessName returns the given line (which may have been formatted into columns) with the
+// name of the process that logged it in place of its PID.
+func WithProcessName(line string, e LogEntry, name string) string {
+	if !e.Parsed || !strings.HasPrefix(line, e.Timestamp) {
+		return line
+	}
+	rest := line[len(e.Timestamp):]
+	pid := strconv.Itoa(e.PID)
+	i := strings.Index(rest, pid)
+	if i < 0 {
+		return line
+	}
+	return e.Timestamp + rest[:i] + name + rest[i+len(pid):]
+}
+
+// filterToApp asks for a package, and opens a new view of just the lines from its process (a "pkg:"
+// filter, which keeps following it when it restarts). If we know the name of the selected line's
+// process (see processNames), it's suggested.
+func filterToApp() {
+	device := currentDevice()
+	if device == nil {
+		return
+	}
+	suggestion := ""
+	if selectedLineNo != 0 {
+		device.mutex.Lock()
+		if e := device.ViewBuffer(viewIndex).GetEntry(selectedLineNo); e.Parsed {
+			suggestion = device.processes[e.PID]
+		}
+		device.mutex.Unlock()
+	}
+	askPrompt("Filter to package:", func(answer string) {
+		if answer = strings.TrimSpace(answer); answer == "" {
+			return
+		}
+		createNewView()
+		editbox.SetText("pkg:" + answer)
+		editbox.MoveCursorToEndOfTheLine()
+		updateCurrentView()
+		// Look its PID up on the next tick, rather than waiting for pollInterval.
+		lastResolved = time.Time{}
+	})
+	editbox.SetText(suggestion)
+	editbox.MoveCursorToEndOfTheLine()
+}
+
+// restrictions carries the PID that restrictToPackage looked up to the main loop, which applies it
+// with applyRestriction.
+var restrictions = make(chan pidUpdate)
+
+// restricting is the package that each device is waiting for restrictToPackage to look up, so that
+// a lookup that's been overtaken by another (or by going back to every process) is ignored.
+var restricting = map[*Device]string{}
+
+// restrictToPackage restricts the current device's logs to the process running the given
+// package, or to every process if pkg is empty. The package's PID is looked up in the background,
+// since 'adb shell pidof' can take a while, and applied when it arrives.
+func restrictToPackage(pkg string) {
+	device := currentDevice()
+	if device == nil {
+		return
+	}
+	if pkg == "" {
+		delete(restricting, device)
+		device.SetPID("", 0)
+		statusMessage = "Streaming logs from every process"
+		return
+	}
+	restricting[device] = pkg
+	statusMessage = fmt.Sprintf("Looking up %s's pid", pkg)
+	go func() {
+		pid, err := device.PIDOf(pkg)
+		restrictions <- pidUpdate{device, pkg, pid, err}
+	}()
+}
+
+// applyRestriction restricts the device's logs to the PID that restrictToPackage looked up, if it's
+// still the package we want.
+func applyRestriction(u pidUpdate) {
+	if restricting[u.device] != u.pkg {
+		return
+	}
+	delete(restricting, u.device)
+	if u.err != nil {
+		statusMessage = u.err.Error()
+		return
+	}
+	u.device.SetPID(u.pkg, u.pid)
+	if u.device == currentDevice() {
+		selectedLineNo = 0
+		bottomLineNo = 0
+	}
+	statusMessage = fmt.Sprintf("Streaming logs from %s (pid %d)", u.pkg, u.pid)
+}
+
+// errSafeMode is the error externalCommand returns when we're running in safe mode.
+var errSafeMode = errors.New("disabled in safe mode")
+
+// logcatArgs returns the arguments to adb that stream logs from this device. The ID is passed as
+// it is, so network devices (e.g. "192.168.1.20:5555") work just like USB ones. You should only
+// call this method when you've got the device's mutex locked.
+func (d *Device) logcatArgs() []string {
+	args := []string{"-s", d.ID, "logcat", "-v", "threadtime"}
+	if logcatBuffer != "" {
+		args = append(args, "-b", logcatBuffer)
+	}
+	if d.pid != 0 && !d.pidUnsupported {
+		args = append(args, fmt.Sprintf("--pid=%d", d.pid))
+	}
+	return args
+}
+
+// adbCommand returns a command that runs adb (or whatever -adb says) with the given arguments. This
+// is only for the core "adb logcat" and "adb devices" commands, which are allowed even in safe mode.
+// Anything else (e.g. "adb shell") must go through externalCommand.
+func adbCommand(args ...string) *exec.Cmd {
+	return exec.Command(adbPath, args...)
+}
+
+// externalCommand returns a command that runs the given program with the given arguments, or
+// errSafeMode if we're not allowed to run external commands. Every feature that needs to run
+// something other than the core adb commands should go through here.
+func externalCommand(name string, args ...string) (*exec.Cmd, error) {
+	if safeMode {
+		return nil, errSafeMode
+	}
+	return exec.Command(name, args...), nil
+}
+
+// clipboardCommands are the commands we try, in order, to copy text to the clipboard.
+var clipboardCommands = [][]string{
+	{"pbcopy"},
+	{"wl-copy"},
+	{"xclip", "-selection", "clipboard"},
+	{"xsel", "--clipboard", "--input"},
+	{"clip.exe"},
+}
+
+// CopyToClipboard copies the given text to the clipboard, with whichever of clipboardCommands is
+// installed.
+func CopyToClipboard(text string) error {
+	// Check this first, so that -safe doesn't go looking for clipboard tools at all.
+	if safeMode {
+		return errSafeMode
+	}
+	for _, args := range clipboardCommands {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		cmd, err := externalCommand(args[0], args[1:]...)
+		if err != nil {
+			return err
+		}
+		cmd.Stdin = strings.NewReader(text)
+		return cmd.Run()
+	}
+	return errors.New("no clipboard tool found, install xclip, xsel or wl-copy")
+}
+
+// Backoff computes exponentially increasing delays between retries, capped at Max.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+
+	next time.Duration
+}
+
+// Next returns how long to wait before the next attempt, and doubles the delay for the one after.
+func (b *Backoff) Next() time.Duration {
+	if b.next <= 0 {
+		b.next = b.Initial
+	}
+	delay := b.next
+	if delay > b.Max {
+		delay = b.Max
+	}
+	b.next = delay * 2
+	return delay
+}
+
+// Reset goes back to the initial delay, call this after an attempt succeeds.
+func (b *Backoff) Reset() {
+	b.next = 0
+}
+
+// LineNoToIndex converts the given line number to an index into the lines buffer. Returns -1 if
+// the line has expired from the buffer (or hasn't been added yet).
+func (lb *LogBuffer) LineNoToIndex(lineNo int64) int {
+	if lineNo <= lb.clearedLineNo || lineNo > lb.lineNo || lineNo <= lb.lineNo-int64(len(lb.lines)) {
+		return -1
+	}
+	index := lb.nextLineIndex - int(lb.lineNo-lineNo) - 1
+	if index < 0 {
+		index += len(lb.lines)
+	}
+	if index < 0 || index >= len(lb.lines) {
+		return -1
+	}
+	return index
+}
+
+// HasLine returns true if the given line is still in the buffer, or in its archive.
+// You should only call this method when you've got the device's mutex locked.
+func (lb *LogBuffer) HasLine(lineNo int64) bool {
+	return lineNo >= lb.GetFirstLineNo() && lineNo <= lb.lineNo
+}
+
+// GetLine returns the given line, or "" if it's not in the buffer (see HasLine). Lines in the
+// archive are decompressed as needed. You should only call this method when you've got the
+// device's mutex locked.
+func (lb *LogBuffer) GetLine(lineNo int64) string {
+	if index := lb.LineNoToIndex(lineNo); index >= 0 {
+		return lb.lines[index].Line
+	}
+	if lb.archive != nil && lineNo > lb.clearedLineNo {
+		line, _ := lb.archive.GetLine(lineNo)
+		return line
+	}
+	return ""
+}
+
+// GetEntry returns the given line along with its parsed columns, or an empty LogEntry if it's not
+// in the buffer. Lines in memory were parsed when they were added, only lines from the archive
+// have to be parsed again. You should only call this method when you've got the device's mutex
+// locked.
+func (lb *LogBuffer) GetEntry(lineNo int64) LogEntry {
+	if index := lb.LineNoToIndex(lineNo); index >= 0 {
+		return lb.lines[index]
+	}
+	return NewLogEntry(lb.GetLine(lineNo))
+}
+
+// Add parses the given line and adds it to the end of the buffer. You should only call this method
+// when you've got the device's mutex locked.
+func (lb *LogBuffer) Add(line string) {
+	lb.AddEntry(NewLogEntry(line))
+}
+
+// AddEntry adds a new, already parsed, line to the end of the buffer, moving the oldest line into
+// the archive (if we've got one) when the buffer's full. You should only call this method when
+// you've got the device's mutex locked.
+func (lb *LogBuffer) AddEntry(e LogEntry) {
+	if oldest := lb.lineNo - int64(len(lb.lines)) + 1; lb.archive != nil && oldest > lb.clearedLineNo && oldest >= 1 {
+		lb.archive.Add(oldest, lb.lines[lb.nextLineIndex].Line)
+	}
+	lb.lines[lb.nextLineIndex] = e
+	lb.lineNo++
+	lb.nextLineIndex++
+	if lb.nextLineIndex >= len(lb.lines) {
+		lb.nextLineIndex = 0
+	}
+}
+
+// Clear throws away every line in the buffer. Line numbers keep counting up from where they were,
+// so that old line numbers can't refer to new lines. You should only call this method when you've
+// got the device's mutex locked.
+func (lb *LogBuffer) Clear() {
+	lb.clearedLineNo = lb.lineNo
+	for i := range lb.lines {
+		lb.lines[i] = LogEntry{}
+	}
+	if lb.archive != nil {
+		lb.archive.Clear()
+	}
+}
+
+// GetLastLineNo returns the index of the last line in the log buffer.
+// You should only call this method when you've got the device's mutex locked.
+func (lb *LogBuffer) GetLastLineNo() int64 {
+	return lb.lineNo
+}
+
+// GetFirstLineNo returns the line number of the oldest line that's still in the buffer. If the
+// buffer's empty, it's one more than GetLastLineNo. You should only call this method when you've
+// got the device's mutex locked.
+func (lb *LogBuffer) GetFirstLineNo() int64 {
+	first := lb.lineNo - int64(len(lb.lines)) + 1
+	if lb.archive != nil {
+		if archived := lb.archive.FirstLineNo(); archived != 0 && archived < first {
+			first = archived
+		}
+	}
+	if first <= lb.clearedLineNo {
+		first = lb.clearedLineNo + 1
+	}
+	if first < 1 {
+		first = 1
+	}
+	return first
+}
+
+// Len returns how many lines are in the buffer, including any that have gone to the archive. You
+// should only call this method when you've got the device's mutex locked.
+func (lb *LogBuffer) Len() int {
+	return int(lb.GetLastLineNo() - lb.GetFirstLineNo() + 1)
+}
+
+// GetLineNos returns the line numbers from the given line number (exclusive) to the given line
+// number (inclusive), newest first. Lines that have expired from the buffer are skipped. They're
+// appended to dst[:0], which is only grown if it's not big enough, so that it can be reused.
+// You should only call this method when you've got the device's mutex locked.
+func (lb *LogBuffer) GetLineNos(dst []int64, from, to int64) []int64 {
+	res := dst[:0]
+	if from < 0 {
+		from = 0
+	}
+	if from >= to {
+		return res
+	}
+
+	for lineNo := to; lineNo > from; lineNo-- {
+		if !lb.HasLine(lineNo) {
+			break
+		}
+		res = append(res, lineNo)
+	}
+	return res
+}
+
+// AppendLine will append the given line number to our index if it matches the current filter.
+func (lv *LogView) AppendLine(e LogEntry, lineNo int64) {
+	if lineNo <= lv.baseline {
+		return
+	}
+	if !lv.grouped {
+		if lv.matches(e) {
+			lv.index = append(lv.index, lineNo)
+		}
+		return
+	}
+
+	if !lv.lb.HasLine(lineNo-1) || !IsContinuation(lv.lb.GetEntry(lineNo-1), e) {
+		lv.groupStart = lineNo
+		lv.groupMatched = false
+	}
+	if lv.groupMatched {
+		lv.index = append(lv.index, lineNo)
+	} else if lv.matches(e) {
+		// Pull in the rest of the group that we skipped before we knew it matched.
+		for no := lv.groupStart; no <= lineNo; no++ {
+			if no > lv.baseline && lv.lb.HasLine(no) {
+				lv.index = append(lv.index, no)
+			}
+		}
+		lv.groupMatched = true
+	}
+}
+
+// UnreadCount returns the number of lines we've matched since the user last looked at this view.
+func (lv *LogView) UnreadCount() int {
+	i := sort.Search(len(lv.index), func(i int) bool {
+		return lv.index[i] > lv.lastViewedLineNo
+	})
+	return len(lv.index) - i
+}
+
+// matches returns true if the given line matches our filter, or doesn't if we're negated. If the
+// filter is invalid, everything matches either way. Either way, the line has to be at least our
+// minLevel too.
+func (lv *LogView) matches(e LogEntry) bool {
+	if lv.minLevel != 0 && strings.IndexByte(LevelOrder, e.Level) < strings.IndexByte(LevelOrder, lv.minLevel) {
+		return false
+	}
+	if lv.negate && lv.err == nil {
+		return !lv.matchesFilter(e)
+	}
+	return lv.matchesFilter(e)
+}
+
+// matchesFilter returns true if the given line matches our filter.
+func (lv *LogView) matchesFilter(e LogEntry) bool {
+	if lv.filter != nil && !lv.filter.MatchString(e.Line) {
+		return false
+	}
+	if lv.patterns != nil && !lv.patterns.MatchString(e.Line) {
+		return false
+	}
+	if len(lv.columns) > 0 || lv.pkg != "" {
+		if !e.Parsed {
+			return false
+		}
+		for _, cf := range lv.columns {
+			if !cf.Matches(e.LogLine) {
+				return false
+			}
+		}
+		if lv.pkg != "" && !lv.pkgPIDs[e.PID] {
+			return false
+		}
+	}
+	return true
+}
+
+// Label returns the name we display for this view in the tab bar, including markers for any of the
+// view's modes that are turned on.
+func (lv *LogView) Label() string {
+	label := lv.Name
+	if lv.negate {
+		label = "!" + label
+	}
+	if lv.snapshot {
+		label = "❄" + label
+	}
+	if lv.grouped {
+		label += "¶"
+	}
+	if lv.minLevel != 0 {
+		label += "≥" + string(lv.minLevel)
+	}
+	if ae := lv.autoExport; ae != nil {
+		label += "⤓"
+		if _, err := ae.Status(); err != nil {
+			label += "!"
+		}
+	}
+	if lv.rateAlert != nil && lv.rateAlert.firing {
+		label += "🔔"
+	}
+	if lv.compareTo != nil {
+		label += "∖"
+	}
+	return label
+}
+
+// SetNegated turns negated matching on or off, and refreshes the index to match.
+func (lv *LogView) SetNegated(lb *LogBuffer, negate bool) {
+	lv.negate = negate
+	lv.UpdateFilter(lb, lv.filterText)
+}
+
+// SetMinLevel only shows lines of at least the given level from now on (or every level, if it's
+// 0), and refreshes the index to match.
+func (lv *LogView) SetMinLevel(lb *LogBuffer, level byte) {
+	lv.minLevel = level
+	lv.UpdateFilter(lb, lv.filterText)
+}
+
+// SetGrouped turns grouped matching on or off, and refreshes the index to match.
+func (lv *LogView) SetGrouped(lb *LogBuffer, grouped bool) {
+	lv.grouped = grouped
+	lv.UpdateFilter(lb, lv.filterText)
+}
+
+// UpdateFilter refreshes the filter for the current LogView to be the given regex.
+func (lv *LogView) UpdateFilter(lb *LogBuffer, str string) {
+	runes := []rune(str)
 	if len(runes) == 0 {
 		lv.Name = "<empty>"
 	} else if len(runes) > 16 {
 		runes = runes[:16]
-		lv.Name = string(runes[:16]) + "..."
+		lv.Name = string(runes[:16]) + glyphs.Ellipsis
+	} else {
+		lv.Name = str
+	}
+
+	lv.filterText = str
+	pf, err := ParseFilter(str)
+	var filter Matcher
+	var patterns *regexp.Regexp
+	if err == nil {
+		filter, err = CompileMatcher(lv.engine, pf.Regex)
+	}
+	lv.patternFile = pf.PatternFile
+	if err == nil && pf.PatternFile != "" {
+		if fi, statErr := os.Stat(pf.PatternFile); statErr == nil {
+			lv.patternModTime = fi.ModTime()
+		}
+		patterns, err = LoadPatterns(pf.PatternFile)
+	}
+	lv.err = err
+	if err != nil {
+		lv.filter = nil
+		lv.columns = nil
+		lv.patterns = nil
+		lv.Name = "#ERR#"
+	} else {
+		lv.filter = filter
+		lv.columns = pf.Columns
+		lv.patterns = patterns
+	}
+	if pf.Package != lv.pkg || err != nil {
+		lv.pkg = pf.Package
+		lv.pkgPIDs = map[int]bool{}
+		lv.pkgPID = 0
+		lv.pkgErr = nil
+		if err != nil {
+			lv.pkg = ""
+		}
+	}
+
+	lv.index = nil
+	lv.groupStart = 0
+	lv.groupMatched = false
+	lb.ForEachEntry(func(lineNo int64, e LogEntry) {
+		lv.AppendLine(e, lineNo)
+	})
+}
+
+// GetLastLineNo returns the index of the last line in the log buffer.
+// You should only call this method when you've got the device's mutex locked.
+func (lv *LogView) GetLastLineNo() int64 {
+	if lv.index == nil {
+		return 0
+	}
+
+	return lv.index[len(lv.index)-1]
+}
+
+// GetLineNos returns the line numbers of up to count of our lines, starting at the given line
+// number and working backwards (so newest first). Lines that have expired from the buffer are
+// skipped. Like LogBuffer.GetLineNos, they're appended to dst[:0].
+func (lv *LogView) GetLineNos(dst []int64, bottomLineNo int64, count int) []int64 {
+	res := dst[:0]
+	for i := len(lv.index) - 1; i >= 0 && len(res) < count; i-- {
+		if lv.index[i] > bottomLineNo {
+			continue
+		}
+		if !lv.lb.HasLine(lv.index[i]) {
+			break
+		}
+		res = append(res, lv.index[i])
+	}
+	return res
+}
+
+// NearestLineNo returns the line number in our index that's closest to the given one, and false if
+// there's no lines in the index that are still in the buffer.
+func (lv *LogView) NearestLineNo(lineNo int64) (int64, bool) {
+	i := sort.Search(len(lv.index), func(i int) bool { return lv.index[i] >= lineNo })
+	best, found := int64(0), false
+	for _, j := range []int{i - 1, i} {
+		if j < 0 || j >= len(lv.index) || !lv.lb.HasLine(lv.index[j]) {
+			continue
+		}
+		if !found || abs64(lv.index[j]-lineNo) < abs64(best-lineNo) {
+			best, found = lv.index[j], true
+		}
+	}
+	return best, found
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// LogLine is a single line of logcat output, parsed out of the "threadtime" format, which looks
+// like:
+//
+//	12-25 10:11:12.345  1234  5678 D SomeTag : the message
+type LogLine struct {
+	Timestamp string
+	PID       int
+	TID       int
+	Level     byte
+	Tag       string
+	Message   string
+}
+
+// threadtimeRegex matches a line in logcat's "threadtime" format.
+var threadtimeRegex = regexp.MustCompile(
+	`^(\d\d-\d\d \d\d:\d\d:\d\d\.\d+)\s+(\d+)\s+(\d+)\s+([VDIWEFS])\s(.*?)\s*: ?(.*)$`)
+
+// LogEntry is a line in a LogBuffer, along with its columns, which are parsed once when it's added
+// so that drawing and filtering it doesn't have to parse it again.
+type LogEntry struct {
+	// Line is the line just as logcat gave it to us.
+	Line string
+
+	// LogLine is the parsed line. If Parsed is false, the line isn't in the "threadtime" format
+	// and only the Message is set (to the whole line).
+	LogLine
+	Parsed bool
+}
+
+// NewLogEntry parses the given line into a LogEntry.
+func NewLogEntry(line string) LogEntry {
+	ll, ok := ParseLogLine(line)
+	return LogEntry{Line: line, LogLine: ll, Parsed: ok}
+}
+
+// ParseLogLine parses the given line from logcat. Returns false if the line isn't in the
+// "threadtime" format (e.g. the "--------- beginning of main" separators).
+func ParseLogLine(line string) (LogLine, bool) {
+	m := threadtimeRegex.FindStringSubmatch(line)
+	if m == nil {
+		return LogLine{Message: line}, false
+	}
+	pid, _ := strconv.Atoi(m[2])
+	tid, _ := strconv.Atoi(m[3])
+	return LogLine{
+		Timestamp: m[1],
+		PID:       pid,
+		TID:       tid,
+		Level:     m[4][0],
+		Tag:       m[5],
+		Message:   m[6],
+	}, true
+}
+
+// ColumnFilter matches a single parsed column of a log line against a value. They're written in a
+// filter as "column:value", e.g. "tag:ActivityManager", "level:E", "pid:1234" or "tid:1235", or
+// as "column:~regex" to match the column against a regex instead, e.g. "tag:~^Activ" or
+// "msg:~failed.*code".
+type ColumnFilter struct {
+	Column string
+	Value  string
+
+	// Regex is the compiled regex for "column:~regex", or nil if Value has to match exactly.
+	Regex *regexp.Regexp
+}
+
+// columnFilterRegex matches the "column:value" tokens in a filter. "file:path" and "stack:kind"
+// aren't really columns, but they're written the same way.
+var columnFilterRegex = regexp.MustCompile(`(?:^|\s)(tag|level|pid|tid|msg|file|stack|pkg):(\S*)`)
+
+// stackFrameRegexes match the message of a line that's a frame of a stack trace, for each kind of
+// stack that "stack:kind" can match. "stack:" on its own matches any of them.
+var stackFrameRegexes = map[string]*regexp.Regexp{
+	// e.g. "	at com.example.Foo.bar(Foo.java:123)"
+	"java": regexp.MustCompile(`^\s*at [\w$.<>]+\((?:[\w$]+\.(?:java|kt):\d+|Native Method|Unknown Source)\)`),
+
+	// e.g. "      #00 pc 0000000000089abc  /system/lib64/libc.so (abort+164)"
+	"native": regexp.MustCompile(`^\s*#\d+ pc [0-9a-fA-F]+\s`),
+}
+
+// logLevels are the logcat priority levels, from lowest to highest.
+const logLevels = "VDIWEF"
+
+// ParsedFilter is the text of a filter, split up into its parts.
+type ParsedFilter struct {
+	// Columns are the "column:value" tokens.
+	Columns []ColumnFilter
+
+	// PatternFile is the path from a "file:path" token, a file of patterns (one per line) that
+	// lines must match at least one of.
+	PatternFile string
+
+	// Package is the package from a "pkg:name" token, whose process (whatever its current PID is)
+	// lines must come from.
+	Package string
+
+	// Regex is whatever's left over, the regex to match against the whole line.
+	Regex string
+}
+
+// ParseFilter splits the given filter text up into its "column:value" tokens and whatever's left
+// over.
+func ParseFilter(str string) (ParsedFilter, error) {
+	var pf ParsedFilter
+	for _, m := range columnFilterRegex.FindAllStringSubmatch(str, -1) {
+		cf := ColumnFilter{Column: m[1], Value: m[2]}
+		if (cf.Value == "" && cf.Column != "stack") || cf.Value == "~" {
+			// Probably still being typed, so don't filter on it yet.
+			continue
+		}
+		if strings.HasPrefix(cf.Value, "~") {
+			if cf.Column == "file" || cf.Column == "stack" || cf.Column == "pkg" {
+				return pf, fmt.Errorf("%s: can't be a regex", cf.Column)
+			}
+			re, err := regexp.Compile(cf.Value[1:])
+			if err != nil {
+				return pf, fmt.Errorf("invalid %s: regex: %v", cf.Column, err)
+			}
+			cf.Regex = re
+			pf.Columns = append(pf.Columns, cf)
+			continue
+		}
+		switch cf.Column {
+		case "stack":
+			if _, ok := stackFrameRegexes[cf.Value]; !ok && cf.Value != "" {
+				return pf, fmt.Errorf("invalid stack: %q, expected java or native", cf.Value)
+			}
+		case "file":
+			pf.PatternFile = cf.Value
+			continue
+		case "pkg":
+			pf.Package = cf.Value
+			continue
+		case "pid", "tid":
+			if _, err := strconv.Atoi(cf.Value); err != nil {
+				return pf, fmt.Errorf("invalid %s: %q", cf.Column, cf.Value)
+			}
+		case "level":
+			if strings.Trim(strings.ToUpper(cf.Value), logLevels) != "" {
+				return pf, fmt.Errorf("invalid level: %q", cf.Value)
+			}
+		}
+		pf.Columns = append(pf.Columns, cf)
+	}
+	pf.Regex = strings.TrimSpace(columnFilterRegex.ReplaceAllString(str, " "))
+	return pf, nil
+}
+
+// LoadPatterns reads a file of regexes, one per line, and combines them into a single regex that
+// matches any of them. Blank lines, and lines starting with "#", are ignored. If any of the regexes
+// are invalid, the error says which line it's on.
+func LoadPatterns(path string) (*regexp.Regexp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var alternatives []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		pattern := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(pattern) == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		alternatives = append(alternatives, "(?:"+pattern+")")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(alternatives) == 0 {
+		// An empty file doesn't match anything.
+		return regexp.MustCompile(`[^\s\S]`), nil
+	}
+	return regexp.Compile(strings.Join(alternatives, "|"))
+}
+
+// Matches returns true if the given line's column matches our value. Tags, PIDs and messages must
+// match exactly (unless we've got a Regex), while the level can be any of the levels listed (e.g.
+// "level:EF" for errors and fatals). "stack:" matches any stack frame, or just Java or native ones
+// with "stack:java" or "stack:native".
+func (cf ColumnFilter) Matches(ll LogLine) bool {
+	if cf.Regex != nil {
+		switch cf.Column {
+		case "tag":
+			return cf.Regex.MatchString(ll.Tag)
+		case "pid":
+			return cf.Regex.MatchString(strconv.Itoa(ll.PID))
+		case "tid":
+			return cf.Regex.MatchString(strconv.Itoa(ll.TID))
+		case "level":
+			return cf.Regex.MatchString(string(ll.Level))
+		case "msg":
+			return cf.Regex.MatchString(ll.Message)
+		}
+		return false
+	}
+	switch cf.Column {
+	case "msg":
+		return ll.Message == cf.Value
+	case "stack":
+		for kind, re := range stackFrameRegexes {
+			if (cf.Value == "" || cf.Value == kind) && re.MatchString(ll.Message) {
+				return true
+			}
+		}
+		return false
+	case "tag":
+		return ll.Tag == cf.Value
+	case "pid":
+		return strconv.Itoa(ll.PID) == cf.Value
+	case "tid":
+		return strconv.Itoa(ll.TID) == cf.Value
+	case "level":
+		return strings.IndexByte(strings.ToUpper(cf.Value), ll.Level) >= 0
+	}
+	return false
+}
+
+// DistinctValues returns the distinct values of the given column over every line in the buffer,
+// sorted. You should only call this method when you've got the device's mutex locked.
+func (d *Device) DistinctValues(column string) []string {
+	seen := make(map[string]bool)
+	for _, line := range d.GetAllLines(0) {
+		ll, ok := ParseLogLine(line)
+		if !ok {
+			continue
+		}
+		switch column {
+		case "tag":
+			seen[ll.Tag] = true
+		case "pid":
+			seen[strconv.Itoa(ll.PID)] = true
+		case "tid":
+			seen[strconv.Itoa(ll.TID)] = true
+		}
+	}
+
+	values := make([]string, 0, len(seen))
+	for value := range seen {
+		values = append(values, value)
+	}
+	if column == "pid" || column == "tid" {
+		sort.Slice(values, func(i, j int) bool {
+			a, _ := strconv.Atoi(values[i])
+			b, _ := strconv.Atoi(values[j])
+			return a < b
+		})
+	} else {
+		sort.Strings(values)
+	}
+	return values
+}
+
+// IsContinuation returns true if line carries on from prev, as part of the same multi-line log
+// message (e.g. the frames of a stack trace). logcat splits multi-line messages up into separate
+// lines, each with the same header, so we look for lines from the same thread and tag that were
+// either logged at the same time, or are indented like a stack frame.
+func IsContinuation(prev, line LogEntry) bool {
+	if !prev.Parsed || !line.Parsed {
+		return false
+	}
+	pll, ll := prev.LogLine, line.LogLine
+	if ll.PID != pll.PID || ll.TID != pll.TID || ll.Level != pll.Level || ll.Tag != pll.Tag {
+		return false
+	}
+	return ll.Timestamp == pll.Timestamp || strings.HasPrefix(ll.Message, "\t") ||
+		strings.HasPrefix(ll.Message, " ") || strings.HasPrefix(ll.Message, "at ") ||
+		strings.HasPrefix(ll.Message, "Caused by:")
+}
+
+// ViewBuffer returns the buffer that the given view's lines are in. That's our LogBuffer, unless
+// the view is a snapshot, which has its own.
+func (d *Device) ViewBuffer(view int) *LogBuffer {
+	if view == 0 {
+		return d.logBuffer
+	}
+	return d.logViews[view-1].lb
+}
+
+// GetViewLineNos returns the buffer that the given view's lines are in (a snapshot has its own),
+// and the line numbers of up to count lines in the view, starting at bottomLineNo and working
+// backwards (so newest first). If bottomLineNo is 0, we start at the most recent line. The line
+// numbers are only good until the next call, since the slice is reused. You should only call this
+// method when you've got the device's mutex locked.
+func (d *Device) GetViewLineNos(view int, bottomLineNo int64, count int) (*LogBuffer, []int64) {
+	lb := d.ViewBuffer(view)
+	if bottomLineNo <= 0 || bottomLineNo > lb.GetLastLineNo() {
+		bottomLineNo = lb.GetLastLineNo()
+	}
+	if cap(d.lineNos) < count {
+		d.lineNos = make([]int64, 0, count)
+	}
+	if view == 0 {
+		d.lineNos = lb.GetLineNos(d.lineNos, bottomLineNo-int64(count), bottomLineNo)
+		return lb, d.lineNos
+	}
+	lv := d.logViews[view-1]
+	if lv.compareTo != nil {
+		diff := &LogView{lb: lv.lb, index: lv.Difference()}
+		d.lineNos = diff.GetLineNos(d.lineNos, bottomLineNo, count)
+		return lb, d.lineNos
+	}
+	d.lineNos = lv.GetLineNos(d.lineNos, bottomLineNo, count)
+	return lb, d.lineNos
+}
+
+// Difference returns the line numbers in our index that aren't in our compareTo view's index, or
+// our whole index if we're not comparing. You should only call this method when you've got the
+// device's mutex locked.
+func (lv *LogView) Difference() []int64 {
+	if lv.compareTo == nil {
+		return lv.index
+	}
+	var diff []int64
+	other := lv.compareTo.index
+	j := 0
+	for _, lineNo := range lv.index {
+		for j < len(other) && other[j] < lineNo {
+			j++
+		}
+		if j >= len(other) || other[j] != lineNo {
+			diff = append(diff, lineNo)
+		}
+	}
+	return diff
+}
+
+// previousView is the filter that was being viewed before the current one, or nil if it was the
+// "no filter" view.
+var previousView *LogView
+
+// compareViews shows only the current filter's lines that another filter (the previous one, unless
+// another is chosen) doesn't match, or goes back to showing all of them.
+func compareViews() {
+	device := currentDevice()
+	if device == nil || viewIndex == 0 {
+		statusMessage = "Only filters can be compared"
+		return
+	}
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	lv := device.logViews[viewIndex-1]
+	if lv.compareTo != nil {
+		lv.compareTo = nil
+		statusMessage = "Showing every line " + lv.Name + " matches"
+		return
+	}
+
+	// Snapshots have their own line numbers, so they can only be compared with views of the same
+	// buffer.
+	var others []*LogView
+	var items []string
+	selected := 0
+	for _, other := range device.logViews {
+		if other != lv && other.lb == lv.lb {
+			if other == previousView {
+				selected = len(others)
+			}
+			others = append(others, other)
+			items = append(items, other.Label())
+		}
+	}
+	if len(others) == 0 {
+		statusMessage = "There's no other filter to compare with"
+		return
+	}
+	overlay = &Overlay{
+		Title: "Show the lines " + lv.Name + " matches that this filter doesn't:",
+		Items: items,
+		OnSelect: func(i int) {
+			device.mutex.Lock()
+			lv.compareTo = others[i]
+			device.mutex.Unlock()
+			bottomLineNo = 0
+			selectedLineNo = 0
+		},
+		selected: selected,
+	}
+}
+
+// historyLost is true if we were scrolled back to lines that have since been overwritten by new
+// ones, so we've moved on to the oldest lines that are left.
+var historyLost bool
+
+// historyLostMessage is what we show while historyLost is set.
+const historyLostMessage = "Older lines have been overwritten"
+
+// clampScroll makes sure that the given bottom line number doesn't scroll us back to lines that
+// have expired from the buffer while we were looking at them (they've been overwritten by new
+// lines). If it does, it returns the bottom line number that puts the oldest lines that are left
+// at the top of the screen, and true. You should only call this method when you've got the
+// device's mutex locked.
+func clampScroll(d *Device, rows int, bottom int64) (int64, bool) {
+	if bottom == 0 {
+		return 0, false
+	}
+	lb, lineNos := d.GetViewLineNos(viewIndex, bottom, rows)
+	if len(lineNos) == rows {
+		return bottom, false
+	}
+	// The screen's not full. That's fine if there's just nothing older in the view, but not if
+	// the older lines have expired.
+	first := lb.GetFirstLineNo()
+	if viewIndex == 0 && first == 1 {
+		return bottom, false
+	}
+	if viewIndex > 0 {
+		if index := d.logViews[viewIndex-1].index; len(index) == 0 || index[0] >= first {
+			return bottom, false
+		}
+	}
+
+	// Some of the lines on screen have expired, so keep the oldest line that's left at the top.
+	if viewIndex == 0 {
+		bottom = first + int64(rows) - 1
+	} else {
+		index := d.logViews[viewIndex-1].index
+		i := sort.Search(len(index), func(i int) bool { return index[i] >= first })
+		bottom = 0
+		if i+rows-1 < len(index) {
+			bottom = index[i+rows-1]
+		}
+	}
+	if bottom >= lb.GetLastLineNo() {
+		bottom = 0
+	}
+	return bottom, bottom != 0
+}
+
+// visibleLineNos returns the buffer and line numbers of the lines that fit in the given number of
+// rows of the current view, newest first, sorted by timestamp if sortByTime is set. It also returns
+// the bottom line number they go up from, which is bottomLineNo after pausing and clampScroll have
+// had their say, and whether clampScroll moved it (see historyLost). It's up to the caller whether
+// to store those. You should only call this method when you've got the device's mutex locked.
+func visibleLineNos(d *Device, rows int) (*LogBuffer, []int64, int64, bool) {
+	bottom := bottomLineNo
+	if paused && bottom == 0 {
+		bottom = d.ViewBuffer(viewIndex).GetLastLineNo()
+	}
+	bottom, lost := clampScroll(d, rows, bottom)
+	lb, lineNos := d.GetViewLineNos(viewIndex, bottom, rows)
+	if sortByTime {
+		SortByTimestamp(lb, lineNos)
+	}
+	return lb, lineNos, bottom, lost
+}
+
+// SortByTimestamp sorts the given line numbers (which are newest first) so that they're in
+// descending order of the lines' timestamps. Lines with the same timestamp stay in the order they
+// arrived, and lines without a timestamp (e.g. the "beginning of" separators) stay just after the
+// line that arrived before them.
+func SortByTimestamp(lb *LogBuffer, lineNos []int64) {
+	timestamps := make(map[int64]string, len(lineNos))
+	prev := ""
+	for i := len(lineNos) - 1; i >= 0; i-- {
+		if e := lb.GetEntry(lineNos[i]); e.Parsed {
+			prev = e.Timestamp
+		}
+		timestamps[lineNos[i]] = prev
+	}
+	sort.SliceStable(lineNos, func(i, j int) bool {
+		return timestamps[lineNos[i]] > timestamps[lineNos[j]]
+	})
+}
+
+// ForEachLine calls fn with every line in the buffer, oldest first. You should only call this
+// method when you've got the device's mutex locked.
+func (lb *LogBuffer) ForEachLine(fn func(lineNo int64, line string)) {
+	for no := lb.GetFirstLineNo(); no <= lb.lineNo; no++ {
+		fn(no, lb.GetLine(no))
+	}
+}
+
+// ForEachEntry is ForEachLine with each line's parsed LogEntry. You should only call this method
+// when you've got the device's mutex locked.
+func (lb *LogBuffer) ForEachEntry(fn func(lineNo int64, e LogEntry)) {
+	for no := lb.GetFirstLineNo(); no <= lb.lineNo; no++ {
+		fn(no, lb.GetEntry(no))
+	}
+}
+
+// GetAllLines returns every line in the given view (0 == the full LogBuffer, 1 == the first
+// LogView, etc), oldest first. You should only call this method when you've got the device's
+// mutex locked.
+func (d *Device) GetAllLines(view int) []string {
+	lb := d.logBuffer
+	var lines []string
+	if view == 0 {
+		lb.ForEachLine(func(_ int64, line string) {
+			lines = append(lines, line)
+		})
+	} else {
+		lv := d.logViews[view-1]
+		for _, no := range lv.index {
+			if lv.lb.HasLine(no) {
+				lines = append(lines, lv.lb.GetLine(no))
+			}
+		}
+	}
+	return lines
+}
+
+// exportedLine is how we represent a single line when exporting as JSON. Lines that couldn't be
+// parsed just have the Message.
+type exportedLine struct {
+	Timestamp string `json:"timestamp,omitempty"`
+	PID       int    `json:"pid,omitempty"`
+	TID       int    `json:"tid,omitempty"`
+	Level     string `json:"level,omitempty"`
+	Tag       string `json:"tag,omitempty"`
+	Message   string `json:"message"`
+}
+
+// WriteLines writes the given lines to w in the given export format. "raw" is just the lines as we
+// got them from logcat, "csv" and "json" split each line into its parsed columns. JSON is written
+// as one object per line.
+func WriteLines(w io.Writer, format string, lines []string) error {
+	return writeLines(w, format, lines, true)
+}
+
+// writeLines is WriteLines, except that the CSV header is only written if header is true, so that
+// more lines can be appended to a file that's already been written to.
+func writeLines(w io.Writer, format string, lines []string, header bool) error {
+	switch format {
+	case "raw":
+		bw := bufio.NewWriter(w)
+		for _, line := range lines {
+			bw.WriteString(line)
+			bw.WriteByte('\n')
+		}
+		return bw.Flush()
+	case "csv":
+		cw := csv.NewWriter(w)
+		if header {
+			cw.Write([]string{"timestamp", "pid", "tid", "level", "tag", "message"})
+		}
+		for _, line := range lines {
+			ll, ok := ParseLogLine(line)
+			if !ok {
+				cw.Write([]string{"", "", "", "", "", ll.Message})
+				continue
+			}
+			cw.Write([]string{ll.Timestamp, strconv.Itoa(ll.PID), strconv.Itoa(ll.TID),
+				string(ll.Level), ll.Tag, ll.Message})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		enc := json.NewEncoder(w)
+		for _, line := range lines {
+			ll, ok := ParseLogLine(line)
+			el := exportedLine{Message: ll.Message}
+			if ok {
+				el = exportedLine{ll.Timestamp, ll.PID, ll.TID, string(ll.Level), ll.Tag, ll.Message}
+			}
+			if err := enc.Encode(el); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown export format: %s", format)
+}
+
+// Draw draws the EditBox in the given location
+func (eb *EditBox) Draw(x, y, w int) {
+	eb.AdjustVisualOffset(w)
+
+	const coldef = termbox.ColorDefault
+	fill(x, y, w, 1, termbox.Cell{Ch: ' '})
+
+	t := eb.text
+	lx := 0
+	tabstop := 0
+	for {
+		rx := lx - eb.visualOffset
+		if len(t) == 0 {
+			break
+		}
+
+		if rx >= w {
+			tbprint(x+w-1, y, coldef, coldef, glyphs.MoreRight)
+			break
+		}
+
+		r, size := utf8.DecodeRune(t)
+		if r == '\t' {
+			for ; lx < tabstop; lx++ {
+				rx = lx - eb.visualOffset
+				if rx >= w {
+					goto next
+				}
+
+				if rx >= 0 {
+					screen.SetCell(x+rx, y, ' ', coldef, coldef)
+				}
+			}
+		} else {
+			if rx >= 0 {
+				screen.SetCell(x+rx, y, r, coldef, coldef)
+			}
+			lx += runewidth.RuneWidth(r)
+		}
+	next:
+		t = t[size:]
+	}
+
+	if eb.visualOffset != 0 {
+		tbprint(x, y, coldef, coldef, glyphs.MoreLeft)
+	}
+}
+
+// AdjustVisualOffset adjusts line visual offset to a proper value depending on width
+func (eb *EditBox) AdjustVisualOffset(width int) {
+	ht := PreferredHorizontalThreshold
+	maxHorizontalThreshold := (width - 1) / 2
+	if ht > maxHorizontalThreshold {
+		ht = maxHorizontalThreshold
+	}
+
+	threshold := width - 1
+	if eb.visualOffset != 0 {
+		threshold = width - ht
+	}
+	if eb.cursorOffsetCells-eb.visualOffset >= threshold {
+		eb.visualOffset = eb.cursorOffsetCells + (ht - width + 1)
+	}
+
+	if eb.visualOffset != 0 && eb.cursorOffsetCells-eb.visualOffset < ht {
+		eb.visualOffset = eb.cursorOffsetCells - ht
+		if eb.visualOffset < 0 {
+			eb.visualOffset = 0
+		}
+	}
+}
+
+func adjustOffset(text []byte, offsetBytes int) (offsetCells, offsetRunes int) {
+	text = text[:offsetBytes]
+	for len(text) > 0 {
+		r, size := utf8.DecodeRune(text)
+		text = text[size:]
+		offsetRunes++
+		offsetCells += runewidth.RuneWidth(r)
+	}
+	return
+}
+
+// MoveCursorTo moves the cursor to the given byte offset.
+func (eb *EditBox) MoveCursorTo(offsetBytes int) {
+	eb.cursorOffsetBytes = offsetBytes
+	eb.cursorOffsetCells, eb.cursorOffsetRunes = adjustOffset(eb.text, offsetBytes)
+}
+
+// RuneUnderCursor returns the rune (and it's size) under the cursor.
+func (eb *EditBox) RuneUnderCursor() (rune, int) {
+	return utf8.DecodeRune(eb.text[eb.cursorOffsetBytes:])
+}
+
+// RuneBeforeCursor returns the rune (and it's size) before the cursor.
+func (eb *EditBox) RuneBeforeCursor() (rune, int) {
+	return utf8.DecodeLastRune(eb.text[:eb.cursorOffsetBytes])
+}
+
+// MoveCursorOneRuneBackward moves the cursor one rune to the left (if possible)
+func (eb *EditBox) MoveCursorOneRuneBackward() {
+	if eb.cursorOffsetBytes == 0 {
+		return
+	}
+	_, size := eb.RuneBeforeCursor()
+	eb.MoveCursorTo(eb.cursorOffsetBytes - size)
+}
+
+// MoveCursorOneRuneForward moves the cursor one run to the right (if possible)
+func (eb *EditBox) MoveCursorOneRuneForward() {
+	if eb.cursorOffsetBytes == len(eb.text) {
+		return
+	}
+	_, size := eb.RuneUnderCursor()
+	eb.MoveCursorTo(eb.cursorOffsetBytes + size)
+}
+
+// MoveCursorOneWordBackward moves the cursor to the start of the word before it, skipping over any
+// spaces first.
+func (eb *EditBox) MoveCursorOneWordBackward() {
+	offset := eb.cursorOffsetBytes
+	for _, inWord := range []bool{false, true} {
+		for offset > 0 {
+			r, size := utf8.DecodeLastRune(eb.text[:offset])
+			if unicode.IsSpace(r) == inWord {
+				break
+			}
+			offset -= size
+		}
+	}
+	eb.MoveCursorTo(offset)
+}
+
+// MoveCursorOneWordForward moves the cursor past the end of the word it's in (or the next one, if
+// it's on a space), and the spaces after it.
+func (eb *EditBox) MoveCursorOneWordForward() {
+	offset := eb.cursorOffsetBytes
+	for _, inWord := range []bool{true, false} {
+		for offset < len(eb.text) {
+			r, size := utf8.DecodeRune(eb.text[offset:])
+			if unicode.IsSpace(r) == inWord {
+				break
+			}
+			offset += size
+		}
+	}
+	eb.MoveCursorTo(offset)
+}
+
+// MoveCursorToBeginningOfTheLine moves the cursor to the beginning of the line.
+func (eb *EditBox) MoveCursorToBeginningOfTheLine() {
+	eb.MoveCursorTo(0)
+}
+
+// MoveCursorToEndOfTheLine moves the cursor to the end of the line.
+func (eb *EditBox) MoveCursorToEndOfTheLine() {
+	eb.MoveCursorTo(len(eb.text))
+}
+
+// DeleteRuneBackward delets the rune to the left of the cursor.
+func (eb *EditBox) DeleteRuneBackward() {
+	if eb.cursorOffsetBytes == 0 {
+		return
+	}
+
+	eb.MoveCursorOneRuneBackward()
+	_, size := eb.RuneUnderCursor()
+	eb.text = byteSliceRemove(eb.text, eb.cursorOffsetBytes, eb.cursorOffsetBytes+size)
+}
+
+// DeleteWordBackward deletes from the start of the word before the cursor (see
+// MoveCursorOneWordBackward) up to the cursor.
+func (eb *EditBox) DeleteWordBackward() {
+	to := eb.cursorOffsetBytes
+	eb.MoveCursorOneWordBackward()
+	eb.text = byteSliceRemove(eb.text, eb.cursorOffsetBytes, to)
+}
+
+// DeleteRuneForward deletes the rune to the right of the cursor.
+func (eb *EditBox) DeleteRuneForward() {
+	if eb.cursorOffsetBytes == len(eb.text) {
+		return
+	}
+	_, size := eb.RuneUnderCursor()
+	eb.text = byteSliceRemove(eb.text, eb.cursorOffsetBytes, eb.cursorOffsetBytes+size)
+}
+
+// DeleteTheRestOfTheLine deletes everything to the right of the cursor.
+func (eb *EditBox) DeleteTheRestOfTheLine() {
+	eb.text = eb.text[:eb.cursorOffsetBytes]
+}
+
+// SetText sets the current text to the given value
+func (eb *EditBox) SetText(text string) {
+	eb.text = []byte(text)
+	if eb.cursorOffsetBytes > len(eb.text) {
+		eb.MoveCursorTo(len(eb.text))
+	}
+}
+
+// InsertRune inserts the given rune at the current cursor position.
+func (eb *EditBox) InsertRune(r rune) {
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+	eb.text = byteSliceInsert(eb.text, eb.cursorOffsetBytes, buf[:n])
+	eb.MoveCursorOneRuneForward()
+}
+
+// ReplaceBeforeCursor replaces the n bytes before the cursor with the given text, leaving the
+// cursor after the new text.
+func (eb *EditBox) ReplaceBeforeCursor(n int, text string) {
+	from := eb.cursorOffsetBytes - n
+	eb.text = byteSliceRemove(eb.text, from, eb.cursorOffsetBytes)
+	eb.text = byteSliceInsert(eb.text, from, []byte(text))
+	eb.MoveCursorTo(from + len(text))
+}
+
+// CursorX ...
+// Please, keep in mind that cursor depends on the value of visualOffset, which
+// is being set on Draw() call, so.. call this method after Draw() one.
+func (eb *EditBox) CursorX() int {
+	return eb.cursorOffsetCells - eb.visualOffset
+}
+
+func byteSliceRemove(text []byte, from, to int) []byte {
+	size := to - from
+	copy(text[from:], text[to:])
+	text = text[:len(text)-size]
+	return text
+}
+
+func byteSliceGrow(s []byte, desiredCap int) []byte {
+	if cap(s) < desiredCap {
+		ns := make([]byte, len(s), desiredCap)
+		copy(ns, s)
+		return ns
+	}
+	return s
+}
+
+func byteSliceInsert(text []byte, offset int, what []byte) []byte {
+	n := len(text) + len(what)
+	text = byteSliceGrow(text, n)
+	text = text[:n]
+	copy(text[offset+len(what):], text[offset:])
+	copy(text[offset:], what)
+	return text
+}
+
+// Screen is where we draw everything, and where key presses come from. It's normally the terminal
+// (via termbox), but tests can replace it with one of their own.
+type Screen interface {
+	Size() (int, int)
+	Clear(fg, bg termbox.Attribute)
+	SetCell(x, y int, ch rune, fg, bg termbox.Attribute)
+	SetCursor(x, y int)
+	Flush()
+	PollEvent() termbox.Event
+	Bell()
+}
+
+// termboxScreen is the Screen that draws to the terminal with termbox.
+type termboxScreen struct{}
+
+func (termboxScreen) Size() (int, int) {
+	return termbox.Size()
+}
+
+func (termboxScreen) Clear(fg, bg termbox.Attribute) {
+	termbox.Clear(fg, bg)
+}
+
+func (termboxScreen) SetCell(x, y int, ch rune, fg, bg termbox.Attribute) {
+	termbox.SetCell(x, y, ch, fg, bg)
+}
+
+func (termboxScreen) SetCursor(x, y int) {
+	termbox.SetCursor(x, y)
+}
+
+func (termboxScreen) Flush() {
+	termbox.Flush()
+}
+
+func (termboxScreen) PollEvent() termbox.Event {
+	return termbox.PollEvent()
+}
+
+func (termboxScreen) Bell() {
+	// termbox hasn't got a way to ring the bell, but the terminal doesn't mind us writing it.
+	os.Stdout.WriteString("\a")
+}
+
+// screen is the Screen we draw to.
+var screen Screen = termboxScreen{}
+
+func tbprint(x, y int, fg, bg termbox.Attribute, msg string) int {
+	n := 0
+	for _, c := range msg {
+		screen.SetCell(x, y, c, fg, bg)
+		width := runewidth.RuneWidth(c)
+		x += width
+		n += width
+	}
+	return n
+}
+
+// drawList draws the given items in a box of the given width, with its bottom-left corner at x, y
+// (so that it pops up above whatever's at y+1). The selected item is highlighted.
+func drawList(x, y, w int, items []string, selected int) {
+	coldef := termbox.ColorDefault
+	for i, item := range items {
+		row := y - len(items) + 1 + i
+		attr := coldef
+		if i == selected {
+			attr |= termbox.AttrReverse
+		}
+		fill(x, row, w, 1, termbox.Cell{Ch: ' ', Fg: attr, Bg: attr})
+		tbprint(x+1, row, attr, attr, item)
+	}
+}
+
+// columnar is true if we draw lines with their columns lined up (see FormatColumns), rather than
+// exactly as logcat printed them.
+var columnar bool
+
+// hideRepeatedTags is true if, in columnar mode, we leave the tag blank when it's the same as the
+// line above's.
+var hideRepeatedTags bool
+
+// ColumnTagWidth is how wide the tag column is in columnar mode. Longer tags are truncated.
+const ColumnTagWidth = 20
+
+// FormatColumns formats the given line so that its columns line up with every other line's. If
+// hideTag is true, the tag is left blank. Lines that can't be parsed are returned unchanged.
+func FormatColumns(e LogEntry, hideTag bool) string {
+	if !e.Parsed {
+		return e.Line
+	}
+	ll := e.LogLine
+	tag := ""
+	if !hideTag {
+		tag = runewidth.Truncate(ll.Tag, ColumnTagWidth, glyphs.TagEllipsis)
+	}
+	return fmt.Sprintf("%s %5d %5d %c %s %s", ll.Timestamp, ll.PID, ll.TID, ll.Level,
+		runewidth.FillRight(tag, ColumnTagWidth), ll.Message)
+}
+
+// Highlight is a range of bytes in a line that should be drawn in a different color.
+type Highlight struct {
+	Start int
+	End   int
+	Fg    termbox.Attribute
+}
+
+// drawLogLine draws the given line at row y, in the given colors except for the highlighted ranges
+// (if ranges overlap, the last one wins).
+func drawLogLine(y int, line string, fg, bg termbox.Attribute, highlights []Highlight) {
+	drawLogLineAt(0, y, line, fg, bg, highlights)
+}
+
+// drawLogLineAt is drawLogLine starting at column x rather than the left edge.
+func drawLogLineAt(x, y int, line string, fg, bg termbox.Attribute, highlights []Highlight) {
+	for offset, c := range line {
+		attr := fg
+		for _, hl := range highlights {
+			if offset >= hl.Start && offset < hl.End {
+				attr = hl.Fg | (fg & (termbox.AttrReverse | termbox.AttrBold))
+			}
+		}
+		c = displayRune(c)
+		screen.SetCell(x, y, c, attr, bg)
+		x += runewidth.RuneWidth(c)
+	}
+	if w, _ := screen.Size(); x > w && glyphs.LineCut != "" {
+		tbprint(w-runewidth.StringWidth(glyphs.LineCut), y, fg|termbox.AttrBold, bg, glyphs.LineCut)
+	}
+}
+
+// displayRune returns the rune we draw for c. Control characters and invalid UTF-8 would mess up
+// the terminal, so they're drawn as dots (see hexDumpSelectedLine to see what they really are).
+func displayRune(c rune) rune {
+	if c == '\t' {
+		return ' '
+	} else if c == utf8.RuneError || !unicode.IsPrint(c) {
+		return '·'
+	}
+	return c
+}
+
+// DisplayWidth returns how many cells wide the given line is when we draw it, with each rune as
+// displayRune draws it.
+func DisplayWidth(line string) int {
+	width := 0
+	for _, c := range line {
+		width += runewidth.RuneWidth(displayRune(c))
+	}
+	return width
+}
+
+// WrapOffsets returns the byte offsets in line that each row starts at when it's wrapped to the
+// given width, with every row after the first indented by the given number of cells. There's always
+// at least one row, even for an empty line.
+func WrapOffsets(line string, width, indent int) []int {
+	offsets := []int{0}
+	x := 0
+	for offset, c := range line {
+		cw := runewidth.RuneWidth(displayRune(c))
+		if x+cw > width && x > indent {
+			offsets = append(offsets, offset)
+			x = indent
+		}
+		x += cw
+	}
+	return offsets
+}
+
+// drawWrappedLine draws the given line wrapped to the given width, with its last row at row y and
+// none of it above row top. Each row after the first starts with the given mark. It returns how
+// many rows the whole line takes up.
+func drawWrappedLine(y, top, width int, line, mark string, fg, bg termbox.Attribute, highlights []Highlight) int {
+	indent := runewidth.StringWidth(mark)
+	if indent >= width/2 {
+		mark, indent = "", 0
+	}
+	offsets := WrapOffsets(line, width, indent)
+	for i := len(offsets) - 1; i >= 0; i-- {
+		row := y - (len(offsets) - 1 - i)
+		if row < top {
+			break
+		}
+		end := len(line)
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		var shifted []Highlight
+		for _, hl := range highlights {
+			shifted = append(shifted, Highlight{hl.Start - offsets[i], hl.End - offsets[i], hl.Fg})
+		}
+		fill(0, row, width, 1, termbox.Cell{Ch: ' ', Fg: bg, Bg: bg})
+		if i == 0 {
+			drawLogLine(row, line[:end], fg, bg, shifted)
+		} else {
+			tbprint(0, row, termbox.ColorDarkGray|(bg&termbox.AttrReverse), bg, mark)
+			drawLogLineAt(indent, row, line[offsets[i]:end], fg, bg, shifted)
+		}
+	}
+	return len(offsets)
+}
+
+// scrollX is how many cells the log lines are scrolled to the left by, so that the end of a long
+// line can be read without wrapping it. See scrollHorizontally.
+var scrollX int
+
+// widestLogLine is how many cells wide the widest log line was last time we rendered, which is as
+// far as there is to scroll horizontally.
+var widestLogLine int
+
+// CellOffset returns the byte offset in line of the first rune that starts at least cells cells
+// in, or len(line) if the line isn't that wide.
+func CellOffset(line string, cells int) int {
+	x := 0
+	for offset, c := range line {
+		if x >= cells {
+			return offset
+		}
+		x += runewidth.RuneWidth(displayRune(c))
+	}
+	return len(line)
+}
+
+// drawScrolledLine is drawLogLine, but with the line scrolled left by scrollX cells. While we're
+// scrolled, the MoreLeft and MoreRight glyphs show that there's more of the line off either edge.
+func drawScrolledLine(y int, line string, fg, bg termbox.Attribute, highlights []Highlight) {
+	if scrollX == 0 {
+		drawLogLine(y, line, fg, bg, highlights)
+		return
+	}
+	start := CellOffset(line, scrollX)
+	var shifted []Highlight
+	for _, hl := range highlights {
+		shifted = append(shifted, Highlight{hl.Start - start, hl.End - start, hl.Fg})
+	}
+	rest := line[start:]
+	drawLogLineAt(0, y, rest, fg, bg, shifted)
+	tbprint(0, y, fg|termbox.AttrBold, bg, glyphs.MoreLeft)
+	if w, _ := screen.Size(); DisplayWidth(rest) > w {
+		tbprint(w-runewidth.StringWidth(glyphs.MoreRight), y, fg|termbox.AttrBold, bg, glyphs.MoreRight)
+	}
+}
+
+// scrollHorizontally scrolls the log lines half a screen to the right (or left, if direction is
+// negative), stopping at the start of the lines and once the widest one on screen is all visible.
+func scrollHorizontally(direction int) {
+	if currentViewWraps() {
+		statusMessage = "Long lines are wrapped, so there's nothing to scroll (see toggle-wrap)"
+		return
+	}
+	w, _ := screen.Size()
+	step := w / 2
+	if step < 1 {
+		step = 1
+	}
+	scrollX += direction * step
+	if limit := widestLogLine - w; scrollX > limit {
+		scrollX = limit
+	}
+	if scrollX < 0 {
+		scrollX = 0
+	}
+}
+
+// currentViewWraps returns true if the current view wraps its long lines (see toggleWrapLines).
+func currentViewWraps() bool {
+	if device := currentDevice(); device != nil && viewIndex > 0 {
+		return device.logViews[viewIndex-1].wrap
+	}
+	return wrapLines
+}
+
+// wrapLines is true if we wrap every line that's too long for the screen over as many rows as it
+// needs, rather than cutting it off, from the -wrap flag. It's for the "no filter" view, and new
+// filters start out with it too, but each filter can be toggled on its own (see LogView.wrap).
+var wrapLines bool
+
+// toggleLevelColors turns coloring lines by their level on or off.
+func toggleLevelColors() {
+	levelColors = !levelColors
+	if levelColors {
+		statusMessage = "Coloring lines by level"
+	} else {
+		statusMessage = "Not coloring lines by level"
+	}
+}
+
+// toggleWrapLines switches the current view between wrapping long lines and cutting them off.
+func toggleWrapLines() {
+	wrap := &wrapLines
+	if device := currentDevice(); device != nil && viewIndex > 0 {
+		wrap = &device.logViews[viewIndex-1].wrap
+	}
+	*wrap = !*wrap
+	if *wrap {
+		statusMessage = "Wrapping long lines"
+	} else {
+		statusMessage = "Cutting long lines off at the edge of the screen"
+	}
+}
+
+// toggleWrapSelected wraps the selected line over as many rows as it needs, or unwraps it.
+func toggleWrapSelected() {
+	if selectedLineNo == 0 {
+		statusMessage = "Select a line to wrap first"
+		return
+	}
+	if wrappedLineNo == selectedLineNo {
+		wrappedLineNo = 0
+	} else {
+		wrappedLineNo = selectedLineNo
+	}
+}
+
+// countUnique counts how many times each distinct value captured by the given regex's first group
+// (or the whole match, if it hasn't got a group) appears in the current view, and shows them in an
+// overlay, most common first. Pressing Enter in the overlay counts them again.
+func countUnique(pattern string) {
+	device := currentDevice()
+	if device == nil {
+		return
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		statusMessage = err.Error()
+		return
+	}
+	device.mutex.Lock()
+	lines := device.GetAllLines(viewIndex)
+	device.mutex.Unlock()
+
+	counts := make(map[string]int)
+	for _, line := range lines {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		value := m[0]
+		if len(m) > 1 {
+			value = m[1]
+		}
+		counts[value]++
+	}
+
+	values := make([]string, 0, len(counts))
+	for value := range counts {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if counts[values[i]] != counts[values[j]] {
+			return counts[values[i]] > counts[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	items := make([]string, len(values))
+	summary := &Summary{Name: "counts", Columns: []string{"count", "value"}}
+	for i, value := range values {
+		items[i] = fmt.Sprintf("%7d  %s", counts[value], value)
+		summary.Rows = append(summary.Rows, []string{strconv.Itoa(counts[value]), value})
+	}
+	overlay = &Overlay{
+		Title: fmt.Sprintf("%d distinct values of %q in %d lines (Enter to count again%s)",
+			len(values), pattern, len(lines), exportHint()),
+		Items:    items,
+		OnSelect: func(int) { countUnique(pattern) },
+		Summary:  summary,
+	}
+}
+
+// Summary is a table that's been worked out from the logs (e.g. by countUnique), which can be
+// exported while it's shown in an overlay.
+type Summary struct {
+	// Name goes in the exported file's name.
+	Name    string
+	Columns []string
+	Rows    [][]string
+}
+
+// Write writes the summary in the given export format: "raw" is tab-separated with a header, "csv"
+// has a header too, and "json" is one object per row, keyed by column.
+func (s *Summary) Write(w io.Writer, format string) error {
+	switch format {
+	case "raw":
+		bw := bufio.NewWriter(w)
+		for _, row := range append([][]string{s.Columns}, s.Rows...) {
+			bw.WriteString(strings.Join(row, "\t"))
+			bw.WriteByte('\n')
+		}
+		return bw.Flush()
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(s.Columns)
+		cw.WriteAll(s.Rows)
+		return cw.Error()
+	case "json":
+		enc := json.NewEncoder(w)
+		for _, row := range s.Rows {
+			obj := make(map[string]string, len(s.Columns))
+			for i, column := range s.Columns {
+				obj[column] = row[i]
+			}
+			if err := enc.Encode(obj); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown export format: %s", format)
+}
+
+// exportSummary writes the given summary to a file named after the current device, the time and
+// the summary, in the configured exportFormat.
+func exportSummary(s *Summary) {
+	device := currentDevice()
+	if device == nil {
+		return
+	}
+	filename := exportFilename(device, "-"+s.Name)
+	f, err := os.Create(filename)
+	if err == nil {
+		err = s.Write(f, exportFormat)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		statusMessage = "Export failed: " + err.Error()
+	} else {
+		statusMessage = fmt.Sprintf("Exported %d rows to %s", len(s.Rows), filename)
+	}
+}
+
+// showRates shows an overlay with each device's line rate, and each filter's match count and
+// rate alert, as they are right now.
+func showRates() {
+	summary := &Summary{Name: "rates", Columns: []string{"device", "filter", "matches", "rate", "alert"}}
+	now := time.Now()
+	for _, d := range devices {
+		if !d.opened {
+			continue
+		}
+		d.mutex.Lock()
+		lines := d.logBuffer.GetLastLineNo() - d.logBuffer.GetFirstLineNo() + 1
+		summary.Rows = append(summary.Rows, []string{d.Name, "", strconv.FormatInt(lines, 10),
+			fmt.Sprintf("%d/s", d.rate), ""})
+		for _, lv := range d.logViews {
+			rate, alert := "", ""
+			if ra := lv.rateAlert; ra != nil {
+				rate = fmt.Sprintf("%d in %s", ra.Rate(now), ra.Window)
+				alert = fmt.Sprintf("over %d", ra.Count)
+			}
+			summary.Rows = append(summary.Rows, []string{d.Name, lv.Name, strconv.Itoa(len(lv.index)), rate, alert})
+		}
+		d.mutex.Unlock()
+	}
+
+	items := make([]string, len(summary.Rows))
+	for i, row := range summary.Rows {
+		items[i] = fmt.Sprintf("%-16s %-20s %8s  %-14s %s", row[0], row[1], row[2], row[3], row[4])
+	}
+	overlay = &Overlay{
+		Title: "Lines, matches and rates (Enter to refresh" + exportHint() + ")",
+		Items: append([]string{fmt.Sprintf("%-16s %-20s %8s  %-14s %s", "Device", "Filter", "Lines",
+			"Rate", "Alert")}, items...),
+		OnSelect: func(int) { showRates() },
+		Summary:  summary,
+	}
+}
+
+// shellQuote quotes the given string for a POSIX shell, if it needs it.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.:/=,") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// AdbCommand returns an adb command line that gets (as near as possible) the same lines as the
+// given view of the given device. Column filters become logcat's own options where they can, and
+// everything else is piped through grep. If there's anything that can't be done that way (e.g.
+// grouping), exact is false.
+func (d *Device) AdbCommand(view int) (cmd string, exact bool) {
+	args := []string{shellQuote(adbPath), "-s", shellQuote(d.ID), "logcat", "-v", "threadtime"}
+	if logcatBuffer != "" {
+		args = append(args, "-b", logcatBuffer)
+	}
+	// logcat only takes one --pid, so this is the one we've given it, if any.
+	pid := d.pid
+	if pid != 0 {
+		args = append(args, fmt.Sprintf("--pid=%d", pid))
+	}
+	if view == 0 {
+		return strings.Join(args, " "), true
+	}
+	lv := d.logViews[view-1]
+	exact = !lv.grouped && !lv.snapshot && lv.baseline == 0 && lv.minLevel == 0
+	if lv.negate {
+		// logcat can't leave out the lines that match a filter.
+		return strings.Join(args, " "), false
+	}
+
+	pf, err := ParseFilter(lv.filterText)
+	if err != nil {
+		return strings.Join(args, " "), false
+	}
+	var tags []string
+	level := "V"
+	var greps []string
+	for _, cf := range pf.Columns {
+		if cf.Regex != nil {
+			// logcat can't match a column against a regex, and grep would match it anywhere in the
+			// line.
+			exact = false
+			continue
+		}
+		switch cf.Column {
+		case "msg", "tid":
+			// logcat can't pick out a single thread, or match the message exactly.
+			exact = false
+		case "pid":
+			if n, _ := strconv.Atoi(cf.Value); pid == 0 {
+				pid = n
+				args = append(args, "--pid="+cf.Value)
+			} else if n != pid {
+				// We're already restricted to another process, so nothing matches.
+				exact = false
+			}
+		case "tag":
+			tags = append(tags, cf.Value)
+		case "level":
+			// logcat can only do "this level or above", so use the lowest one given.
+			given := ""
+			for _, l := range logLevels {
+				if strings.ContainsRune(strings.ToUpper(cf.Value), l) {
+					given += string(l)
+				}
+			}
+			level = given[:1]
+			if !strings.HasSuffix(logLevels, given) {
+				exact = false
+			}
+		case "stack":
+			greps = append(greps, "grep -E "+shellQuote(`: +(at [^ ]+\(|#[0-9]+ pc [0-9a-f]+ )`))
+			if cf.Value != "" {
+				exact = false
+			}
+		}
+	}
+	if len(tags) > 1 {
+		// A line can only have one tag, so nothing matches.
+		exact = false
+	}
+	if len(tags) > 0 {
+		args = append(args, shellQuote(tags[0]+":"+level), shellQuote("*:S"))
+	} else if level != "V" {
+		args = append(args, shellQuote("*:"+level))
+	}
+	if pf.PatternFile != "" {
+		greps = append(greps, "grep -E -f "+shellQuote(pf.PatternFile))
+	}
+	if pf.Package != "" {
+		// The package's PID changes whenever it restarts, which logcat can't follow.
+		exact = false
+	}
+	if pf.Regex != "" {
+		switch lv.engine {
+		case "fixed":
+			greps = append(greps, "grep -F "+shellQuote(pf.Regex))
+		case "glob":
+			greps = append(greps, "grep -E "+shellQuote(GlobToRegex(pf.Regex)))
+		default:
+			greps = append(greps, "grep -E "+shellQuote(pf.Regex))
+			if !GrepCompatible(pf.Regex) {
+				exact = false
+			}
+		}
+	}
+
+	cmd = strings.Join(args, " ")
+	for _, grep := range greps {
+		cmd += " | " + grep
+	}
+	return cmd, exact
+}
+
+// GrepCompatible returns true if the given regex means the same thing to 'grep -E' as it does to
+// Go. Perl-style escapes like \d or \b, flags and non-capturing groups like (?i), non-greedy
+// repeats, and escapes inside brackets (which are just backslashes to grep) are all Go's own.
+func GrepCompatible(re string) bool {
+	for i := 0; i < len(re); i++ {
+		next := byte(0)
+		if i+1 < len(re) {
+			next = re[i+1]
+		}
+		switch re[i] {
+		case '\\':
+			// Escaping punctuation is the same in both, but an escaped letter or digit isn't.
+			if unicode.IsLetter(rune(next)) || unicode.IsDigit(rune(next)) {
+				return false
+			}
+			i++
+		case '[':
+			j := i + 1
+			if j < len(re) && re[j] == '^' {
+				j++
+			}
+			if j < len(re) && re[j] == ']' {
+				j++
+			}
+			for ; j < len(re) && re[j] != ']'; j++ {
+				if re[j] == '\\' {
+					return false
+				}
+			}
+			i = j
+		case '(', '*', '+', '?', '}':
+			if next == '?' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// copyAdbCommand copies an adb command line that reproduces the current view to the clipboard.
+func copyAdbCommand() {
+	device := currentDevice()
+	if device == nil {
+		return
+	}
+	device.mutex.Lock()
+	cmd, exact := device.AdbCommand(viewIndex)
+	device.mutex.Unlock()
+	if err := CopyToClipboard(cmd); err != nil {
+		statusMessage = "Can't copy: " + err.Error()
+	} else if exact {
+		statusMessage = "Copied: " + cmd
+	} else {
+		statusMessage = "Copied (roughly the same): " + cmd
+	}
+}
+
+// selectedLine returns the text of the selected line. If there isn't one, or it's expired, the
+// status message says so and we return false.
+func selectedLine() (string, bool) {
+	device := currentDevice()
+	if device == nil || selectedLineNo == 0 {
+		statusMessage = "No line selected"
+		return "", false
+	}
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	lb := device.ViewBuffer(viewIndex)
+	if !lb.HasLine(selectedLineNo) {
+		statusMessage = "The selected line has expired"
+		return "", false
+	}
+	return lb.GetLine(selectedLineNo), true
+}
+
+// LooksBinary returns true if a good chunk of the given line is control characters or invalid
+// UTF-8, in which case it's probably a raw buffer that's better viewed as a hex dump.
+func LooksBinary(line string) bool {
+	binary := 0
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRuneInString(line[i:])
+		if (r == utf8.RuneError && size == 1) || (r != '\t' && !unicode.IsPrint(r)) {
+			binary++
+		}
+		i += size
+	}
+	return binary > 0 && binary*4 >= len(line)
+}
+
+// hexDumpSelectedLine shows an overlay with a hex dump of the selected line, for when it's got
+// binary data in it.
+func hexDumpSelectedLine() {
+	line, ok := selectedLine()
+	if !ok {
+		return
+	}
+	dump := strings.Split(strings.TrimRight(hex.Dump([]byte(line)), "\n"), "\n")
+	overlay = &Overlay{
+		Title: fmt.Sprintf("Line %d, %d bytes", selectedLineNo, len(line)),
+		Items: dump,
+	}
+}
+
+// drawSeparator draws a horizontal line across the whole of row y, with the given label in it.
+func drawSeparator(y, w int, label string) {
+	attr := termbox.ColorBlue
+	fill(0, y, w, 1, termbox.Cell{Ch: '─', Fg: attr})
+	tbprint(4, y, attr, termbox.ColorDefault, " "+label+" ")
+}
+
+func fill(x, y, w, h int, cell termbox.Cell) {
+	for ly := 0; ly < h; ly++ {
+		for lx := 0; lx < w; lx++ {
+			screen.SetCell(x+lx, y+ly, cell.Ch, cell.Fg, cell.Bg)
+		}
+	}
+}
+
+// renderCount and eventCount count how many times we've rendered, and how many events (key presses,
+// new lines, etc) we've handled, for the -stats flag.
+var renderCount, eventCount int
+
+func render() {
+	renderCount++
+	coldef := termbox.ColorDefault
+	screen.Clear(coldef, coldef)
+	l := currentLayout()
+	w := l.Width
+
+	// Top line, device list. If there's more than maxDevices, we show a window of them that
+	// includes the current one.
+	x := 0
+	coldef = termbox.ColorDefault | termbox.AttrReverse
+	first := 0
+	if deviceIndex >= maxDevices {
+		first = deviceIndex - maxDevices + 1
+	}
+	for i := first; i < len(devices) && i < first+maxDevices; i++ {
+		x += tbprint(x, l.DeviceBar, coldef, coldef, "［")
+		if i == deviceIndex {
+			coldef = termbox.ColorDefault
+		}
+		devices[i].mutex.Lock()
+		glyph, color := devices[i].state.Glyph()
+		x += tbprint(x, l.DeviceBar, coldef|color|termbox.AttrBold, coldef, string(glyph)+" ")
+		x += tbprint(x, l.DeviceBar, coldef, coldef, devices[i].Name)
+		if devices[i].pidPackage != "" {
+			x += tbprint(x, l.DeviceBar, coldef, coldef, " ("+devices[i].pidPackage+")")
+		}
+		if devices[i].alertPending {
+			screen.Bell()
+			devices[i].alertPending = false
+		}
+		if devices[i].frozen {
+			frozen := fmt.Sprintf(" ⏸ frozen, %d dropped", devices[i].droppedLines)
+			x += tbprint(x, l.DeviceBar, coldef|termbox.ColorRed|termbox.AttrBold, coldef, frozen)
+		} else if rate := devices[i].rate; rate >= rateWarning {
+			lag := fmt.Sprintf(" %d lines/sec, display may lag", rate)
+			x += tbprint(x, l.DeviceBar, coldef|termbox.ColorRed|termbox.AttrBold, coldef, lag)
+		} else if rate > 0 {
+			x += tbprint(x, l.DeviceBar, coldef, coldef, fmt.Sprintf(" %d/s", rate))
+		}
+		if err := devices[i].err; err != nil && devices[i].state != StateStreaming {
+			x += tbprint(x, l.DeviceBar, coldef|termbox.ColorRed, coldef, " "+err.Error())
+		}
+		devices[i].mutex.Unlock()
+		coldef = termbox.ColorDefault | termbox.AttrReverse
+		x += tbprint(x, l.DeviceBar, coldef, coldef, "］")
+	}
+	if hidden := len(devices) - maxDevices; hidden > 0 {
+		x += tbprint(x, l.DeviceBar, coldef, coldef, fmt.Sprintf(" (+%d more)", hidden))
+	}
+	if devicesErr != nil {
+		x += tbprint(x, l.DeviceBar, coldef|termbox.ColorRed, coldef, " "+devicesErr.Error())
+	}
+	for ; x < w; x++ {
+		screen.SetCell(x, l.DeviceBar, ' ', coldef, coldef)
+	}
+
+	// Pinned lines, in the order the tags were given, and then the log lines from the bottom up.
+	// If the selected line has a note, it's shown in place of a status message.
+	top := l.LogTop
+	selectedNote := ""
+	coldef = termbox.ColorDefault
+	if device := currentDevice(); device != nil {
+		device.mutex.Lock()
+		for i, tag := range pinnedTags {
+			if i >= l.PinnedRows {
+				break
+			}
+			if line, ok := device.pinned[tag]; ok {
+				drawLogLine(l.PinnedTop+i, line, coldef, coldef, KeywordHighlights(line))
+			} else {
+				tbprint(0, l.PinnedTop+i, coldef|termbox.AttrBold, coldef, tag+": nothing logged yet")
+			}
+		}
+		if l.PinnedRows > 0 {
+			drawSeparator(l.PinnedTop+l.PinnedRows, w, "pinned")
+		}
+
+		// Rendering is what moves us on from lines that have expired, and pins the screen when
+		// we've paused, so hold on to where that leaves us.
+		lb, lineNos, bottom, lost := visibleLineNos(device, l.LogRows)
+		bottomLineNo, historyLost = bottom, lost
+		var matcher Matcher
+		wrap := wrapLines
+		if viewIndex > 0 {
+			lv := device.logViews[viewIndex-1]
+			lv.lastViewedLineNo = lv.GetLastLineNo()
+			if !lv.negate && lv.err == nil {
+				matcher = lv.filter
+			}
+			wrap = lv.wrap
+		}
+
+		// markerBelow returns true if there's a launch marker between the i'th line and the one
+		// below it. Snapshots have their own buffer, with their own line numbers, so there's no
+		// launch marker in them.
+		markerBelow := func(i int) bool {
+			return showLaunchMarker && !sortByTime && lb == device.logBuffer && i > 0 &&
+				lineNos[i-1] > device.launchLineNo && lineNos[i] <= device.launchLineNo
+		}
+		y := l.LogBottom()
+		widestLogLine = 0
+		for i, lineNo := range lineNos {
+			if y < top {
+				break
+			}
+			if markerBelow(i) {
+				drawSeparator(y, w, "since launch")
+				y--
+			}
+			if y < top {
+				break
+			}
+			attr := coldef
+			if lineNo == selectedLineNo {
+				attr |= termbox.AttrReverse
+				fill(0, y, w, 1, termbox.Cell{Ch: ' ', Fg: attr, Bg: attr})
+			}
+			e := lb.GetEntry(lineNo)
+			line := e.Line
+			if markerMode == "styled" && lineNo != selectedLineNo && IsBufferMarker(line) {
+				drawSeparator(y, w, strings.TrimLeft(line, "- "))
+				y--
+				continue
+			}
+			fg := attr
+			if levelColors && lineNo != selectedLineNo {
+				fg = LevelColor(e.Level)
+			}
+			if continuationColor != termbox.ColorDefault && lineNo != selectedLineNo {
+				if lb.HasLine(lineNo-1) && IsContinuation(lb.GetEntry(lineNo-1), e) {
+					fg = continuationColor
+				}
+			}
+			if columnar {
+				// The top line on screen always shows its tag, as does the line under a marker.
+				hideTag := false
+				if hideRepeatedTags && y > top && i+1 < len(lineNos) && !markerBelow(i+1) {
+					above := lb.GetEntry(lineNos[i+1])
+					hideTag = above.Parsed && e.Parsed && above.Tag == e.Tag
+				}
+				line = FormatColumns(e, hideTag)
+			}
+			if name := device.processes[e.PID]; processNames && name != "" {
+				line = WithProcessName(line, e, name)
+			}
+			highlights := append(KeywordHighlights(line), MatchHighlights(matcher, line)...)
+			highlights = append(highlights, MatchHighlights(searchMatcher, line)...)
+			rows := 1
+			if wrap {
+				rows = drawWrappedLine(y, top, w, line, glyphs.WrapMark, fg, attr, highlights)
+			} else if lineNo == selectedLineNo && lineNo == wrappedLineNo {
+				rows = drawWrappedLine(y, top, w, line, "", fg, attr, highlights)
+			} else {
+				drawScrolledLine(y, line, fg, attr, highlights)
+				if lw := DisplayWidth(line); lw > widestLogLine {
+					widestLogLine = lw
+				}
+			}
+			if note, ok := device.notes[lineNo]; ok && lb == device.logBuffer {
+				screen.SetCell(w-1, y, '✎', termbox.ColorYellow|termbox.AttrBold, attr)
+				if lineNo == selectedLineNo {
+					selectedNote = note
+				}
+			}
+			y -= rows
+		}
+		splitTimestamp := ""
+		if linkSplit && bottomLineNo != 0 && len(lineNos) > 0 {
+			splitTimestamp = TimestampAt(lb, lineNos[0])
+		}
+		device.mutex.Unlock()
+		if l.SplitRows > 0 {
+			drawSplitPane(l, splitTimestamp)
+		}
+	}
+	if overlay != nil {
+		drawOverlay(l.PinnedTop, l.LogBottom(), w)
+	}
+
+	// The filter, or the prompt we're asking in its place, with the match count (or the line count,
+	// in the "no filter" view) beside it unless there's a status row for it. When we're scrolled
+	// back, it also says where the bottom of the screen is.
+	// TODO: the first tab ("no filter") should have no filter line
+	y := l.EditBox
+	editX := 1
+	if prompt != nil {
+		editX += tbprint(1, y, termbox.ColorDefault|termbox.AttrBold, termbox.ColorDefault, prompt.Label) + 1
+	}
+	var count string
+	var filterErr error
+	if device := currentDevice(); device != nil && viewIndex == 0 && prompt == nil {
+		device.mutex.Lock()
+		count = Plural(device.logBuffer.Len(), "line", "lines")
+		if bottomLineNo != 0 {
+			count = fmt.Sprintf("line %d of %d", bottomLineNo, device.logBuffer.GetLastLineNo())
+		}
+		device.mutex.Unlock()
+	}
+	if device := currentDevice(); device != nil && viewIndex > 0 && prompt == nil {
+		device.mutex.Lock()
+		lv := device.logViews[viewIndex-1]
+		if device.preview != nil {
+			count = Plural(len(device.preview.index), "line would match", "lines would match")
+		} else if lv.err == nil && bottomLineNo != 0 {
+			position := sort.Search(len(lv.index), func(i int) bool { return lv.index[i] > bottomLineNo })
+			count = fmt.Sprintf("match %d of %d", position, len(lv.index))
+		} else if lv.err == nil {
+			count = Plural(len(lv.index), "match", "matches")
+		}
+		if lv.baseline > 0 && count != "" {
+			count += fmt.Sprintf(" after line %d", lv.baseline)
+		}
+		if lv.pkg != "" && count != "" {
+			if lv.pkgErr != nil {
+				count += ", " + lv.pkgErr.Error()
+			} else if lv.pkgPID != 0 {
+				count += fmt.Sprintf(", %s is pid %d", lv.pkg, lv.pkgPID)
+			}
+		}
+		if lv.compareTo != nil && count != "" {
+			count += fmt.Sprintf(", %d not in %s", len(lv.Difference()), lv.compareTo.Name)
+		}
+		if lv.engine != "regex" && lv.engine != "" && count != "" {
+			count += " (" + lv.engine + ")"
+		}
+		if ra := lv.rateAlert; ra != nil && count != "" {
+			count += fmt.Sprintf(", %d in %s (alert over %d)", ra.Rate(time.Now()), ra.Window, ra.Count)
+		}
+		filterErr = lv.err
+		device.mutex.Unlock()
+	}
+	message := statusMessage
+	if message == "" && selectedNote != "" {
+		message = "✎ " + selectedNote
+	}
+	if l.StatusRow >= 0 {
+		coldef = termbox.ColorDefault
+		fill(0, l.StatusRow, w, 1, termbox.Cell{Ch: ' ', Fg: coldef, Bg: coldef})
+		if message != "" {
+			tbprint(1, l.StatusRow, coldef, coldef, message)
+		} else if filterErr != nil {
+			tbprint(1, l.StatusRow, termbox.ColorRed, coldef, filterErr.Error())
+		} else if historyLost {
+			tbprint(1, l.StatusRow, termbox.ColorRed, coldef, historyLostMessage)
+		}
+		tbprint(w-runewidth.StringWidth(count)-1, l.StatusRow, coldef, coldef, count)
+		count = ""
+	}
+	countWidth := runewidth.StringWidth(count)
+	tbprint(w-countWidth-1, y, termbox.ColorDefault, termbox.ColorDefault, count)
+	editbox.Draw(editX, y, w-countWidth-editX-2)
+	screen.SetCursor(editX+editbox.CursorX(), y)
+	if completion != nil {
+		first := 0
+		if completion.selected >= MaxCompletionRows {
+			first = completion.selected - MaxCompletionRows + 1
+		}
+		items := completion.items[first:]
+		if len(items) > MaxCompletionRows {
+			items = items[:MaxCompletionRows]
+		}
+		width := 0
+		for _, item := range items {
+			if iw := runewidth.StringWidth(item); iw > width {
+				width = iw
+			}
+		}
+		cx, _ := adjustOffset(editbox.text, completion.start)
+		drawList(1+cx-editbox.visualOffset, y-1, width+2, items, completion.selected-first)
+	}
+
+	// Last line, tabs, one tab per configured filter
+	x = 0
+	y = l.Tabs
+	sep := "  "
+	if compactTabs {
+		sep = " "
+	}
+	coldef = termbox.ColorDefault
+	if !compactTabs {
+		x += tbprint(x, y, coldef, coldef, " ")
+	}
+	if viewIndex == 0 {
+		coldef = termbox.ColorDefault | termbox.AttrReverse
+	}
+	x += tbprint(x, y, coldef, coldef, "no filter")
+	coldef = termbox.ColorDefault
+	x += tbprint(x, y, coldef, coldef, sep)
+
+	if device := currentDevice(); device != nil {
+		device.mutex.Lock()
+		for n, view := range device.logViews {
+			if viewIndex-1 == n {
+				coldef = termbox.ColorDefault | termbox.AttrReverse
+			}
+			x += tbprint(x, y, coldef, coldef, view.Label())
+			coldef = termbox.ColorDefault
+			if unread := view.UnreadCount(); unread > 0 && viewIndex-1 != n {
+				badge := strconv.Itoa(unread)
+				if unread > 99 {
+					badge = "99+"
+				}
+				x += tbprint(x, y, termbox.ColorYellow|termbox.AttrBold, coldef, "•"+badge)
+			}
+			x += tbprint(x, y, coldef, coldef, sep)
+		}
+		device.mutex.Unlock()
+	}
+
+	x += tbprint(x, y, coldef, coldef, "+filter")
+	if paused {
+		x += tbprint(x, y, termbox.ColorRed|termbox.AttrBold|termbox.AttrReverse, coldef,
+			fmt.Sprintf("%s⏸ PAUSED, %d newer", sep, newerLineCount()))
+	} else if bottomLineNo != 0 {
+		// We're not following new lines, so say why they're not appearing.
+		scrolled := fmt.Sprintf("%s⇡ scrolled, %d newer", sep, newerLineCount())
+		x += tbprint(x, y, termbox.ColorYellow|termbox.AttrBold, coldef, scrolled)
+	}
+	for ; x < w; x++ {
+		screen.SetCell(x, y, ' ', coldef, coldef)
+	}
+	if message != "" && l.StatusRow < 0 {
+		tbprint(w-runewidth.StringWidth(message)-1, y, coldef, coldef, message)
+	} else if historyLost && l.StatusRow < 0 {
+		tbprint(w-runewidth.StringWidth(historyLostMessage)-1, y, termbox.ColorRed, coldef, historyLostMessage)
+	}
+
+	screen.Flush()
+}
+
+// moveViewRight moves the selected view one to the right. If there's no more views, we'll create
+// a new one with an empty filter.
+func createNewView() {
+	device := currentDevice()
+	if device == nil {
+		return
+	}
+	device.mutex.Lock()
+	device.logViews = append(device.logViews, &LogView{
+		Name:   "<empty>",
+		lb:     device.logBuffer,
+		engine: matchEngine,
+		wrap:   wrapLines,
+	})
+	viewIndex = len(device.logViews)
+	device.logViews[viewIndex-1].UpdateFilter(device.logBuffer, "")
+	device.mutex.Unlock()
+	editbox.MoveCursorToBeginningOfTheLine()
+	editbox.DeleteTheRestOfTheLine()
+}
+
+func moveViewTo(index int) {
+	device := currentDevice()
+	if device == nil {
+		return
+	}
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(device.logViews) {
+		index = len(device.logViews)
+	}
+	device.mutex.Lock()
+	var prevBuffer *LogBuffer
+	if viewIndex <= len(device.logViews) {
+		// If we've just switched devices, viewIndex was one of the old device's views.
+		prevBuffer = device.ViewBuffer(viewIndex)
+		if index != viewIndex {
+			previousView = nil
+			if viewIndex > 0 {
+				previousView = device.logViews[viewIndex-1]
+			}
+		}
+	}
+	viewIndex = index
+	// The new view's lines might not be as wide, so start from their beginning.
+	scrollX = 0
+	if syncSelection && device.ViewBuffer(viewIndex) == prevBuffer {
+		syncScroll(device)
 	} else {
-		lv.Name = str
+		selectedLineNo = 0
+		bottomLineNo = 0
+	}
+	device.mutex.Unlock()
+	if index == 0 {
+		editbox.SetText("")
+	} else {
+		editbox.SetText(device.logViews[viewIndex-1].filterText)
+	}
+	clearPreview()
+}
+
+// syncScroll scrolls the view we've just switched to so that the selected line (or the line that
+// was at the bottom of the screen, if nothing's selected) is on screen, if it's in this view. If it
+// isn't, we go to the nearest line that is. You should only call this method when you've got the
+// device's mutex locked.
+func syncScroll(d *Device) {
+	anchor := selectedLineNo
+	if anchor == 0 {
+		anchor = bottomLineNo
+	}
+	if anchor == 0 {
+		// We're following new lines, so just keep doing that.
+		return
+	}
+
+	if !d.ViewBuffer(viewIndex).HasLine(anchor) {
+		selectedLineNo = 0
+		bottomLineNo = 0
+		return
+	}
+	if viewIndex > 0 {
+		nearest, ok := d.logViews[viewIndex-1].NearestLineNo(anchor)
+		if !ok {
+			selectedLineNo = 0
+			bottomLineNo = 0
+			return
+		}
+		anchor = nearest
+	}
+	if selectedLineNo != 0 {
+		scrollTo(d, anchor)
+	} else {
+		bottomLineNo = anchor
+	}
+}
+
+// snapshotCurrentView creates a new view holding a frozen copy of the lines in the current view,
+// which can be scrolled through and filtered while the original keeps updating.
+func snapshotCurrentView() {
+	device := currentDevice()
+	if device == nil {
+		return
+	}
+	device.mutex.Lock()
+	lines := device.GetAllLines(viewIndex)
+	name := "no filter"
+	if viewIndex > 0 {
+		name = device.logViews[viewIndex-1].Name
+	}
+
+	// The snapshot gets a buffer that's just big enough to hold its lines, which are renumbered
+	// from 1.
+	lb := &LogBuffer{lines: make([]LogEntry, len(lines)+1)}
+	for _, line := range lines {
+		lb.lines[lb.nextLineIndex] = NewLogEntry(line)
+		lb.nextLineIndex++
+		lb.lineNo++
+	}
+	lv := &LogView{lb: lb, snapshot: true, wrap: wrapLines}
+	lv.UpdateFilter(lb, "")
+	lv.Name = name
+	device.logViews = append(device.logViews, lv)
+	device.mutex.Unlock()
+
+	moveViewTo(len(device.logViews))
+	statusMessage = fmt.Sprintf("Snapshot of %d lines", len(lines))
+}
+
+// toggleGrouped turns grouped matching of multi-line messages on or off for the current view.
+func toggleGrouped() {
+	device := currentDevice()
+	if device == nil || viewIndex == 0 {
+		return
+	}
+	device.mutex.Lock()
+	lv := device.logViews[viewIndex-1]
+	lv.SetGrouped(lv.lb, !lv.grouped)
+	device.mutex.Unlock()
+}
+
+// toggleNegated switches the current view between showing the lines that match its filter and the
+// lines that don't.
+func toggleNegated() {
+	device := currentDevice()
+	if device == nil || viewIndex == 0 {
+		return
+	}
+	device.mutex.Lock()
+	lv := device.logViews[viewIndex-1]
+	lv.SetNegated(lv.lb, !lv.negate)
+	device.mutex.Unlock()
+}
+
+// cycleMinLevel raises the current view's minimum level by one (debug, info, warning, error), and
+// then goes back to showing every level.
+func cycleMinLevel() {
+	device := currentDevice()
+	if device == nil || viewIndex == 0 {
+		statusMessage = "The \"no filter\" view shows every level, use a filter to pick one"
+		return
+	}
+	device.mutex.Lock()
+	lv := device.logViews[viewIndex-1]
+	// After errors, we go back to every level.
+	level := map[byte]byte{0: 'D', 'D': 'I', 'I': 'W', 'W': 'E'}[lv.minLevel]
+	lv.SetMinLevel(lv.lb, level)
+	device.mutex.Unlock()
+	if level == 0 {
+		statusMessage = "Showing every level"
+	} else {
+		statusMessage = fmt.Sprintf("Showing level %c and above", level)
+	}
+}
+
+// moveViewBy moves the selected view delta places to the right (or left, if delta is negative),
+// wrapping around at either end.
+func moveViewBy(delta int) {
+	device := currentDevice()
+	if device == nil {
+		return
+	}
+	count := len(device.logViews) + 1
+	moveViewTo(((viewIndex+delta)%count + count) % count)
+}
+
+// completionsAtCursor returns the possible values for the "column:value" token that the cursor is
+// at the end of, and the byte offset in the editbox where the value starts. Returns false if the
+// cursor isn't in such a token.
+func completionsAtCursor() ([]string, int, bool) {
+	device := currentDevice()
+	if device == nil {
+		return nil, 0, false
+	}
+	text := string(editbox.text[:editbox.cursorOffsetBytes])
+	tokenStart := strings.LastIndexAny(text, " \t") + 1
+	token := text[tokenStart:]
+	colon := strings.IndexByte(token, ':')
+	if colon < 0 {
+		return nil, 0, false
+	}
+
+	var values []string
+	switch column := token[:colon]; column {
+	case "level":
+		values = strings.Split(logLevels, "")
+	case "stack":
+		values = []string{"java", "native"}
+	case "tag", "pid", "tid":
+		device.mutex.Lock()
+		values = device.DistinctValues(column)
+		device.mutex.Unlock()
+	default:
+		return nil, 0, false
+	}
+
+	partial := strings.ToLower(token[colon+1:])
+	var items []string
+	for _, value := range values {
+		if strings.HasPrefix(strings.ToLower(value), partial) {
+			items = append(items, value)
+		}
+	}
+	return items, tokenStart + colon + 1, true
+}
+
+// completeFilter offers completions for the "column:value" token the cursor is in. If there's only
+// one possibility we just fill it in, otherwise we show a dropdown to choose from. If the cursor's
+// not in such a token, we create a new view instead (which is what Tab always used to do).
+func completeFilter() {
+	items, start, ok := completionsAtCursor()
+	if !ok {
+		createNewView()
+		return
+	}
+	switch len(items) {
+	case 0:
+		statusMessage = "No completions"
+	case 1:
+		completion = &Completion{start: start, items: items}
+		acceptCompletion()
+	default:
+		completion = &Completion{start: start, items: items}
+	}
+}
+
+// acceptCompletion replaces the partial value in the editbox with the selected completion.
+func acceptCompletion() {
+	editbox.ReplaceBeforeCursor(editbox.cursorOffsetBytes-completion.start,
+		completion.items[completion.selected])
+	completion = nil
+	filterEdited()
+}
+
+// refreshCompletion updates the completions in the dropdown after the editbox changes, closing the
+// dropdown if there's nothing left to complete.
+func refreshCompletion() {
+	items, start, ok := completionsAtCursor()
+	if !ok || len(items) == 0 {
+		completion = nil
+		return
+	}
+	completion = &Completion{start: start, items: items}
+}
+
+// handleCompletionKey handles the keys that navigate the completion dropdown. Returns false if the
+// key wasn't one of them, and should be handled as normal.
+func handleCompletionKey(ev termbox.Event) bool {
+	switch ev.Key {
+	case termbox.KeyArrowUp:
+		if completion.selected > 0 {
+			completion.selected--
+		}
+	case termbox.KeyArrowDown:
+		if completion.selected < len(completion.items)-1 {
+			completion.selected++
+		}
+	case termbox.KeyEnter, termbox.KeyTab:
+		acceptCompletion()
+	case termbox.KeyEsc:
+		completion = nil
+	default:
+		return false
+	}
+	return true
+}
+
+// reloadPatternFiles re-applies the filter of any view whose "file:" patterns have been modified
+// since they were loaded. Returns true if any were reloaded.
+func reloadPatternFiles() bool {
+	reloaded := false
+	for _, device := range devices {
+		device.mutex.Lock()
+		for _, lv := range device.logViews {
+			if lv.patternFile == "" {
+				continue
+			}
+			fi, err := os.Stat(lv.patternFile)
+			if err != nil || fi.ModTime().Equal(lv.patternModTime) {
+				continue
+			}
+			lv.UpdateFilter(lv.lb, lv.filterText)
+			if lv.err != nil {
+				statusMessage = lv.err.Error()
+			} else {
+				statusMessage = "Reloaded " + lv.patternFile
+			}
+			reloaded = true
+		}
+		device.mutex.Unlock()
+	}
+	return reloaded
+}
+
+// moveSelection moves the selected line up (delta < 0) or down (delta > 0) through the lines that
+// are currently on screen. If there's no selected line, we select the most recent one.
+func moveSelection(delta int) {
+	device := currentDevice()
+	if device == nil {
+		return
+	}
+	rows := currentLayout().LogRows
+	device.mutex.Lock()
+	_, lineNos, _, _ := visibleLineNos(device, rows)
+	device.mutex.Unlock()
+	if len(lineNos) == 0 {
+		return
+	}
+
+	// lineNos is newest first, so moving up the screen means moving forward through it.
+	selected := lineNos[0]
+	for i, lineNo := range lineNos {
+		if lineNo == selectedLineNo {
+			selected = lineNo
+			if i-delta >= 0 && i-delta < len(lineNos) {
+				selected = lineNos[i-delta]
+			}
+			break
+		}
+	}
+	selectedLineNo = selected
+	if line, ok := selectedLine(); ok && LooksBinary(line) {
+		statusMessage = "This line looks like binary data, hex-dump shows its bytes"
+	}
+}
+
+// copySelectedLine copies the selected line to the clipboard. If messageOnly is true, we copy just
+// the message, without the timestamp, pid, tag and so on (unless the line can't be parsed, in
+// which case we copy all of it anyway).
+func copySelectedLine(messageOnly bool) {
+	line, ok := selectedLine()
+	if !ok {
+		return
+	}
+	if messageOnly {
+		if ll, ok := ParseLogLine(line); ok {
+			line = ll.Message
+		}
+	}
+	if err := CopyToClipboard(line); err != nil {
+		statusMessage = "Can't copy: " + err.Error()
+	} else {
+		statusMessage = "Copied"
+	}
+}
+
+// filterEdited is called whenever the text in the editbox changes.
+func filterEdited() {
+	if prompt != nil {
+		// The editbox isn't being used for the filter right now.
+		return
+	}
+	if liveFilter {
+		updateCurrentView()
+		return
+	}
+
+	// Otherwise, once they stop typing for a moment we'll count how many lines it would match.
+	clearPreview()
+	if previewTimer != nil {
+		previewTimer.Stop()
+	}
+	previewTimer = time.AfterFunc(PreviewDelay, func() {
+		select {
+		case previewReady <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// updatePreview works out which lines the filter in the editbox would match in the current view,
+// without actually applying it, so that we can show how many there are.
+func updatePreview() {
+	device := currentDevice()
+	if device == nil || viewIndex == 0 {
+		return
+	}
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	lv := device.logViews[viewIndex-1]
+	preview := &LogView{lb: lv.lb, grouped: lv.grouped, baseline: lv.baseline, engine: lv.engine,
+		pkg: lv.pkg, pkgPIDs: lv.pkgPIDs, negate: lv.negate, minLevel: lv.minLevel}
+	preview.UpdateFilter(lv.lb, string(editbox.text))
+	device.preview = nil
+	if preview.err != nil {
+		statusMessage = preview.err.Error()
+	} else {
+		device.preview = preview
+	}
+}
+
+func updateCurrentView() {
+	clearPreview()
+	device := currentDevice()
+	if device != nil && viewIndex > 0 {
+		device.mutex.Lock()
+		lv := device.logViews[viewIndex-1]
+		lv.UpdateFilter(lv.lb, string(editbox.text))
+		if lv.err != nil {
+			statusMessage = lv.err.Error()
+		}
+		device.mutex.Unlock()
+	}
+}
+
+// FilterPreset is a filter saved under a name with save-preset, so that it can be opened again
+// later, on any device.
+type FilterPreset struct {
+	Filter string `json:"filter"`
+	Engine string `json:"engine,omitempty"`
+	// Negate and MinLevel are the view's toggle-negated and cycle-min-level settings. MinLevel is
+	// one of LevelOrder, or "" for every level.
+	Negate   bool   `json:"negate,omitempty"`
+	MinLevel string `json:"min_level,omitempty"`
+}
+
+// startupFilters are the filters every device starts out with a view for, from the -filter flag,
+// so that the ones you always use don't have to be typed in every time.
+var startupFilters []string
+
+// presetsPath is the JSON file we keep FilterPresets in, keyed by name, from the -presets flag. If
+// it's empty, presets can't be saved.
+var presetsPath string
+
+// defaultPresetsPath returns where we keep the presets when -presets isn't given, or "" if there's
+// nowhere to keep them.
+func defaultPresetsPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "lolcat", "filters.json")
+}
+
+// LoadPresets reads the presets saved in the given file. It's not an error if the file doesn't
+// exist yet, there's just no presets.
+func LoadPresets(path string) (map[string]FilterPreset, error) {
+	presets := make(map[string]FilterPreset)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return presets, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return presets, nil
+}
+
+// SavePresets writes the given presets to the given file, creating its directory if need be.
+func SavePresets(path string, presets map[string]FilterPreset) error {
+	data, err := json.MarshalIndent(presets, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// savePreset asks for a name, and saves the current view's filter under it, with its engine,
+// negation and minimum level (replacing any preset that already has that name).
+func savePreset() {
+	device := currentDevice()
+	if device == nil || viewIndex == 0 {
+		statusMessage = "The \"no filter\" view has no filter to save"
+		return
+	}
+	if presetsPath == "" {
+		statusMessage = "Nowhere to save presets, see -presets"
+		return
+	}
+	device.mutex.Lock()
+	lv := device.logViews[viewIndex-1]
+	preset := FilterPreset{Filter: lv.filterText, Engine: lv.engine, Negate: lv.negate}
+	if lv.minLevel != 0 {
+		preset.MinLevel = string(lv.minLevel)
+	}
+	device.mutex.Unlock()
+	askPrompt("Save filter as:", func(name string) {
+		if name = strings.TrimSpace(name); name == "" {
+			return
+		}
+		presets, err := LoadPresets(presetsPath)
+		if err == nil {
+			presets[name] = preset
+			err = SavePresets(presetsPath, presets)
+		}
+		if err != nil {
+			statusMessage = "Couldn't save the preset: " + err.Error()
+			return
+		}
+		statusMessage = fmt.Sprintf("Saved %q to %s", name, presetsPath)
+	})
+}
+
+// openPreset lists the saved presets, and opens the chosen one in a new view.
+func openPreset() {
+	if currentDevice() == nil {
+		return
+	}
+	presets, err := LoadPresets(presetsPath)
+	if err != nil {
+		statusMessage = err.Error()
+		return
+	}
+	if len(presets) == 0 {
+		statusMessage = "No saved presets yet, use save-preset to save a filter"
+		return
 	}
+	var names, items []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		items = append(items, name+": "+presets[name].Filter)
+	}
+	overlay = &Overlay{
+		Title: "Presets",
+		Items: items,
+		OnSelect: func(index int) {
+			openFilter(names[index], presets[names[index]])
+		},
+	}
+}
 
-	lv.filterText = str
-	filter, err := regexp.Compile(str)
+// openFilter opens the given preset in a new view on the current device, named after the preset.
+func openFilter(name string, preset FilterPreset) {
+	createNewView()
+	device := currentDevice()
+	if device == nil || viewIndex == 0 {
+		return
+	}
+	device.mutex.Lock()
+	lv := device.logViews[viewIndex-1]
+	if preset.Engine != "" {
+		lv.engine = preset.Engine
+	}
+	// These are applied along with the filter, when it's committed below.
+	lv.negate = preset.Negate
+	if len(preset.MinLevel) == 1 && strings.Contains(LevelOrder, preset.MinLevel) {
+		lv.minLevel = preset.MinLevel[0]
+	}
+	device.mutex.Unlock()
+	editbox.SetText(preset.Filter)
+	editbox.MoveCursorToEndOfTheLine()
+	updateCurrentView()
+	device.mutex.Lock()
+	lv.Name = name
+	device.mutex.Unlock()
+}
+
+// exportCurrentView writes every line in the current view to a file named after the device and the
+// current time, in the configured exportFormat.
+func exportCurrentView() {
+	if device := currentDevice(); device != nil {
+		exportCurrentViewTo(device, exportFilename(device, ""))
+	}
+}
+
+// exportCurrentViewAs asks for the file to export the current view to, starting with the name that
+// exportCurrentView would have used.
+func exportCurrentViewAs() {
+	device := currentDevice()
+	if device == nil {
+		return
+	}
+	askPrompt("Export to:", func(answer string) {
+		if answer = strings.TrimSpace(answer); answer != "" {
+			exportCurrentViewTo(device, answer)
+		}
+	})
+	editbox.SetText(exportFilename(device, ""))
+	editbox.MoveCursorToEndOfTheLine()
+}
+
+// exportCurrentViewTo writes every line in the current view of the given device to the given file,
+// in the background.
+func exportCurrentViewTo(device *Device, filename string) {
+	device.mutex.Lock()
+	lines := device.GetAllLines(viewIndex)
+	var notes bytes.Buffer
+	noteCount := device.WriteNotes(&notes)
+	device.mutex.Unlock()
+
+	// The lines are copied, so the file can be written without holding up the UI.
+	format := exportFormat
+	statusMessage = fmt.Sprintf("Exporting %d lines to %s…", len(lines), filename)
+	go func() {
+		exportResults <- writeExport(filename, format, lines, notes.Bytes(), noteCount)
+	}()
+}
+
+// exportResults carries the status message for each export that exportCurrentView has written in
+// the background, for the main loop to show.
+var exportResults = make(chan string)
+
+// writeExport writes the given lines to the given file, and the notes to a sidecar file next to it
+// if there are any. Returns the message that says how it went.
+func writeExport(filename, format string, lines []string, notes []byte, noteCount int) string {
+	f, err := os.Create(filename)
+	if err == nil {
+		err = WriteLines(f, format, lines)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
 	if err != nil {
-		lv.filter = nil
-		lv.Name = "#ERR#"
-	} else {
-		lv.filter = filter
+		return "Export failed: " + err.Error()
+	}
+	message := fmt.Sprintf("Exported %d lines to %s", len(lines), filename)
+	if noteCount > 0 {
+		notesFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + "-notes.txt"
+		if err := os.WriteFile(notesFilename, notes, 0666); err != nil {
+			message += ", but exporting notes failed: " + err.Error()
+		} else {
+			message += fmt.Sprintf(" and %d notes to %s", noteCount, notesFilename)
+		}
+	}
+	return message
+}
+
+// WriteNotes writes each of the notes on lines that are still in the buffer, oldest first, after
+// the line it's on. Returns how many notes were written. You should only call this method when
+// you've got the device's mutex locked.
+func (d *Device) WriteNotes(w io.Writer) int {
+	var lineNos []int64
+	for lineNo := range d.notes {
+		if d.logBuffer.HasLine(lineNo) {
+			lineNos = append(lineNos, lineNo)
+		}
+	}
+	sort.Slice(lineNos, func(i, j int) bool { return lineNos[i] < lineNos[j] })
+	for _, lineNo := range lineNos {
+		fmt.Fprintf(w, "line %d: %s\n    ✎ %s\n\n", lineNo, d.logBuffer.GetLine(lineNo),
+			d.notes[lineNo])
+	}
+	return len(lineNos)
+}
+
+// annotateSelectedLine asks for a note to attach to the selected line, replacing any it's already
+// got. An empty note removes it.
+func annotateSelectedLine() {
+	device := currentDevice()
+	if device == nil || selectedLineNo == 0 {
+		statusMessage = "Select a line to annotate first"
+		return
+	}
+	device.mutex.Lock()
+	snapshot := device.ViewBuffer(viewIndex) != device.logBuffer
+	note := device.notes[selectedLineNo]
+	device.mutex.Unlock()
+	if snapshot {
+		statusMessage = "Lines in snapshots can't be annotated"
+		return
+	}
+	lineNo := selectedLineNo
+	askPrompt(fmt.Sprintf("Note for line %d (empty to remove):", lineNo), func(answer string) {
+		device.mutex.Lock()
+		defer device.mutex.Unlock()
+		if answer == "" {
+			delete(device.notes, lineNo)
+		} else {
+			device.notes[lineNo] = answer
+		}
+	})
+	// Start with the note it's already got, so that it can be edited.
+	editbox.SetText(note)
+	editbox.MoveCursorToEndOfTheLine()
+}
+
+// exportFilename returns the name of a file to export the given device's lines to, named after the
+// device, the current time and the given suffix.
+func exportFilename(device *Device, suffix string) string {
+	safeID := strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, device.ID)
+	return fmt.Sprintf("lolcat-%s-%s%s.%s", safeID, time.Now().Format("20060102-150405"), suffix,
+		exportFormats[exportFormat])
+}
+
+// toggleAutoExport stops the current view's auto-export if it's running, otherwise asks how many
+// matches to write at a time and starts it.
+func toggleAutoExport() {
+	device := currentDevice()
+	if device == nil || viewIndex == 0 {
+		statusMessage = "Only filters can be auto-exported"
+		return
+	}
+	device.mutex.Lock()
+	lv := device.logViews[viewIndex-1]
+	if lv.autoExport != nil {
+		ae := lv.StopAutoExport()
+		device.mutex.Unlock()
+		if ae.err != nil {
+			statusMessage = fmt.Sprintf("Auto-export to %s failed: %v", ae.Path, ae.err)
+		} else {
+			statusMessage = fmt.Sprintf("Auto-exported %d lines to %s", ae.written, ae.Path)
+		}
+		return
+	}
+	snapshot := lv.snapshot
+	device.mutex.Unlock()
+	if snapshot {
+		statusMessage = "Snapshots don't get new matches to auto-export"
+		return
+	}
+
+	askPrompt("Auto-export every N matches (empty for every match):", func(answer string) {
+		threshold := 1
+		if answer = strings.TrimSpace(answer); answer != "" {
+			n, err := strconv.Atoi(answer)
+			if err != nil || n < 1 {
+				statusMessage = fmt.Sprintf("%q isn't a number of matches", answer)
+				return
+			}
+			threshold = n
+		}
+		filename := exportFilename(device, "-auto")
+		device.mutex.Lock()
+		err := lv.StartAutoExport(filename, threshold)
+		device.mutex.Unlock()
+		if err != nil {
+			statusMessage = "Auto-export failed: " + err.Error()
+		} else {
+			statusMessage = "Auto-exporting new matches to " + filename
+		}
+	})
+}
+
+// cycleMatchEngine switches the current view to the next of the matchEngines, and re-applies its
+// filter with it.
+func cycleMatchEngine() {
+	device := currentDevice()
+	if device == nil || viewIndex == 0 {
+		return
+	}
+	device.mutex.Lock()
+	lv := device.logViews[viewIndex-1]
+	next := matchEngines[0]
+	for i, engine := range matchEngines {
+		if engine == lv.engine && i+1 < len(matchEngines) {
+			next = matchEngines[i+1]
+		}
+	}
+	lv.engine = next
+	lv.UpdateFilter(lv.lb, lv.filterText)
+	device.mutex.Unlock()
+	statusMessage = "Filter engine: " + next
+}
+
+// stopAutoExports stops every auto-export, writing whatever they've got pending, for when we quit.
+func stopAutoExports() {
+	for _, d := range devices {
+		d.mutex.Lock()
+		for _, lv := range d.logViews {
+			if lv.autoExport != nil {
+				lv.StopAutoExport()
+			}
+		}
+		d.mutex.Unlock()
+	}
+}
+
+// CloseAllViews closes every one of the device's views (including snapshots), stopping any
+// auto-exports, and returns how many there were.
+func (d *Device) CloseAllViews() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	n := len(d.logViews)
+	for _, lv := range d.logViews {
+		if lv.autoExport != nil {
+			lv.StopAutoExport()
+		}
+		if previousView == lv {
+			previousView = nil
+		}
+	}
+	d.logViews = nil
+	return n
+}
+
+// CloseView closes the device's view at the given index into logViews, stopping its auto-export if
+// it's got one. Any view that was being compared to it goes back to showing all of its lines. You
+// should only call this method when you've got the device's mutex locked.
+func (d *Device) CloseView(index int) {
+	lv := d.logViews[index]
+	if lv.autoExport != nil {
+		lv.StopAutoExport()
+	}
+	// Shift the rest down by hand, so that the slot at the end doesn't keep the closed view (and
+	// its index, or a snapshot's whole buffer) from being garbage collected.
+	copy(d.logViews[index:], d.logViews[index+1:])
+	d.logViews[len(d.logViews)-1] = nil
+	d.logViews = d.logViews[:len(d.logViews)-1]
+	lv.index = nil
+	for _, other := range d.logViews {
+		if other.compareTo == lv {
+			other.compareTo = nil
+		}
+	}
+	if previousView == lv {
+		previousView = nil
+	}
+}
+
+// closeCurrentView closes the current view, and moves to the one that took its place, or the one
+// to its left if it was the last one.
+func closeCurrentView() {
+	device := currentDevice()
+	if device == nil || viewIndex == 0 {
+		statusMessage = "The \"no filter\" view can't be closed"
+		return
+	}
+	device.mutex.Lock()
+	name := device.logViews[viewIndex-1].Name
+	device.CloseView(viewIndex - 1)
+	device.mutex.Unlock()
+	completion = nil
+	// If it was the last one, this goes to the one before it.
+	moveViewTo(viewIndex)
+	statusMessage = "Closed " + name
+}
+
+// closeAllViews closes every view of the current device, or of all devices, depending on the answer
+// to the prompt asking which ("y" or "a"). Any other answer closes nothing.
+func closeAllViews(answer string) {
+	var closing []*Device
+	switch strings.ToLower(answer) {
+	case "y":
+		if device := currentDevice(); device != nil {
+			closing = []*Device{device}
+		}
+	case "a":
+		closing = devices
+	default:
+		return
+	}
+	n := 0
+	for _, d := range closing {
+		n += d.CloseAllViews()
+	}
+	completion = nil
+	moveViewTo(0)
+	statusMessage = fmt.Sprintf("Closed %d filters", n)
+}
+
+// Action is something that can be done by pressing a key. Every action has a name, which is how
+// keys get bound to it.
+type Action string
+
+// The actions that keys can be bound to.
+const (
+	ActionQuit             Action = "quit"
+	ActionNewView          Action = "new-view"
+	ActionComplete         Action = "complete"
+	ActionNextView         Action = "next-view"
+	ActionPrevView         Action = "prev-view"
+	ActionCommitFilter     Action = "commit-filter"
+	ActionExport           Action = "export"
+	ActionExportAs         Action = "export-as"
+	ActionMinLevel         Action = "cycle-min-level"
+	ActionProcessNames     Action = "toggle-process-names"
+	ActionFilterToApp      Action = "filter-to-app"
+	ActionRetry            Action = "retry"
+	ActionChooseBuffers    Action = "choose-buffers"
+	ActionToggleGrouped    Action = "toggle-grouped"
+	ActionToggleNegated    Action = "toggle-negated"
+	ActionSnapshot         Action = "snapshot"
+	ActionNextDevice       Action = "next-device"
+	ActionPrevDevice       Action = "prev-device"
+	ActionToggleLaunchMark Action = "toggle-launch-marker"
+	ActionSelectUp         Action = "select-up"
+	ActionSelectDown       Action = "select-down"
+	ActionClearSelection   Action = "clear-selection"
+	ActionCopyLine         Action = "copy-line"
+	ActionCopyMessage      Action = "copy-message"
+	ActionSearchAll        Action = "search-all"
+	ActionSearch           Action = "search"
+	ActionShowKeys         Action = "show-keys"
+	ActionSavePreset       Action = "save-preset"
+	ActionOpenPreset       Action = "open-preset"
+	ActionSearchNext       Action = "search-next"
+	ActionSearchPrevious   Action = "search-previous"
+	ActionToggleSort       Action = "toggle-sort"
+	ActionClearLocal       Action = "clear-local"
+	ActionRestrictPID      Action = "restrict-pid"
+	ActionGoToLine         Action = "go-to-line"
+	ActionToggleColumns    Action = "toggle-columns"
+	ActionToggleRepeatTags Action = "toggle-repeated-tags"
+	ActionReconnectAll     Action = "reconnect-all"
+	ActionAutoExport       Action = "auto-export"
+	ActionHexDump          Action = "hex-dump"
+	ActionToggleBaseline   Action = "toggle-baseline"
+	ActionCompactTabs      Action = "toggle-compact-tabs"
+	ActionCountUnique      Action = "count-unique"
+	ActionCopyCommand      Action = "copy-command"
+	ActionToggleDim        Action = "toggle-continuation-color"
+	ActionResume           Action = "resume"
+	ActionTogglePause      Action = "toggle-pause"
+	ActionToggleWrap       Action = "toggle-wrap"
+	ActionToggleLevels     Action = "toggle-level-colors"
+	ActionCycleEngine      Action = "cycle-match-engine"
+	ActionWrapSelected     Action = "wrap-selected"
+	ActionToggleSplit      Action = "toggle-split"
+	ActionSwapSplit        Action = "swap-split"
+	ActionLinkSplit        Action = "toggle-split-link"
+	ActionCloseAllViews    Action = "close-all-filters"
+	ActionCloseView        Action = "close-filter"
+	ActionRateAlert        Action = "rate-alert"
+	ActionAnnotate         Action = "annotate"
+	ActionCompareViews     Action = "compare-views"
+	ActionShowRates        Action = "show-rates"
+	ActionScrollOldest     Action = "scroll-to-oldest"
+	ActionFollow           Action = "follow"
+	ActionScrollLeft       Action = "scroll-left"
+	ActionScrollRight      Action = "scroll-right"
+	ActionPageUp           Action = "page-up"
+	ActionPageDown         Action = "page-down"
+	ActionHalfPageUp       Action = "half-page-up"
+	ActionHalfPageDown     Action = "half-page-down"
+	ActionCursorLeft       Action = "cursor-left"
+	ActionCursorRight      Action = "cursor-right"
+	ActionCursorHome       Action = "cursor-home"
+	ActionCursorEnd        Action = "cursor-end"
+	ActionDeleteBackward   Action = "delete-backward"
+	ActionDeleteForward    Action = "delete-forward"
+	ActionDeleteRestOfLine Action = "delete-rest-of-line"
+	ActionWordLeft         Action = "cursor-word-left"
+	ActionWordRight        Action = "cursor-word-right"
+	ActionDeleteWord       Action = "delete-word-backward"
+)
+
+// actions maps each Action to the function that performs it. ActionQuit is handled by the main
+// loop itself.
+var actions = map[Action]func(){
+	ActionNewView:       createNewView,
+	ActionComplete:      completeFilter,
+	ActionNextView:      func() { moveViewBy(1) },
+	ActionPrevView:      func() { moveViewBy(-1) },
+	ActionCommitFilter:  updateCurrentView,
+	ActionExport:        exportCurrentView,
+	ActionExportAs:      exportCurrentViewAs,
+	ActionMinLevel:      cycleMinLevel,
+	ActionProcessNames:  toggleProcessNames,
+	ActionFilterToApp:   filterToApp,
+	ActionRetry:         retryNow,
+	ActionChooseBuffers: chooseBuffers,
+	ActionToggleGrouped: toggleGrouped,
+	ActionToggleNegated: toggleNegated,
+	ActionSnapshot:      snapshotCurrentView,
+	ActionNextDevice:    func() { moveDeviceTo(deviceIndex + 1) },
+	ActionPrevDevice:    func() { moveDeviceTo(deviceIndex - 1) },
+	ActionToggleLaunchMark: func() {
+		showLaunchMarker = !showLaunchMarker
+	},
+	ActionSelectUp:   func() { moveSelection(-1) },
+	ActionSelectDown: func() { moveSelection(1) },
+	ActionClearSelection: func() {
+		selectedLineNo = 0
+		bottomLineNo = 0
+	},
+	ActionSearchAll: func() {
+		askPrompt("Search all devices:", searchAllDevices)
+	},
+	ActionSearch:         startSearch,
+	ActionShowKeys:       showKeys,
+	ActionSavePreset:     savePreset,
+	ActionOpenPreset:     openPreset,
+	ActionSearchNext:     func() { searchView(-1) },
+	ActionSearchPrevious: func() { searchView(1) },
+	ActionToggleSort: func() {
+		sortByTime = !sortByTime
+		if sortByTime {
+			statusMessage = "Sorted by timestamp"
+		} else {
+			statusMessage = "In the order lines arrived"
+		}
+	},
+	ActionClearLocal: func() {
+		if device := currentDevice(); device != nil {
+			device.ClearLocal()
+			selectedLineNo = 0
+			bottomLineNo = 0
+			statusMessage = "Cleared (the device's own log is untouched)"
+		}
+	},
+	ActionRestrictPID: func() {
+		askPrompt("Only stream logs from package (empty for all):", restrictToPackage)
+	},
+	ActionGoToLine: func() {
+		askPrompt("Go to line:", goToLine)
+	},
+	ActionToggleColumns: func() {
+		columnar = !columnar
+	},
+	ActionToggleRepeatTags: func() {
+		if !columnar {
+			statusMessage = "Repeated tags can only be hidden in columnar mode"
+			return
+		}
+		hideRepeatedTags = !hideRepeatedTags
+	},
+	ActionReconnectAll: func() {
+		askPrompt("Reconnect all devices, clearing their logs? (y/N)", reconnectAll)
+	},
+	ActionAutoExport:   toggleAutoExport,
+	ActionHexDump:      hexDumpSelectedLine,
+	ActionCopyCommand:  copyAdbCommand,
+	ActionCycleEngine:  cycleMatchEngine,
+	ActionWrapSelected: toggleWrapSelected,
+	ActionToggleSplit:  toggleSplit,
+	ActionSwapSplit:    swapSplit,
+	ActionLinkSplit:    toggleLinkSplit,
+	ActionRateAlert:    setRateAlert,
+	ActionAnnotate:     annotateSelectedLine,
+	ActionCompareViews: compareViews,
+	ActionShowRates:    showRates,
+	ActionCloseView:    closeCurrentView,
+	ActionCloseAllViews: func() {
+		askPrompt("Close every filter on this device (y), on all devices (a), or neither (N)?", closeAllViews)
+	},
+	ActionScrollOldest: scrollToOldest,
+	ActionFollow:       followNewLines,
+	ActionScrollLeft:   func() { scrollHorizontally(-1) },
+	ActionScrollRight:  func() { scrollHorizontally(1) },
+	ActionPageUp:       func() { scrollByPages(-1) },
+	ActionPageDown:     func() { scrollByPages(1) },
+	ActionHalfPageUp:   func() { scrollByPages(-0.5) },
+	ActionHalfPageDown: func() { scrollByPages(0.5) },
+	ActionTogglePause:  togglePause,
+	ActionToggleWrap:   toggleWrapLines,
+	ActionToggleLevels: toggleLevelColors,
+	ActionResume: func() {
+		if device := currentDevice(); device != nil {
+			statusMessage = fmt.Sprintf("Resumed, %d lines were dropped while frozen", device.Resume())
+		}
+	},
+	ActionToggleDim: func() {
+		continuationColor, savedContinuationColor = savedContinuationColor, continuationColor
+	},
+	ActionCountUnique: func() {
+		askPrompt("Count unique values of (regex, with a group):", countUnique)
+	},
+	ActionCompactTabs: func() {
+		compactTabs = !compactTabs
+	},
+	ActionToggleBaseline: func() {
+		device := currentDevice()
+		if device == nil || viewIndex == 0 {
+			statusMessage = "Only filters can have a baseline"
+			return
+		}
+		device.mutex.Lock()
+		lv := device.logViews[viewIndex-1]
+		if lv.baseline == 0 {
+			lv.SetBaseline(lv.lb.GetLastLineNo())
+		} else {
+			lv.SetBaseline(0)
+		}
+		device.mutex.Unlock()
+	},
+	ActionCopyLine:    func() { copySelectedLine(false) },
+	ActionCopyMessage: func() { copySelectedLine(true) },
+	ActionCursorLeft:  editbox.MoveCursorOneRuneBackward,
+	ActionCursorRight: editbox.MoveCursorOneRuneForward,
+	ActionCursorHome:  editbox.MoveCursorToBeginningOfTheLine,
+	ActionCursorEnd:   editbox.MoveCursorToEndOfTheLine,
+	ActionDeleteBackward: func() {
+		editbox.DeleteRuneBackward()
+		filterEdited()
+	},
+	ActionDeleteForward: func() {
+		editbox.DeleteRuneForward()
+		filterEdited()
+	},
+	ActionDeleteRestOfLine: func() {
+		editbox.DeleteTheRestOfTheLine()
+		filterEdited()
+	},
+	ActionWordLeft:  editbox.MoveCursorOneWordBackward,
+	ActionWordRight: editbox.MoveCursorOneWordForward,
+	ActionDeleteWord: func() {
+		editbox.DeleteWordBackward()
+		filterEdited()
+	},
+}
+
+// defaultBindings are the key bindings we start off with, in the same "action=key" form as the
+// -bind flag.
+var defaultBindings = []string{
+	"quit=Ctrl+C",
+	"complete=Tab",
+	"new-view=Ctrl+T",
+	"next-view=Ctrl+N",
+	"prev-view=Ctrl+P", "prev-view=Shift+Tab",
+	"commit-filter=Enter",
+	"export=Ctrl+S",
+	"export-as=Alt+E",
+	"cycle-min-level=Alt+M",
+	"toggle-process-names=Alt+A",
+	"filter-to-app=Alt+O",
+	"retry=Alt+y",
+	"choose-buffers=Alt+B",
+	"toggle-grouped=Ctrl+G",
+	"toggle-negated=Alt+i",
+	"snapshot=Alt+s",
+	"next-device=Alt+.",
+	"prev-device=Alt+,",
+	"toggle-launch-marker=Alt+m",
+	"select-up=Up",
+	"select-down=Down",
+	"clear-selection=Esc",
+	"copy-line=Alt+c",
+	"copy-message=Alt+C",
+	"search-all=Alt+f",
+	"search=Alt+/",
+	"show-keys=Alt+?",
+	"save-preset=Alt+K",
+	"open-preset=Alt+G",
+	"search-next=Alt+j",
+	"search-previous=Alt+J",
+	"toggle-sort=Alt+t",
+	"clear-local=Alt+l", "clear-local=Ctrl+L",
+	"restrict-pid=Alt+p",
+	"go-to-line=Alt+g",
+	"toggle-columns=Alt+o",
+	"toggle-repeated-tags=Alt+r",
+	"reconnect-all=Alt+R",
+	"auto-export=Alt+x",
+	"hex-dump=Alt+h",
+	"toggle-baseline=Alt+b",
+	"toggle-compact-tabs=Alt+w",
+	"count-unique=Alt+u",
+	"copy-command=Alt+a",
+	"toggle-continuation-color=Alt+d",
+	"resume=Alt+z",
+	"toggle-pause=Alt+Space",
+	"toggle-wrap=Alt+=",
+	"toggle-level-colors=Alt+P",
+	"cycle-match-engine=Alt+e",
+	"wrap-selected=Alt+W",
+	"toggle-split=Alt+v",
+	"swap-split=Alt+V",
+	"toggle-split-link=Alt+k",
+	"close-filter=Ctrl+X",
+	"close-all-filters=Alt+F",
+	"rate-alert=Alt+n",
+	"annotate=Alt+N",
+	"compare-views=Alt+D",
+	"show-rates=Alt+S",
+	"page-up=PgUp",
+	"page-down=PgDn",
+	"scroll-to-oldest=Alt+Home",
+	"follow=Alt+End",
+	"scroll-left=Alt+<",
+	"scroll-right=Alt+>",
+	"half-page-up=Alt+Up",
+	"half-page-down=Alt+Down",
+	"cursor-left=Left", "cursor-left=Ctrl+B",
+	"cursor-right=Right", "cursor-right=Ctrl+F",
+	"cursor-home=Home", "cursor-home=Ctrl+A",
+	"cursor-end=End", "cursor-end=Ctrl+E",
+	"delete-backward=Backspace", "delete-backward=Ctrl+H",
+	"delete-forward=Delete", "delete-forward=Ctrl+D",
+	"delete-rest-of-line=Ctrl+K",
+	"cursor-word-left=Alt+Left", "cursor-word-right=Alt+Right",
+	"delete-word-backward=Ctrl+W",
+}
+
+// KeyBinding identifies a single key press (with modifiers) that can be bound to an Action. Either
+// key or ch is set, depending on whether it's a special key or a regular character.
+type KeyBinding struct {
+	key termbox.Key
+	ch  rune
+	mod termbox.Modifier
+}
+
+// keymap maps each key that's been bound to the Action it performs.
+var keymap = map[KeyBinding]Action{}
+
+// KeyBackTab is Shift+Tab. Termbox doesn't know about it, so handleEvent puts it together from the
+// escape sequence the terminal sends for it. It's well out of the way of termbox's own keys.
+const KeyBackTab termbox.Key = 0xFF00
+
+// keyNames are the names of the special keys that can be used in a key binding.
+var keyNames = map[string]termbox.Key{
+	"tab":       termbox.KeyTab,
+	"backtab":   KeyBackTab,
+	"enter":     termbox.KeyEnter,
+	"esc":       termbox.KeyEsc,
+	"space":     termbox.KeySpace,
+	"backspace": termbox.KeyBackspace2,
+	"delete":    termbox.KeyDelete,
+	"insert":    termbox.KeyInsert,
+	"home":      termbox.KeyHome,
+	"end":       termbox.KeyEnd,
+	"pgup":      termbox.KeyPgup,
+	"pgdn":      termbox.KeyPgdn,
+	"up":        termbox.KeyArrowUp,
+	"down":      termbox.KeyArrowDown,
+	"left":      termbox.KeyArrowLeft,
+	"right":     termbox.KeyArrowRight,
+	"f1":        termbox.KeyF1,
+	"f2":        termbox.KeyF2,
+	"f3":        termbox.KeyF3,
+	"f4":        termbox.KeyF4,
+	"f5":        termbox.KeyF5,
+	"f6":        termbox.KeyF6,
+	"f7":        termbox.KeyF7,
+	"f8":        termbox.KeyF8,
+	"f9":        termbox.KeyF9,
+	"f10":       termbox.KeyF10,
+	"f11":       termbox.KeyF11,
+	"f12":       termbox.KeyF12,
+}
+
+// ParseKey parses a key name like "Tab", "Ctrl+T", "Alt+Left" or "x" into a KeyBinding.
+func ParseKey(name string) (KeyBinding, error) {
+	var kb KeyBinding
+	parts := strings.Split(name, "+")
+	ctrl := false
+	shift := false
+	for _, mod := range parts[:len(parts)-1] {
+		switch strings.ToLower(mod) {
+		case "ctrl":
+			ctrl = true
+		case "alt":
+			kb.mod |= termbox.ModAlt
+		case "shift":
+			shift = true
+		default:
+			return kb, fmt.Errorf("unknown modifier %q in key %q", mod, name)
+		}
+	}
+
+	last := parts[len(parts)-1]
+	if shift {
+		// The terminal only tells us about Shift with Tab, everything else is just a different
+		// character (e.g. "T" rather than "Shift+t").
+		if strings.ToLower(last) != "tab" || ctrl {
+			return kb, fmt.Errorf("unsupported key %q", name)
+		}
+		kb.key = KeyBackTab
+		return kb, nil
+	}
+	if key, ok := keyNames[strings.ToLower(last)]; ok && !ctrl {
+		kb.key = key
+		return kb, nil
+	}
+	if utf8.RuneCountInString(last) != 1 {
+		return kb, fmt.Errorf("unknown key %q", name)
+	}
+	r, _ := utf8.DecodeRuneInString(last)
+	if !ctrl {
+		kb.ch = r
+		return kb, nil
+	}
+	// Ctrl+letter comes through from the terminal as a control character.
+	r = []rune(strings.ToLower(string(r)))[0]
+	if r < 'a' || r > 'z' {
+		return kb, fmt.Errorf("unsupported key %q", name)
+	}
+	kb.key = termbox.KeyCtrlA + termbox.Key(r-'a')
+	return kb, nil
+}
+
+// keyDisplayNames are the names KeyName gives the special keys, in the same style as the README.
+var keyDisplayNames = map[termbox.Key]string{
+	termbox.KeyTab:        "Tab",
+	KeyBackTab:            "Shift+Tab",
+	termbox.KeyEnter:      "Enter",
+	termbox.KeyEsc:        "Esc",
+	termbox.KeySpace:      "Space",
+	termbox.KeyBackspace2: "Backspace",
+	termbox.KeyDelete:     "Delete",
+	termbox.KeyInsert:     "Insert",
+	termbox.KeyHome:       "Home",
+	termbox.KeyEnd:        "End",
+	termbox.KeyPgup:       "PgUp",
+	termbox.KeyPgdn:       "PgDn",
+	termbox.KeyArrowUp:    "Up",
+	termbox.KeyArrowDown:  "Down",
+	termbox.KeyArrowLeft:  "Left",
+	termbox.KeyArrowRight: "Right",
+	termbox.KeyF1:         "F1",
+	termbox.KeyF2:         "F2",
+	termbox.KeyF3:         "F3",
+	termbox.KeyF4:         "F4",
+	termbox.KeyF5:         "F5",
+	termbox.KeyF6:         "F6",
+	termbox.KeyF7:         "F7",
+	termbox.KeyF8:         "F8",
+	termbox.KeyF9:         "F9",
+	termbox.KeyF10:        "F10",
+	termbox.KeyF11:        "F11",
+	termbox.KeyF12:        "F12",
+}
+
+// KeyName returns the name of the given KeyBinding, the opposite of ParseKey, e.g. "Alt+Left".
+func KeyName(kb KeyBinding) string {
+	name := ""
+	if kb.mod&termbox.ModAlt != 0 {
+		name = "Alt+"
+	}
+	if kb.ch != 0 {
+		return name + string(kb.ch)
+	}
+	if display, ok := keyDisplayNames[kb.key]; ok {
+		return name + display
+	}
+	if kb.key >= termbox.KeyCtrlA && kb.key <= termbox.KeyCtrlZ {
+		return name + "Ctrl+" + string(rune('A'+kb.key-termbox.KeyCtrlA))
+	}
+	return name + fmt.Sprintf("key %#x", uint16(kb.key))
+}
+
+// KeysFor returns the names of the keys bound to the given action, joined with " or ", e.g.
+// "Ctrl+S or F2". It returns "" if the action isn't bound to any key.
+func KeysFor(action Action) string {
+	var names []string
+	for kb, a := range keymap {
+		if a == action {
+			names = append(names, KeyName(kb))
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, " or ")
+}
+
+// exportHint returns ", <key> to export" for the titles of overlays that can be exported, or "" if
+// export isn't bound to any key.
+func exportHint() string {
+	keys := KeysFor(ActionExport)
+	if keys == "" {
+		return ""
+	}
+	return ", " + keys + " to export"
+}
+
+// BindKeys binds each of the given "action=key" strings. The key "none" unbinds every key that's
+// bound to the action so far, so that it can be moved rather than just given another key.
+func BindKeys(bindings []string) error {
+	for _, binding := range bindings {
+		parts := strings.SplitN(binding, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid key binding %q, expected action=key", binding)
+		}
+		action := Action(parts[0])
+		if _, ok := actions[action]; !ok && action != ActionQuit {
+			return fmt.Errorf("unknown action %q", parts[0])
+		}
+		if strings.ToLower(parts[1]) == "none" {
+			for kb, a := range keymap {
+				if a == action {
+					delete(keymap, kb)
+				}
+			}
+			continue
+		}
+		kb, err := ParseKey(parts[1])
+		if err != nil {
+			return err
+		}
+		keymap[kb] = action
+	}
+	return nil
+}
+
+// bindingFor returns the KeyBinding that corresponds to the given key press event.
+func bindingFor(ev termbox.Event) KeyBinding {
+	if ev.Ch != 0 {
+		return KeyBinding{ch: ev.Ch, mod: ev.Mod}
+	}
+	return KeyBinding{key: ev.Key, mod: ev.Mod}
+}
+
+// listFlag collects every value of a flag that can be repeated, like -bind.
+type listFlag []string
+
+func (b *listFlag) String() string {
+	return strings.Join(*b, ",")
+}
+
+func (b *listFlag) Set(value string) error {
+	*b = append(*b, value)
+	return nil
+}
+
+// EnvName returns the name of the environment variable that sets the given flag, e.g. LOLCAT_MAX_DEVICES
+// for -max-devices.
+func EnvName(flagName string) string {
+	return "LOLCAT_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Config is what ReadConfig reads from a config file.
+type Config struct {
+	// Options are the values given for each option outside of any device's section, by name.
+	Options map[string][]string
+	// Devices are the options in each device's section, by the device's serial. See DeviceSettings.
+	Devices map[string]map[string][]string
+}
+
+// ReadConfig reads options from a config file, one "name=value" per line, where name is the name
+// of a flag without the "-". Blank lines and lines starting with "#" are ignored. An option can be
+// given more than once, e.g. "bind". A "[serial]" line starts a section of options for just the
+// device with that serial, which runs until the next section.
+func ReadConfig(r io.Reader) (*Config, error) {
+	config := &Config{Options: map[string][]string{}, Devices: map[string]map[string][]string{}}
+	options := config.Options
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			serial := strings.TrimSpace(line[1 : len(line)-1])
+			if serial == "" {
+				return nil, fmt.Errorf("line %d: expected [serial], got %q", lineNo, line)
+			}
+			if config.Devices[serial] == nil {
+				config.Devices[serial] = map[string][]string{}
+			}
+			options = config.Devices[serial]
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected name=value, got %q", lineNo, line)
+		}
+		name := strings.TrimPrefix(strings.TrimSpace(parts[0]), "-")
+		options[name] = append(options[name], strings.TrimSpace(parts[1]))
+	}
+	return config, scanner.Err()
+}
+
+// DeviceSettings are the options that can be set for a single device, in its section of the config
+// file. Anything that isn't set falls back to the option for every device.
+type DeviceSettings struct {
+	// Name is shown in the device bar in place of the name adb gives the device, from "name".
+	Name string
+	// Lines is how many of the device's most recent lines to keep in memory, from "lines". It's 0
+	// if it's not set, in which case bufferLines is used.
+	Lines int
+	// Filters are the filters the device starts out with views for, after the ones from -filter,
+	// from "filter" (which can be repeated).
+	Filters []string
+}
+
+// deviceSettings are the settings from each device's section of the config file, by serial.
+var deviceSettings = map[string]DeviceSettings{}
+
+// ParseDeviceSettings turns the options in each device's section of the config file into its
+// DeviceSettings.
+func ParseDeviceSettings(devices map[string]map[string][]string) (map[string]DeviceSettings, error) {
+	settings := make(map[string]DeviceSettings, len(devices))
+	for serial, options := range devices {
+		var s DeviceSettings
+		for name, values := range options {
+			last := values[len(values)-1]
+			switch name {
+			case "name":
+				s.Name = last
+			case "lines", "buffer-lines":
+				n, err := strconv.Atoi(last)
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("[%s]: invalid value %q for %s, it must be at least 1", serial, last, name)
+				}
+				s.Lines = n
+			case "filter":
+				s.Filters = values
+			default:
+				return nil, fmt.Errorf("[%s]: %s can't be set for a single device, only name, lines and filter",
+					serial, name)
+			}
+		}
+		settings[serial] = s
+	}
+	return settings, nil
+}
+
+// ResolveOptions sets every flag in fs that wasn't given on the command line from its environment
+// variable (see EnvName), or failing that from the config file. So a flag beats an environment
+// variable, which beats the config file, which beats the flag's default. Flags that share a
+// variable (e.g. -lines and its alias -buffer-lines) count as given if either of them was. Flags
+// that are set from the environment or config file count as set for IsSet, just like ones that
+// were given on the command line.
+func ResolveOptions(fs *flag.FlagSet, lookupEnv func(string) (string, bool), config map[string][]string) error {
+	given := make(map[flag.Value]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Value] = true
+	})
+	for name := range config {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown option in config file: %s", name)
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Value] {
+			return
+		}
+		values := config[f.Name]
+		source := "config file"
+		if value, ok := lookupEnv(EnvName(f.Name)); ok {
+			values = []string{value}
+			source = EnvName(f.Name)
+		}
+		for _, value := range values {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: invalid value %q for -%s: %v", source, value, f.Name, setErr)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// IsSet returns true if the flag with the given name was set, on the command line or by
+// ResolveOptions, rather than left at its default.
+func IsSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
+}
+
+// defaultConfigPath returns where we look for the config file when -config isn't given, or "" if
+// there's nowhere to look.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "lolcat", "config")
+}
+
+// loadOptions applies the environment variables and config file to the flags that weren't given
+// on the command line. A missing config file is only an error if it was asked for explicitly.
+func loadOptions(configPath string) error {
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		explicit = explicit || f.Name == "config"
+	})
+	if value, ok := os.LookupEnv(EnvName("config")); ok && !explicit {
+		configPath = value
+		explicit = true
+	}
+
+	config := &Config{}
+	if configPath != "" {
+		f, err := os.Open(configPath)
+		if err == nil {
+			config, err = ReadConfig(f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %v", configPath, err)
+			}
+		} else if explicit || !os.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(config.Options, "config")
+	settings, err := ParseDeviceSettings(config.Devices)
+	if err != nil {
+		return fmt.Errorf("%s: %v", configPath, err)
+	}
+	deviceSettings = settings
+	return ResolveOptions(flag.CommandLine, os.LookupEnv, config.Options)
+}
+
+// handleKey handles a single key press event. Returns true if it was the key to quit.
+func handleKey(ev termbox.Event) bool {
+	if overlay != nil {
+		handleOverlayKey(ev)
+		return false
+	}
+	if prompt != nil {
+		handlePromptKey(ev)
+		return false
+	}
+	if completion != nil {
+		if handleCompletionKey(ev) {
+			return false
+		}
+		// Any other key closes the dropdown, unless the cursor's still in a token we can complete.
+		defer refreshCompletion()
 	}
 
-	lv.index = nil
-	for no := lb.lineNo - int64(len(lb.lines)); no <= lb.lineNo; no++ {
-		if no <= 0 {
-			continue
+	if action, ok := keymap[bindingFor(ev)]; ok {
+		if action == ActionQuit {
+			return true
 		}
-		index := lb.LineNoToIndex(no)
-		if lv.filter == nil || lv.filter.MatchString(lb.lines[index]) {
-			lv.index = append(lv.index, no)
+		actions[action]()
+	} else if ev.Ch >= '1' && ev.Ch <= '9' && ev.Mod == termbox.ModAlt {
+		moveViewTo(int(ev.Ch - '1'))
+	} else if ev.Ch == 0 && ev.Key <= termbox.KeyF1 && ev.Key >= termbox.KeyF9 {
+		// F1 to F9 jump straight to that device (the keys count down from F1).
+		if index := int(termbox.KeyF1 - ev.Key); index < len(devices) {
+			moveDeviceTo(index)
 		}
+	} else if ev.Key == termbox.KeySpace {
+		editbox.InsertRune(' ')
+		filterEdited()
+	} else if ev.Ch != 0 && ev.Mod == 0 {
+		editbox.InsertRune(ev.Ch)
+		filterEdited()
 	}
+	return false
 }
 
-// GetLastLineNo returns the index of the last line in the log buffer.
-// You should only call this method when you've got the device's mutex locked.
-func (lv *LogView) GetLastLineNo() int64 {
-	if lv.index == nil {
-		return 0
-	}
+// Prompt is a question that we ask in the editbox, in place of the filter. For example, the
+// pattern to search for.
+type Prompt struct {
+	Label    string
+	OnAnswer func(answer string)
 
-	return lv.index[len(lv.index)-1]
+	// savedText is what was in the editbox before the prompt took it over.
+	savedText string
 }
 
-// GetLines returns a slice of the lines with the given line no at the end, and count elements big.
-func (lv *LogView) GetLines(bottomLineNo int64, count int) []string {
-	// TODO: can we keep these in a buffer to avoid allocating the new array each time?
-	res := make([]string, int(count))
-	ri := count - 1
-	for i := len(lv.index) - 1; i >= 0; i-- {
-		if lv.index[i] > bottomLineNo {
-			continue
-		}
-		index := lv.lb.LineNoToIndex(lv.index[i])
-		if index < 0 {
-			break
-		}
-		res[ri] = lv.lb.lines[index]
-		ri--
-		if ri < 0 {
-			break
-		}
+// prompt is the Prompt we're currently asking, or nil if the editbox is being used for the filter.
+var prompt *Prompt
+
+// askPrompt takes over the editbox to ask the given question. onAnswer is called with the answer,
+// unless the prompt is cancelled with Esc.
+func askPrompt(label string, onAnswer func(answer string)) {
+	prompt = &Prompt{Label: label, OnAnswer: onAnswer, savedText: string(editbox.text)}
+	completion = nil
+	editbox.SetText("")
+	editbox.MoveCursorToBeginningOfTheLine()
+}
+
+// closePrompt gives the editbox back to the filter.
+func closePrompt() {
+	editbox.SetText(prompt.savedText)
+	editbox.MoveCursorToEndOfTheLine()
+	prompt = nil
+}
+
+// editActions are the actions that edit the text in the editbox, which are the only ones allowed
+// while we're asking a Prompt.
+var editActions = map[Action]bool{
+	ActionCursorLeft:       true,
+	ActionCursorRight:      true,
+	ActionCursorHome:       true,
+	ActionCursorEnd:        true,
+	ActionDeleteBackward:   true,
+	ActionDeleteForward:    true,
+	ActionDeleteRestOfLine: true,
+	ActionWordLeft:         true,
+	ActionWordRight:        true,
+	ActionDeleteWord:       true,
+}
+
+// handlePromptKey handles a key press while we're asking a Prompt. Enter answers it, Esc cancels
+// it, and the editing keys work as usual.
+func handlePromptKey(ev termbox.Event) {
+	switch {
+	case ev.Key == termbox.KeyEnter:
+		answer, onAnswer := string(editbox.text), prompt.OnAnswer
+		closePrompt()
+		onAnswer(answer)
+	case ev.Key == termbox.KeyEsc:
+		closePrompt()
+	case editActions[keymap[bindingFor(ev)]]:
+		actions[keymap[bindingFor(ev)]]()
+	case ev.Key == termbox.KeySpace:
+		editbox.InsertRune(' ')
+	case ev.Ch != 0 && ev.Mod == 0:
+		editbox.InsertRune(ev.Ch)
 	}
-	return res
 }
 
-// Draw draws the EditBox in the given location
-func (eb *EditBox) Draw(x, y, w int) {
-	eb.AdjustVisualOffset(w)
+// Overlay is a list that's shown on top of the log lines, e.g. search results. If OnSelect is set,
+// items can be selected with the arrow keys and chosen with Enter.
+type Overlay struct {
+	Title    string
+	Items    []string
+	OnSelect func(index int)
 
-	const coldef = termbox.ColorDefault
-	fill(x, y, w, 1, termbox.Cell{Ch: ' '})
+	// Summary is the table the overlay is showing, if it's one that can be exported.
+	Summary *Summary
 
-	t := eb.text
-	lx := 0
-	tabstop := 0
-	for {
-		rx := lx - eb.visualOffset
-		if len(t) == 0 {
-			break
+	selected int
+}
+
+// overlay is the Overlay being shown, or nil if there isn't one.
+var overlay *Overlay
+
+// handleOverlayKey handles a key press while an Overlay is shown. Esc closes it.
+func handleOverlayKey(ev termbox.Event) {
+	if keymap[bindingFor(ev)] == ActionExport && overlay.Summary != nil {
+		exportSummary(overlay.Summary)
+		return
+	}
+	l := currentLayout()
+	page := l.LogBottom() - l.PinnedTop
+	switch ev.Key {
+	case termbox.KeyArrowUp:
+		overlay.selected--
+	case termbox.KeyArrowDown:
+		overlay.selected++
+	case termbox.KeyPgup:
+		overlay.selected -= page
+	case termbox.KeyPgdn:
+		overlay.selected += page
+	case termbox.KeyHome:
+		overlay.selected = 0
+	case termbox.KeyEnd:
+		overlay.selected = len(overlay.Items) - 1
+	case termbox.KeyEnter:
+		if overlay.OnSelect != nil && len(overlay.Items) > 0 {
+			onSelect, selected := overlay.OnSelect, overlay.selected
+			overlay = nil
+			onSelect(selected)
 		}
+		return
+	case termbox.KeyEsc:
+		overlay = nil
+		return
+	}
+	if overlay.selected >= len(overlay.Items) {
+		overlay.selected = len(overlay.Items) - 1
+	}
+	if overlay.selected < 0 {
+		overlay.selected = 0
+	}
+}
 
-		if rx >= w {
-			termbox.SetCell(x+w-1, y, '→',
-				coldef, coldef)
-			break
+// drawOverlay draws the current overlay over the log area, between rows top and bottom inclusive.
+func drawOverlay(top, bottom, w int) {
+	coldef := termbox.ColorDefault
+	title := coldef | termbox.AttrReverse
+	fill(0, top, w, 1, termbox.Cell{Ch: ' ', Fg: title, Bg: title})
+	tbprint(1, top, title, title, overlay.Title)
+	fill(0, top+1, w, bottom-top, termbox.Cell{Ch: ' ', Fg: coldef, Bg: coldef})
+
+	rows := bottom - top
+	first := 0
+	if overlay.selected >= rows {
+		first = overlay.selected - rows + 1
+	}
+	for i := first; i < len(overlay.Items) && i-first < rows; i++ {
+		attr := coldef
+		if overlay.OnSelect != nil && i == overlay.selected {
+			attr |= termbox.AttrReverse
+			fill(0, top+1+i-first, w, 1, termbox.Cell{Ch: ' ', Fg: attr, Bg: attr})
 		}
+		tbprint(1, top+1+i-first, attr, attr, overlay.Items[i])
+	}
+}
 
-		r, size := utf8.DecodeRune(t)
-		if r == '\t' {
-			for ; lx < tabstop; lx++ {
-				rx = lx - eb.visualOffset
-				if rx >= w {
-					goto next
-				}
+// MaxSearchResults is the most results we'll list when searching every device.
+const MaxSearchResults = 1000
 
-				if rx >= 0 {
-					termbox.SetCell(x+rx, y, ' ', coldef, coldef)
-				}
+// searchAllDevices searches the buffer of every device for lines matching the given regex, and
+// shows the results in an overlay. Choosing one of them jumps to that line.
+func searchAllDevices(pattern string) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		statusMessage = err.Error()
+		return
+	}
+
+	type hit struct {
+		device int
+		lineNo int64
+	}
+	var hits []hit
+	var items, counts []string
+	for i, d := range devices {
+		n := 0
+		d.mutex.Lock()
+		d.logBuffer.ForEachLine(func(lineNo int64, line string) {
+			if !re.MatchString(line) {
+				return
 			}
-		} else {
-			if rx >= 0 {
-				termbox.SetCell(x+rx, y, r, coldef, coldef)
+			n++
+			if len(hits) < MaxSearchResults {
+				hits = append(hits, hit{i, lineNo})
+				items = append(items, d.Name+": "+line)
 			}
-			lx += runewidth.RuneWidth(r)
+		})
+		d.mutex.Unlock()
+		counts = append(counts, fmt.Sprintf("%s %d", d.Name, n))
+	}
+
+	title := fmt.Sprintf("%q: %s", pattern, strings.Join(counts, ", "))
+	if len(hits) == MaxSearchResults {
+		title += fmt.Sprintf(" (showing the first %d)", MaxSearchResults)
+	}
+	overlay = &Overlay{
+		Title: title,
+		Items: items,
+		OnSelect: func(index int) {
+			jumpToLine(hits[index].device, hits[index].lineNo)
+		},
+	}
+}
+
+// searchMatcher is what we last searched the current view for with search, or nil if we haven't.
+// Its matches are highlighted, like a filter's, until the next search.
+var searchMatcher Matcher
+
+// searchText is the text searchMatcher was compiled from, which the search prompt starts with.
+var searchText string
+
+// startSearch asks what to search the current view for, and jumps to the nearest older line that
+// matches. Unlike a filter, the lines that don't match are still shown.
+func startSearch() {
+	askPrompt("Search:", func(answer string) {
+		if answer == "" {
+			searchMatcher, searchText = nil, ""
+			return
+		}
+		m, err := CompileMatcher(matchEngine, answer)
+		if err != nil {
+			statusMessage = err.Error()
+			return
+		}
+		searchMatcher, searchText = m, answer
+		searchView(-1)
+	})
+	editbox.SetText(searchText)
+	editbox.MoveCursorToEndOfTheLine()
+}
+
+// searchView jumps to the next line in the current view that matches searchMatcher, older than the
+// selected line (or the bottom of the screen, if there isn't one) if direction is negative, or newer
+// if it's positive. It doesn't wrap around at either end.
+func searchView(direction int) {
+	d := currentDevice()
+	if d == nil {
+		return
+	}
+	if searchMatcher == nil {
+		statusMessage = "Nothing to search for yet, use search first"
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	from := selectedLineNo
+	if from == 0 {
+		from = bottomLineNo
+	}
+	lb, lineNos := d.GetViewLineNos(viewIndex, 0, d.ViewBuffer(viewIndex).Len())
+	if from == 0 && len(lineNos) > 0 {
+		// We're following new lines, so start just past the newest one, so that it can match too.
+		from = lineNos[0] + 1
+	}
+	// lineNos is newest first, so searching back means going forward through it.
+	for i := range lineNos {
+		lineNo := lineNos[i]
+		if direction > 0 {
+			lineNo = lineNos[len(lineNos)-1-i]
+		}
+		if (direction < 0 && lineNo >= from) || (direction > 0 && lineNo <= from) {
+			continue
+		}
+		if searchMatcher.MatchString(lb.GetLine(lineNo)) {
+			scrollTo(d, lineNo)
+			return
 		}
-	next:
-		t = t[size:]
 	}
+	if direction < 0 {
+		statusMessage = fmt.Sprintf("No older lines match %q", searchText)
+	} else {
+		statusMessage = fmt.Sprintf("No newer lines match %q", searchText)
+	}
+}
 
-	if eb.visualOffset != 0 {
-		termbox.SetCell(x, y, '←', coldef, coldef)
+// showKeys lists every action with the keys that are bound to it, as they've been set up with
+// -bind.
+func showKeys() {
+	keys := make(map[Action][]string)
+	for kb, action := range keymap {
+		keys[action] = append(keys[action], KeyName(kb))
 	}
+	var names []Action
+	for action := range keys {
+		names = append(names, action)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	var items []string
+	for _, action := range names {
+		sort.Strings(keys[action])
+		items = append(items, fmt.Sprintf("%-22s %s", action, strings.Join(keys[action], ", ")))
+	}
+	overlay = &Overlay{Title: "Keys (change them with -bind)", Items: items}
 }
 
-// AdjustVisualOffset adjusts line visual offset to a proper value depending on width
-func (eb *EditBox) AdjustVisualOffset(width int) {
-	ht := PreferredHorizontalThreshold
-	maxHorizontalThreshold := (width - 1) / 2
-	if ht > maxHorizontalThreshold {
-		ht = maxHorizontalThreshold
+// jumpToLine switches to the given device's "no filter" view, and scrolls so that the given line
+// is in the middle of the screen, and selected.
+func jumpToLine(device int, lineNo int64) {
+	if device != deviceIndex {
+		moveDeviceTo(device)
 	}
+	moveViewTo(0)
+	d := currentDevice()
+	d.mutex.Lock()
+	scrollTo(d, lineNo)
+	d.mutex.Unlock()
+}
 
-	threshold := width - 1
-	if eb.visualOffset != 0 {
-		threshold = width - ht
+// scrollTo scrolls the current view so that the given line is in the middle of the screen (or as
+// close as we can get, if it's one of the most recent lines), and selects it. You should only call
+// this method when you've got the device's mutex locked.
+func scrollTo(d *Device, lineNo int64) {
+	rows := currentLayout().LogRows
+	selectedLineNo = lineNo
+	bottomLineNo = lineNo + int64(rows)/2
+	if viewIndex > 0 {
+		// The lines below this one in a filtered view aren't the ones right after it in the buffer.
+		index := d.logViews[viewIndex-1].index
+		i := sort.Search(len(index), func(i int) bool { return index[i] >= lineNo }) + rows/2
+		if i < len(index) {
+			bottomLineNo = index[i]
+		} else {
+			bottomLineNo = 0
+		}
 	}
-	if eb.cursorOffsetCells-eb.visualOffset >= threshold {
-		eb.visualOffset = eb.cursorOffsetCells + (ht - width + 1)
+	if bottomLineNo >= d.ViewBuffer(viewIndex).GetLastLineNo() {
+		bottomLineNo = 0
+	} else {
+		statusMessage = "Press Esc to go back to following new lines"
 	}
+}
 
-	if eb.visualOffset != 0 && eb.cursorOffsetCells-eb.visualOffset < ht {
-		eb.visualOffset = eb.cursorOffsetCells - ht
-		if eb.visualOffset < 0 {
-			eb.visualOffset = 0
+// scrollBy scrolls the current view back (delta < 0) or forward (delta > 0) by the given number of
+// lines. We stop at the oldest line that's still in the buffer, and scrolling forward past the most
+// recent line goes back to following new lines.
+func scrollBy(delta int) {
+	d := currentDevice()
+	if d == nil {
+		return
+	}
+	rows := currentLayout().LogRows
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	lb := d.ViewBuffer(viewIndex)
+	if viewIndex == 0 {
+		bottom := bottomLineNo
+		if bottom == 0 {
+			bottom = lb.GetLastLineNo()
+		}
+		bottom += int64(delta)
+		if oldest := lb.GetFirstLineNo() + int64(rows) - 1; bottom < oldest {
+			bottom = oldest
+		}
+		bottomLineNo = bottom
+	} else {
+		index := d.logViews[viewIndex-1].index
+		i := len(index) - 1
+		if bottomLineNo != 0 {
+			i = sort.Search(len(index), func(i int) bool { return index[i] > bottomLineNo }) - 1
+		}
+		first := lb.GetFirstLineNo()
+		oldest := sort.Search(len(index), func(i int) bool { return index[i] >= first }) + rows - 1
+		if i += delta; i < oldest {
+			i = oldest
 		}
+		bottomLineNo = 0
+		if i >= 0 && i < len(index) {
+			bottomLineNo = index[i]
+		}
+	}
+	if bottomLineNo >= d.ViewBuffer(viewIndex).GetLastLineNo() {
+		bottomLineNo = 0
 	}
 }
 
-func adjustOffset(text []byte, offsetBytes int) (offsetCells, offsetRunes int) {
-	text = text[:offsetBytes]
-	for len(text) > 0 {
-		r, size := utf8.DecodeRune(text)
-		text = text[size:]
-		offsetRunes++
-		offsetCells += runewidth.RuneWidth(r)
+// scrollToOldest scrolls the current view back as far as it goes, so the oldest lines are on screen.
+func scrollToOldest() {
+	d := currentDevice()
+	if d == nil {
+		return
 	}
-	return
+	d.mutex.Lock()
+	oldest := d.ViewBuffer(viewIndex).GetFirstLineNo() - d.ViewBuffer(viewIndex).GetLastLineNo()
+	d.mutex.Unlock()
+	scrollBy(int(oldest))
 }
 
-// MoveCursorTo moves the cursor to the given byte offset.
-func (eb *EditBox) MoveCursorTo(offsetBytes int) {
-	eb.cursorOffsetBytes = offsetBytes
-	eb.cursorOffsetCells, eb.cursorOffsetCells = adjustOffset(eb.text, offsetBytes)
+// followNewLines jumps back to the newest line and follows new lines from then on, whether we'd
+// scrolled back or paused.
+func followNewLines() {
+	bottomLineNo = 0
+	paused = false
 }
 
-// RuneUnderCursor returns the rune (and it's size) under the cursor.
-func (eb *EditBox) RuneUnderCursor() (rune, int) {
-	return utf8.DecodeRune(eb.text[eb.cursorOffsetBytes:])
+// paused is true if the screen stays where it is rather than following new lines, which still go
+// into the buffer. We pin the bottom line, so it's much like scrolling back.
+var paused bool
+
+// togglePause pauses or unpauses following new lines. Unpausing jumps back to the newest line.
+func togglePause() {
+	paused = !paused
+	if !paused {
+		bottomLineNo = 0
+		statusMessage = "Following new lines again"
+	}
 }
 
-// RuneBeforeCursor returns the rune (and it's size) before the cursor.
-func (eb *EditBox) RuneBeforeCursor() (rune, int) {
-	return utf8.DecodeLastRune(eb.text[:eb.cursorOffsetBytes])
+// newerLineCount returns how many lines in the current view are below the bottom of the screen,
+// when we've scrolled back.
+func newerLineCount() int {
+	d := currentDevice()
+	if d == nil || bottomLineNo == 0 {
+		return 0
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if viewIndex == 0 {
+		return int(d.logBuffer.GetLastLineNo() - bottomLineNo)
+	}
+	index := d.logViews[viewIndex-1].index
+	return len(index) - sort.Search(len(index), func(i int) bool { return index[i] > bottomLineNo })
 }
 
-// MoveCursorOneRuneBackward moves the cursor one rune to the left (if possible)
-func (eb *EditBox) MoveCursorOneRuneBackward() {
-	if eb.cursorOffsetBytes == 0 {
-		return
+// halfPage is how many lines the half-page scroll actions move by, from the -half-page flag. If
+// it's 0, it's half of the log area.
+var halfPage int
+
+// scrollByPages scrolls the current view by the given number of pages (which can be fractional,
+// for half a page). A negative number scrolls back.
+func scrollByPages(pages float64) {
+	rows := currentLayout().LogRows
+	n := int(float64(rows) * pages)
+	if (pages == 0.5 || pages == -0.5) && halfPage > 0 {
+		n = halfPage
+		if pages < 0 {
+			n = -halfPage
+		}
 	}
-	_, size := eb.RuneBeforeCursor()
-	eb.MoveCursorTo(eb.cursorOffsetBytes - size)
+	scrollBy(n)
 }
 
-// MoveCursorOneRuneForward moves the cursor one run to the right (if possible)
-func (eb *EditBox) MoveCursorOneRuneForward() {
-	if eb.cursorOffsetBytes == len(eb.text) {
+// goToLine scrolls to the given line number (as text, since it's what was typed into the prompt)
+// in the current view. In a filtered view, if the line doesn't match we go to the nearest one that
+// does.
+func goToLine(text string) {
+	d := currentDevice()
+	if d == nil {
 		return
 	}
-	_, size := eb.RuneUnderCursor()
-	eb.MoveCursorTo(eb.cursorOffsetBytes + size)
+	lineNo, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+	if err != nil || lineNo <= 0 {
+		statusMessage = fmt.Sprintf("%q isn't a line number", text)
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	lb := d.ViewBuffer(viewIndex)
+	if !lb.HasLine(lineNo) {
+		if lineNo > lb.GetLastLineNo() {
+			statusMessage = fmt.Sprintf("There's no line %d yet", lineNo)
+		} else {
+			statusMessage = fmt.Sprintf("Line %d has expired from the buffer", lineNo)
+		}
+		return
+	}
+	if viewIndex > 0 {
+		nearest, ok := d.logViews[viewIndex-1].NearestLineNo(lineNo)
+		if !ok {
+			statusMessage = "Nothing in this view to go to"
+			return
+		}
+		lineNo = nearest
+	}
+	scrollTo(d, lineNo)
 }
 
-// MoveCursorToBeginningOfTheLine moves the cursor to the beginning of the line.
-func (eb *EditBox) MoveCursorToBeginningOfTheLine() {
-	eb.MoveCursorTo(0)
+// deviceInfo is what 'adb devices' tells us about a single attached device.
+type deviceInfo struct {
+	id   string
+	name string
+
+	// state is what adb says about the device: "device" if it's ready to use, or "offline",
+	// "unauthorized" and so on.
+	state string
 }
 
-// MoveCursorToEndOfTheLine moves the cursor to the end of the line.
-func (eb *EditBox) MoveCursorToEndOfTheLine() {
-	eb.MoveCursorTo(len(eb.text))
+// listDevices returns the list of attached devices (by running 'adb devices' basically).
+func listDevices() ([]deviceInfo, error) {
+	cmd := adbCommand("devices", "-l")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []deviceInfo
+	for scanner.Scan() {
+		if info, ok := parseDeviceLine(scanner.Text()); ok {
+			infos = append(infos, info)
+		}
+	}
+	err = scanner.Err()
+	if waitErr := cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	return infos, err
 }
 
-// DeleteRuneBackward delets the rune to the left of the cursor.
-func (eb *EditBox) DeleteRuneBackward() {
-	if eb.cursorOffsetBytes == 0 {
+// parseDeviceLine parses a line of 'adb devices -l' output, which looks like:
+//
+//	emulator-5554  device product:sdk_gphone64 model:Pixel_6 device:emu64 transport_id:1
+//
+// Returns false for lines that aren't a device (e.g. the "List of devices attached" header, or the
+// daemon's "* daemon started successfully"). Devices that aren't ready to use (e.g. "offline" or
+// "unauthorized") are returned too, with their state. The model, if there is one, is used as the
+// device's name.
+func parseDeviceLine(line string) (deviceInfo, bool) {
+	parts := strings.Fields(line)
+	if len(parts) < 2 || strings.HasPrefix(parts[0], "*") || strings.HasPrefix(line, "List of devices") {
+		return deviceInfo{}, false
+	}
+
+	info := deviceInfo{id: parts[0], name: parts[0], state: parts[1]}
+	for _, field := range parts[2:] {
+		// Only split on the first colon, in case the value has colons in it too.
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) == 2 && kv[0] == "model" && kv[1] != "" {
+			info.name = strings.Replace(kv[1], "_", " ", -1)
+		}
+	}
+	return info, true
+}
+
+// addDevices opens any device in the given list that we don't already know about, and updates the
+// state of the ones we do. Devices that aren't ready to use aren't opened until they are, and any we
+// know about that aren't in the list any more are marked offline.
+func addDevices(infos []deviceInfo) {
+	listed := map[string]bool{}
+	for _, info := range infos {
+		listed[info.id] = true
+		index := -1
+		for i, d := range devices {
+			if d.ID == info.id {
+				index = i
+				break
+			}
+		}
+		if index >= 0 {
+			// A device that was unauthorized when we first saw it might have been allowed since.
+			known := devices[index]
+			known.SetAdbState(info.state)
+			if info.state == "device" && !known.opened && index < maxDevices {
+				known.Open()
+			}
+			continue
+		}
+
+		d := NewDevice(info.id, info.name)
+		d.SetAdbState(info.state)
+		if info.state == "device" && len(devices) < maxDevices {
+			d.Open()
+		}
+		devices = append(devices, d)
+	}
+	now := time.Now()
+	for _, d := range devices {
+		if listed[d.ID] {
+			d.missingSince = time.Time{}
+			continue
+		}
+		d.SetAdbState("")
+		if d.missingSince.IsZero() {
+			d.missingSince = now
+		}
+	}
+}
+
+// forgetDevices closes and removes any device that's been missing from 'adb devices' for at least
+// forgetAfter. If the current device goes, we move to the one that took its place. Returns true if
+// any were removed.
+func forgetDevices(now time.Time) bool {
+	if forgetAfter <= 0 {
+		return false
+	}
+	current := currentDevice()
+	var kept []*Device
+	var forgotten []string
+	for _, d := range devices {
+		if d.missingSince.IsZero() || now.Sub(d.missingSince) < forgetAfter {
+			kept = append(kept, d)
+			continue
+		}
+		d.Close()
+		forgotten = append(forgotten, d.Name)
+		if d == splitDevice {
+			splitDevice = nil
+		}
+	}
+	if len(forgotten) == 0 {
+		return false
+	}
+
+	devices = kept
+	statusMessage = "Forgot unplugged " + strings.Join(forgotten, ", ")
+	for i, d := range devices {
+		if d == current {
+			deviceIndex = i
+			return true
+		}
+	}
+	if deviceIndex >= len(devices) {
+		deviceIndex = len(devices) - 1
+	}
+	if deviceIndex < 0 {
+		// That was the last one, there's nothing to show until another is attached.
+		deviceIndex = 0
+		viewIndex = 0
+		selectedLineNo = 0
+		bottomLineNo = 0
+		previousView = nil
+		editbox.SetText("")
+		return true
+	}
+	moveDeviceTo(deviceIndex)
+	return true
+}
+
+// devicesErr is why the last 'adb devices' failed (e.g. adb isn't installed, or the adb server
+// died), or nil if it worked. It's shown at the end of the device bar.
+var devicesErr error
+
+// refreshDevices refreshes the list of attached devices (by running 'adb devices' basically). If
+// that fails, the error is kept in devicesErr and the devices are left as they are.
+func refreshDevices() {
+	infos, err := listDevices()
+	if err != nil {
+		devicesErr = fmt.Errorf("'adb devices' failed: %v", err)
 		return
 	}
+	devicesErr = nil
+	addDevices(infos)
+}
 
-	eb.MoveCursorOneRuneBackward()
-	_, size := eb.RuneUnderCursor()
-	eb.text = byteSliceRemove(eb.text, eb.cursorOffsetBytes, eb.cursorOffsetBytes+size)
+// chooseBuffers asks which of logcat's buffers to read, starting with the ones we're reading now.
+func chooseBuffers() {
+	askPrompt("Logcat buffers (e.g. main,crash, or empty for the default):", setLogcatBuffer)
+	editbox.SetText(logcatBuffer)
+	editbox.MoveCursorToEndOfTheLine()
 }
 
-// DeleteRuneForward deletes the rune to the right of the cursor.
-func (eb *EditBox) DeleteRuneForward() {
-	if eb.cursorOffsetBytes == len(eb.text) {
+// setLogcatBuffer switches to reading the given logcat buffers (like -buffer). Every device we've
+// opened is reconnected straight away and its logs are cleared, since logcat will give us the
+// history of the new buffers.
+func setLogcatBuffer(answer string) {
+	buffer, err := ParseLogcatBuffer(answer)
+	if err != nil {
+		statusMessage = err.Error()
 		return
 	}
-	_, size := eb.RuneUnderCursor()
-	eb.text = byteSliceRemove(eb.text, eb.cursorOffsetBytes, eb.cursorOffsetBytes+size)
+	if buffer == logcatBuffer {
+		return
+	}
+	logcatBuffer = buffer
+	for _, d := range devices {
+		if d.opened {
+			d.Reconnect(true)
+			d.Retry()
+		}
+	}
+	selectedLineNo = 0
+	bottomLineNo = 0
+	if buffer == "" {
+		statusMessage = "Reading logcat's default buffers"
+	} else {
+		statusMessage = "Reading the " + buffer + " buffers"
+	}
 }
 
-// DeleteTheRestOfTheLine deletes everything to the right of the cursor.
-func (eb *EditBox) DeleteTheRestOfTheLine() {
-	eb.text = eb.text[:eb.cursorOffsetBytes]
+// reconnectAll restarts the stream of every device we've opened, and re-runs 'adb devices' to pick
+// up any new ones. The answer is from the prompt asking whether to clear their logs too.
+func reconnectAll(answer string) {
+	clear := strings.HasPrefix(strings.ToLower(answer), "y")
+	n := 0
+	for _, d := range devices {
+		if d.opened {
+			d.Reconnect(clear)
+			n++
+		}
+	}
+	if clear {
+		selectedLineNo = 0
+		bottomLineNo = 0
+	}
+	statusMessage = "Reconnected " + Plural(n, "device", "devices")
+	listDevicesInBackground(statusMessage)
 }
 
-// SetText sets the current text to the given value
-func (eb *EditBox) SetText(text string) {
-	eb.text = []byte(text)
-	if eb.cursorOffsetBytes > len(eb.text) {
-		eb.MoveCursorTo(len(eb.text))
+// Plural returns n followed by whichever of the singular or plural form of a noun goes with it,
+// e.g. "1 device" or "2 devices".
+func Plural(n int, singular, plural string) string {
+	if n == 1 {
+		return "1 " + singular
 	}
+	return fmt.Sprintf("%d %s", n, plural)
 }
 
-// InsertRune inserts the given rune at the current cursor position.
-func (eb *EditBox) InsertRune(r rune) {
-	var buf [utf8.UTFMax]byte
-	n := utf8.EncodeRune(buf[:], r)
-	eb.text = byteSliceInsert(eb.text, eb.cursorOffsetBytes, buf[:n])
-	eb.MoveCursorOneRuneForward()
+// deviceUpdates carries each deviceUpdate to the main loop, from pollDevices and from
+// listDevicesInBackground.
+var deviceUpdates = make(chan deviceUpdate)
+
+// listDevicesInBackground runs 'adb devices' without holding up the UI, which it would for as long
+// as adb hangs, and sends what it lists to deviceUpdates. The status is the message to show with
+// the result.
+func listDevicesInBackground(status string) {
+	go func() {
+		infos, err := listDevices()
+		if err != nil {
+			err = fmt.Errorf("'adb devices' failed: %v", err)
+		}
+		deviceUpdates <- deviceUpdate{infos, err, status}
+	}()
 }
 
-// CursorX ...
-// Please, keep in mind that cursor depends on the value of visualOffset, which
-// is being set on Draw() call, so.. call this method after Draw() one.
-func (eb *EditBox) CursorX() int {
-	return eb.cursorOffsetCells - eb.visualOffset
+// pollDevices sends the list of attached devices to the main loop whenever it changes, so that it
+// can pick up devices as they're plugged in and notice them being unplugged. We use 'adb
+// track-devices', which tells us straight away. If that fails (e.g. adb is too old to have it), or
+// adb exits, we re-run 'adb devices' after pollInterval instead, and then try tracking again.
+func pollDevices(updates chan<- deviceUpdate) {
+	for {
+		trackDevices(updates)
+		time.Sleep(pollInterval)
+		infos, err := listDevices()
+		if err != nil {
+			err = fmt.Errorf("'adb devices' failed: %v", err)
+		}
+		updates <- deviceUpdate{infos: infos, err: err}
+	}
 }
 
-func byteSliceRemove(text []byte, from, to int) []byte {
-	size := to - from
-	copy(text[from:], text[to:])
-	text = text[:len(text)-size]
-	return text
+// deviceUpdate is sent to the main loop with either the attached devices or why we couldn't list
+// them.
+type deviceUpdate struct {
+	infos []deviceInfo
+	err   error
+
+	// status is the message for whoever asked for the update (e.g. "Reconnected 2 devices"), which
+	// we show along with what came of it, or "" if it's just from polling.
+	status string
 }
 
-func byteSliceGrow(s []byte, desiredCap int) []byte {
-	if cap(s) < desiredCap {
-		ns := make([]byte, len(s), desiredCap)
-		copy(ns, s)
-		return ns
+// applyDeviceUpdate adds any new devices from the given update, and forgets ones that have been
+// gone for a while. If listing the devices failed, the error is kept in devicesErr instead, and the
+// devices are left as they are.
+func applyDeviceUpdate(update deviceUpdate, now time.Time) {
+	devicesErr = update.err
+	if update.err != nil {
+		if update.status != "" {
+			statusMessage = update.status + ", but " + update.err.Error()
+		}
+		return
 	}
-	return s
+	known := len(devices)
+	addDevices(update.infos)
+	if update.status != "" {
+		// Only count the new devices we can actually stream from, not ones that are offline or
+		// waiting for the debugging prompt to be accepted.
+		found := 0
+		for _, d := range devices[known:] {
+			d.mutex.Lock()
+			if d.state != StateOffline && d.state != StateUnauthorized {
+				found++
+			}
+			d.mutex.Unlock()
+		}
+		statusMessage = fmt.Sprintf("%s, found %d new", update.status, found)
+	}
+	forgetDevices(now)
 }
 
-func byteSliceInsert(text []byte, offset int, what []byte) []byte {
-	n := len(text) + len(what)
-	text = byteSliceGrow(text, n)
-	text = text[:n]
-	copy(text[offset+len(what):], text[offset:])
-	copy(text[offset:], what)
-	return text
+// retryNow skips the wait before reconnecting to any device that's lost its connection, and
+// re-runs 'adb devices' in case that failed last time.
+func retryNow() {
+	n := 0
+	for _, d := range devices {
+		d.mutex.Lock()
+		if d.opened && d.state == StateReconnecting {
+			d.Retry()
+			n++
+		}
+		d.mutex.Unlock()
+	}
+	statusMessage = "Retrying " + Plural(n, "device", "devices")
+	listDevicesInBackground(statusMessage)
 }
 
-func tbprint(x, y int, fg, bg termbox.Attribute, msg string) int {
-	n := 0
-	for _, c := range msg {
-		termbox.SetCell(x, y, c, fg, bg)
-		width := runewidth.RuneWidth(c)
-		x += width
-		n += width
+// trackDevices runs 'adb track-devices', sending each list of devices it gives us to updates until
+// it exits.
+func trackDevices(updates chan<- deviceUpdate) error {
+	cmd := adbCommand("track-devices", "-l")
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
 	}
-	return n
+	if err != nil {
+		return err
+	}
+	err = readTrackedDevices(stdout, func(infos []deviceInfo) {
+		updates <- deviceUpdate{infos: infos}
+	})
+	cmd.Process.Kill()
+	cmd.Wait()
+	return err
 }
 
-func fill(x, y, w, h int, cell termbox.Cell) {
-	for ly := 0; ly < h; ly++ {
-		for lx := 0; lx < w; lx++ {
-			termbox.SetCell(x+lx, y+ly, cell.Ch, cell.Fg, cell.Bg)
+// readTrackedDevices reads the output of 'adb track-devices', calling fn with each list of devices.
+// Every list is the same as 'adb devices -l' would print (without the header), preceded by its
+// length as four hex digits, e.g. "002aemulator-5554 device product:sdk model:Pixel_6\n". An empty
+// list means there's no devices.
+func readTrackedDevices(r io.Reader, fn func([]deviceInfo)) error {
+	br := bufio.NewReader(r)
+	var length [4]byte
+	for {
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n, err := strconv.ParseUint(string(length[:]), 16, 16)
+		if err != nil {
+			return fmt.Errorf("bad length from 'adb track-devices': %q", length[:])
+		}
+		list := make([]byte, n)
+		if _, err := io.ReadFull(br, list); err != nil {
+			return err
+		}
+		var infos []deviceInfo
+		for _, line := range strings.Split(string(list), "\n") {
+			if info, ok := parseDeviceLine(line); ok {
+				infos = append(infos, info)
+			}
 		}
+		fn(infos)
 	}
 }
 
-func render() {
-	coldef := termbox.ColorDefault
-	termbox.Clear(coldef, coldef)
-	w, h := termbox.Size()
-
-	// Top line, device list
-	x := 0
-	coldef = termbox.ColorDefault | termbox.AttrReverse
-	for _, d := range devices {
-		x += tbprint(x, 0, coldef, coldef, "［")
-		coldef = termbox.ColorDefault
-		x += tbprint(x, 0, coldef, coldef, d.Name)
-		coldef = termbox.ColorDefault | termbox.AttrReverse
-		x += tbprint(x, 0, coldef, coldef, "］")
+// moveDeviceTo selects the device at the given index (wrapping around at either end), starting to
+// stream its logs if we haven't already.
+func moveDeviceTo(index int) {
+	if len(devices) == 0 {
+		return
 	}
-	for ; x < w; x++ {
-		termbox.SetCell(x, 0, ' ', coldef, coldef)
-	}
-
-	// Start from bottom and write up
-	if len(devices) > deviceIndex {
-		logBuffer := devices[deviceIndex].logBuffer
-		devices[deviceIndex].mutex.Lock()
-		var lines []string
-		if viewIndex == 0 {
-			lastLineNo := logBuffer.GetLastLineNo()
-			firstLineNo := lastLineNo - int64(h) + 3
-			lines = logBuffer.GetLines(firstLineNo, lastLineNo)
-		} else {
-			lastLineNo := logBuffer.GetLastLineNo()
-			count := h - 3
-			lines = devices[deviceIndex].logViews[viewIndex-1].GetLines(lastLineNo, count)
-		}
-		devices[deviceIndex].mutex.Unlock()
-
-		coldef = termbox.ColorDefault
-		for i := 0; i < len(lines); i++ {
-			y := h - 3 - i
-			tbprint(0, y, coldef, coldef, lines[i])
-		}
+	deviceIndex = (index%len(devices) + len(devices)) % len(devices)
+	selectedLineNo = 0
+	bottomLineNo = 0
+	scrollX = 0
+	if !devices[deviceIndex].opened {
+		devices[deviceIndex].Open()
 	}
+	completion = nil
+	moveViewTo(0)
+}
 
-	// Second from bottom line, filter.
-	// TODO: the first tab ("no filter") should have no filter line
-	y := h - 2
-	editbox.Draw(1, y, w-2)
-	termbox.SetCursor(1+editbox.cursorOffsetCells, y)
+// splitDevice is the device shown in the split pane below the current device's lines, or nil if
+// the screen isn't split.
+var splitDevice *Device
 
-	// Last line, tabs, one tab per configured filter
-	x = 0
-	y = h - 1
-	coldef = termbox.ColorDefault
-	x += tbprint(x, y, coldef, coldef, " ")
-	if viewIndex == 0 {
-		coldef = termbox.ColorDefault | termbox.AttrReverse
-	}
-	x += tbprint(x, y, coldef, coldef, "no filter")
-	coldef = termbox.ColorDefault
-	x += tbprint(x, y, coldef, coldef, "  ")
+// linkSplit is true if the split pane is scrolled to the same time as the current device's lines,
+// rather than following new lines.
+var linkSplit = true
 
-	for n, view := range devices[deviceIndex].logViews {
-		if viewIndex-1 == n {
-			coldef = termbox.ColorDefault | termbox.AttrReverse
-		}
-		x += tbprint(x, y, coldef, coldef, view.Name)
-		coldef = termbox.ColorDefault
-		x += tbprint(x, y, coldef, coldef, "  ")
+// toggleSplit splits the screen to show the next device's lines below the current device's, or
+// goes back to just the current device.
+func toggleSplit() {
+	if splitDevice != nil {
+		splitDevice = nil
+		return
 	}
-
-	x += tbprint(x, y, coldef, coldef, "+filter")
-	for ; x < w; x++ {
-		termbox.SetCell(x, y, ' ', coldef, coldef)
+	if len(devices) < 2 {
+		statusMessage = "There's no other device to split the screen with"
+		return
+	}
+	splitDevice = devices[(deviceIndex+1)%len(devices)]
+	if !splitDevice.opened {
+		splitDevice.Open()
 	}
-
-	termbox.Flush()
 }
 
-// moveViewRight moves the selected view one to the right. If there's no more views, we'll create
-// a new one with an empty filter.
-func createNewView() {
-	device := devices[deviceIndex]
-	device.mutex.Lock()
-	device.logViews = append(device.logViews, &LogView{
-		Name: "<empty>",
-		lb:   device.logBuffer,
-	})
-	viewIndex = len(device.logViews)
-	device.logViews[viewIndex-1].UpdateFilter(device.logBuffer, "")
-	device.mutex.Unlock()
-	editbox.MoveCursorToBeginningOfTheLine()
-	editbox.DeleteTheRestOfTheLine()
-	render()
+// toggleLinkSplit links the split pane's scrolling to the current device's, or unlinks it.
+func toggleLinkSplit() {
+	linkSplit = !linkSplit
+	if linkSplit {
+		statusMessage = "The split pane is scrolled to the same time as the lines above"
+	} else {
+		statusMessage = "The split pane follows new lines"
+	}
 }
 
-func moveViewTo(index int) {
-	device := devices[deviceIndex]
-	if index < 0 {
-		index = 0
+// swapSplit swaps the device in the split pane with the current device, so that it's the one you
+// scroll and filter. If the panes are linked, the new current device is scrolled to the time the
+// old one was.
+func swapSplit() {
+	top := currentDevice()
+	if splitDevice == nil || top == nil {
+		statusMessage = "The screen isn't split"
+		return
 	}
-	if index >= len(device.logViews) {
-		index = len(device.logViews)
+	var bottom int64
+	if linkSplit && bottomLineNo != 0 {
+		top.mutex.Lock()
+		lb, lineNos, _, _ := visibleLineNos(top, currentLayout().LogRows)
+		timestamp := ""
+		if len(lineNos) > 0 {
+			timestamp = TimestampAt(lb, lineNos[0])
+		}
+		top.mutex.Unlock()
+		if timestamp != "" {
+			splitDevice.mutex.Lock()
+			if bottom = LineAtTime(splitDevice.logBuffer, timestamp); bottom >= splitDevice.logBuffer.GetLastLineNo() {
+				bottom = 0
+			}
+			splitDevice.mutex.Unlock()
+		}
 	}
-	viewIndex = index
-	if index == 0 {
-		editbox.SetText("")
-	} else {
-		editbox.SetText(device.logViews[viewIndex-1].filterText)
+	for i, d := range devices {
+		if d == splitDevice {
+			moveDeviceTo(i)
+			break
+		}
 	}
-	render()
+	splitDevice = top
+	bottomLineNo = bottom
 }
 
-func updateCurrentView() {
-	device := devices[deviceIndex]
-	if viewIndex > 0 {
-		device.mutex.Lock()
-		device.logViews[viewIndex-1].UpdateFilter(device.logBuffer, string(editbox.text))
-		device.mutex.Unlock()
+// TimestampAt returns the timestamp of the given line, or of the closest line before it that has
+// one, or "" if none of them do. You should only call this method when you've got the device's
+// mutex locked.
+func TimestampAt(lb *LogBuffer, lineNo int64) string {
+	for ; lb.HasLine(lineNo); lineNo-- {
+		if e := lb.GetEntry(lineNo); e.Parsed {
+			return e.Timestamp
+		}
 	}
+	return ""
 }
 
-// refreshDevices refreshes the list of attached devices (by running 'adb devices' basically).
-func refreshDevices() {
-	cmd := exec.Command("adb", "devices", "-l")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		panic("'adb devices' error: " + err.Error())
+// LineAtTime returns the line number of the last line in the buffer that was logged at or before
+// the given timestamp (lines without a timestamp count as being logged with the line before them),
+// or 0 if they were all logged after it. It's called on every render, so rather than look at every
+// line we binary search, since logcat gives us the lines in the order they were logged. You should
+// only call this method when you've got the device's mutex locked.
+func LineAtTime(lb *LogBuffer, timestamp string) int64 {
+	first := lb.GetFirstLineNo()
+	n := int(lb.GetLastLineNo() - first + 1)
+	if n <= 0 {
+		return 0
+	}
+	// The first line that was logged after the timestamp.
+	i := sort.Search(n, func(i int) bool {
+		return TimestampAt(lb, first+int64(i)) > timestamp
+	})
+	found := first + int64(i) - 1
+	if TimestampAt(lb, found) == "" {
+		return 0
 	}
+	return found
+}
 
-	scanner := bufio.NewScanner(stdout)
-	err = cmd.Start()
-	if err != nil {
-		panic("'adb devices' error: " + err.Error())
+// drawSplitPane draws the split device's lines in the split pane. If timestamp isn't "", the
+// bottom line is the last one logged at or before it, otherwise we show the newest lines.
+func drawSplitPane(l Layout, timestamp string) {
+	d := splitDevice
+	label := d.Name
+	if linkSplit {
+		label += " (linked by time)"
 	}
+	drawSeparator(l.SplitTop-1, l.Width, label)
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Fields(line)
-		if len(parts) < 2 || parts[1] != "device" {
-			fmt.Fprintf(os.Stderr, "Not a device line: '%s'\n", line)
-			continue
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	y := l.SplitTop + l.SplitRows - 1
+	var bottom int64
+	if timestamp != "" {
+		if bottom = LineAtTime(d.logBuffer, timestamp); bottom == 0 {
+			tbprint(0, y, termbox.ColorDefault|termbox.AttrBold, termbox.ColorDefault,
+				"Nothing logged at or before "+timestamp)
+			return
 		}
-
-		id := parts[0]
-		name := id
-		for i := 2; i < len(parts); i++ {
-			kvp := strings.Split(parts[i], ":")
-			if len(kvp) == 2 && kvp[0] == "model" {
-				name = kvp[1]
-			}
+	}
+	lb, lineNos := d.GetViewLineNos(0, bottom, l.SplitRows)
+	for _, lineNo := range lineNos {
+		e := lb.GetEntry(lineNo)
+		line := e.Line
+		fg := termbox.ColorDefault
+		if levelColors {
+			fg = LevelColor(e.Level)
 		}
-
-		d := NewDevice(id, strings.Replace(name, "_", " ", -1))
-		d.Open()
-		devices = append(devices, d)
-
-		deviceIndex = 0
-		viewIndex = 0
+		if columnar {
+			line = FormatColumns(e, false)
+		}
+		drawScrolledLine(y, line, fg, termbox.ColorDefault, KeywordHighlights(line))
+		if lw := DisplayWidth(line); lw > widestLogLine {
+			widestLogLine = lw
+		}
+		y--
 	}
-	if err := scanner.Err(); err != nil {
-		panic("An error occurred reading output: " + err.Error())
+}
+
+// currentDevice returns the device we're currently displaying, or nil if there's no devices.
+func currentDevice() *Device {
+	if deviceIndex >= len(devices) {
+		return nil
 	}
+	return devices[deviceIndex]
 }
 
 func main() {
-	err := termbox.Init()
-	if err != nil {
+	flag.DurationVar(&pollInterval, "poll", DefaultPollInterval,
+		"how often to check 'adb devices' for newly attached devices, if 'adb track-devices' isn't working")
+	flag.DurationVar(&forgetAfter, "forget-after", DefaultForgetAfter,
+		"how long a device has to be unplugged before it's removed (0 to keep it forever)")
+	flag.DurationVar(&reconnectBackoff, "backoff", DefaultReconnectBackoff,
+		"how long to wait before reconnecting to a device, doubled after each failed attempt")
+	flag.DurationVar(&maxReconnectBackoff, "max-backoff", DefaultMaxReconnectBackoff,
+		"the longest to wait between attempts to reconnect to a device")
+	flag.StringVar(&exportFormat, "export-format", "raw",
+		"the format to export lines in with Ctrl+S: raw, csv or json")
+	flag.BoolVar(&liveFilter, "live", true,
+		"update the filter as you type, otherwise only when the commit-filter key (Enter) is pressed")
+	flag.IntVar(&maxDevices, "max-devices", DefaultMaxDevices,
+		"the most devices to show and stream logs from up front, others are streamed once selected")
+	keywordsFlag := flag.String("keywords", "",
+		"comma-separated words to color wherever they appear, e.g. FAIL=red,OK=green,timeout=yellow")
+	pinFlag := flag.String("pin", "",
+		"comma-separated tags whose most recent line is always shown at the top, e.g. Heartbeat,State")
+	flag.IntVar(&pinnedRows, "pin-rows", 0,
+		"how many rows to show pinned lines in (default one per pinned tag)")
+	flag.BoolVar(&syncSelection, "sync-selection", true,
+		"keep the same line selected when switching between views, if it's in both")
+	flag.BoolVar(&compactTabs, "compact-tabs", false,
+		"separate the tabs by one space rather than two, to fit more in (toggle with Alt+w)")
+	flag.BoolVar(&showStatusRow, "status-row", false,
+		"show the match count, status messages and filter errors in a row of their own")
+	flag.BoolVar(&levelColors, "level-colors", true,
+		"draw warnings in yellow, errors in red and debug and verbose lines dimmed")
+	flag.BoolVar(&processNames, "process-names", false,
+		"show the name of the process that logged each line in place of its PID (toggle with Alt+A)")
+	flag.BoolVar(&wrapLines, "wrap", false,
+		"wrap lines that are too long for the screen rather than cutting them off")
+	matchColorFlag := flag.String("match-color", "cyan",
+		"the color to draw the part of each line that the current filter matched in (use \"default\" to turn it off)")
+	continuationColorFlag := flag.String("continuation-color", "gray",
+		"the color to draw the lines of a multi-line message after the first in, e.g. stack frames")
+	freezeFlag := flag.String("freeze-on", "",
+		"a regex: once a line matches it, stop taking new lines (after -freeze-after more) until resumed")
+	flag.IntVar(&freezeAfter, "freeze-after", 0,
+		"how many lines after the -freeze-on line to keep before freezing (default half of -lines)")
+	flag.IntVar(&bufferLines, "lines", BufferLineCount,
+		"how many of each device's most recent lines to keep in memory")
+	flag.IntVar(&bufferLines, "buffer-lines", BufferLineCount, "the same as -lines")
+	logcatBufferFlag := flag.String("buffer", "",
+		"which logcat buffers to read, e.g. main, system, crash or all, or several separated by commas")
+	flag.StringVar(&matchEngine, "match", "regex",
+		"how new filters match lines: regex, fixed (a plain string) or glob (* and ?)")
+	flag.StringVar(&markerMode, "markers", "styled",
+		"how to show logcat's \"beginning of main\" markers: styled (as a separator), hide or raw")
+	memoryBudgetMB := flag.Int("memory-budget", 0,
+		"megabytes of compressed history to keep per device, beyond the last -lines lines "+
+			"(default none)")
+	glyphsFlag := flag.String("glyphs", "unicode",
+		"the characters that show something's been cut short: unicode or ascii, and/or name=glyph "+
+			"overrides, e.g. ascii,line-cut=>")
+	flag.IntVar(&rateWarning, "rate-warning", DefaultRateWarning,
+		"how many lines a second a device has to log before we warn that the display may lag")
+	flag.IntVar(&maxFPS, "max-fps", DefaultMaxFPS,
+		"the most times a second to redraw the screen, or 0 for no limit")
+	flag.IntVar(&halfPage, "half-page", 0,
+		"how many lines half-page-up and half-page-down scroll by (default half the screen)")
+	flag.BoolVar(&lowLatency, "low-latency", false,
+		"redraw for every line as soon as it arrives, rather than waiting for logcat's history to "+
+			"finish first; use it to catch the very next event, at the cost of a lot more redrawing")
+	flag.BoolVar(&showStats, "stats", false,
+		"print how many events were handled and how many times we rendered, on exit")
+	flag.StringVar(&adbPath, "adb", "adb",
+		"the adb binary to run, if it's not on the PATH as 'adb'")
+	flag.BoolVar(&safeMode, "safe", false,
+		"don't run any external commands except for 'adb logcat' and 'adb devices'")
+	flag.StringVar(&presetsPath, "presets", defaultPresetsPath(),
+		"the JSON file that filters saved with save-preset are kept in")
+	flag.Var((*listFlag)(&startupFilters), "filter",
+		"open a view with this filter on every device, e.g. -filter tag:ActivityManager (can be repeated)")
+	var bindings listFlag
+	flag.Var(&bindings, "bind",
+		"bind a key to an action, e.g. -bind next-view=Tab -bind new-view=Ctrl+T (can be repeated)")
+	configPath := flag.String("config", defaultConfigPath(),
+		"a file of name=value options, one per line, used for any flag that isn't given on the "+
+			"command line or in a LOLCAT_<NAME> environment variable")
+	flag.Parse()
+	if err := loadOptions(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if _, ok := exportFormats[exportFormat]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown export format: %s\n", exportFormat)
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	if keywords, err = ParseKeywords(*keywordsFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	for _, tag := range strings.Split(*pinFlag, ",") {
+		if tag != "" {
+			pinnedTags = append(pinnedTags, tag)
+		}
+	}
+	if glyphs, err = ParseGlyphs(*glyphsFlag); err != nil {
+		fmt.Fprintln(os.Stderr, "-glyphs:", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *memoryBudgetMB < 0 {
+		fmt.Fprintln(os.Stderr, "-memory-budget can't be negative")
+		flag.Usage()
+		os.Exit(2)
+	}
+	memoryBudget = *memoryBudgetMB << 20
+	if pinnedRows < 0 {
+		fmt.Fprintln(os.Stderr, "-pin-rows can't be negative")
+		flag.Usage()
+		os.Exit(2)
+	}
+	// With no delay, pollDevices and Open's loop would just run adb over and over as fast as they
+	// can whenever it fails.
+	if pollInterval <= 0 {
+		fmt.Fprintln(os.Stderr, "-poll must be more than 0")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if reconnectBackoff <= 0 {
+		fmt.Fprintln(os.Stderr, "-backoff must be more than 0")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if maxReconnectBackoff <= 0 {
+		fmt.Fprintln(os.Stderr, "-max-backoff must be more than 0")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if maxReconnectBackoff < reconnectBackoff {
+		fmt.Fprintln(os.Stderr, "-max-backoff must be at least -backoff")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if _, err := CompileMatcher(matchEngine, ""); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if markerMode != "styled" && markerMode != "hide" && markerMode != "raw" {
+		fmt.Fprintf(os.Stderr, "Unknown -markers: %s\n", markerMode)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *freezeFlag != "" {
+		if freezeTrigger, err = regexp.Compile(*freezeFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "-freeze-on:", err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+	if bufferLines < 1 {
+		fmt.Fprintln(os.Stderr, "-lines must be at least 1")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !IsSet(flag.CommandLine, "freeze-after") {
+		freezeAfter = bufferLines / 2
+	}
+	if freezeAfter < 0 || freezeAfter >= bufferLines {
+		fmt.Fprintf(os.Stderr, "-freeze-after must be between 0 and %d\n", bufferLines-1)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if logcatBuffer, err = ParseLogcatBuffer(*logcatBufferFlag); err != nil {
+		fmt.Fprintln(os.Stderr, "-buffer:", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	var ok bool
+	if continuationColor, ok = colorNames[strings.ToLower(*continuationColorFlag)]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown color: %s\n", *continuationColorFlag)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if matchColor, ok = colorNames[strings.ToLower(*matchColorFlag)]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown color: %s\n", *matchColorFlag)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if maxDevices < 1 {
+		fmt.Fprintln(os.Stderr, "-max-devices must be at least 1")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := BindKeys(defaultBindings); err != nil {
 		panic(err)
 	}
+	if err := BindKeys(bindings); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if showStats {
+		// This is deferred before termbox.Close, so that it runs after it.
+		defer func() {
+			fmt.Fprintf(os.Stderr, "%d events, %d renders\n", eventCount, renderCount)
+		}()
+	}
+
+	err = termbox.Init()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't start the terminal:", err)
+		os.Exit(1)
+	}
 	defer termbox.Close()
+	defer stopAutoExports()
 	termbox.SetInputMode(termbox.InputAlt)
 
 	refreshDevices()
 	render()
 
+	go pollDevices(deviceUpdates)
+
+	// How often we check whether any "file:" patterns need to be reloaded, update each device's
+	// line rate, and forget devices that have been missing for too long.
+	patternTicker := time.NewTicker(time.Second)
+	defer patternTicker.Stop()
+	pidUpdates := make(chan pidUpdate)
+	processUpdates := make(chan processUpdate)
+
 	events := make(chan termbox.Event)
 	go func() {
 		for {
-			events <- termbox.PollEvent()
+			events <- screen.PollEvent()
 		}
 	}()
 
+	// dirty is set whenever something happens that means we need to render again. We only render
+	// once we've handled everything that's waiting, so a burst of key presses and new lines only
+	// costs us one render. If we rendered too recently (see -max-fps), nextFrame fires when we can
+	// render again, and everything that comes in until then is drawn in the same frame.
+	dirty := false
+	limiter := FrameLimiter{}
+	if maxFPS > 0 {
+		limiter.Interval = time.Second / time.Duration(maxFPS)
+	}
+	var nextFrame <-chan time.Time
+	// backTabTimeout fires when we've waited long enough after an Alt+[ without a Z following it.
+	var backTabTimeout <-chan time.Time
 mainloop:
 	for {
+		// There's nothing to wait for until the first device is attached.
+		var ping, splitPing chan struct{}
+		if device := currentDevice(); device != nil {
+			ping = device.ping
+		}
+		if splitDevice != nil && splitDevice != currentDevice() {
+			splitPing = splitDevice.ping
+		}
+
 		select {
 		case ev := <-events:
-			switch ev.Key {
-			case termbox.KeyCtrlC:
+			if handleEvent(ev) {
 				break mainloop
-			case termbox.KeyTab:
-				// TODO: tab is a shortcut for new filter, always
-				createNewView()
-			case termbox.KeyArrowLeft, termbox.KeyCtrlB:
-				editbox.MoveCursorOneRuneBackward()
-			case termbox.KeyArrowRight, termbox.KeyCtrlF:
-				editbox.MoveCursorOneRuneForward()
-			case termbox.KeyBackspace, termbox.KeyBackspace2:
-				editbox.DeleteRuneBackward()
-			case termbox.KeyDelete, termbox.KeyCtrlD:
-				editbox.DeleteRuneForward()
-			case termbox.KeySpace:
-				editbox.InsertRune(' ')
-			case termbox.KeyCtrlK:
-				editbox.DeleteTheRestOfTheLine()
-			case termbox.KeyHome, termbox.KeyCtrlA:
-				editbox.MoveCursorToBeginningOfTheLine()
-			case termbox.KeyEnd, termbox.KeyCtrlE:
-				editbox.MoveCursorToEndOfTheLine()
-			default:
-				if ev.Ch >= '1' && ev.Ch <= '9' {
-					if ev.Mod == termbox.ModAlt {
-						moveViewTo(int(ev.Ch - '1'))
-						ev.Ch = 0
-					}
+			}
+			dirty = true
+		case update := <-deviceUpdates:
+			applyDeviceUpdate(update, time.Now())
+			dirty = true
+		case <-ping:
+			eventCount++
+			dirty = true
+		case <-splitPing:
+			eventCount++
+			dirty = true
+		case now := <-patternTicker.C:
+			if reloadPatternFiles() {
+				dirty = true
+			}
+			// 'adb track-devices' only tells us when the list changes, so a device that's gone
+			// missing has to be forgotten on a timer rather than when the next list comes in.
+			if forgetDevices(now) {
+				dirty = true
+			}
+			for _, d := range devices {
+				if d.opened && (d.UpdateRate(now) || d.HasRateAlerts()) {
+					dirty = true
 				}
-				if ev.Ch != 0 {
-					editbox.InsertRune(ev.Ch)
+			}
+			followPackages(now, pidUpdates)
+			listProcesses(now, processUpdates)
+		case <-previewReady:
+			updatePreview()
+			dirty = true
+		case u := <-pidUpdates:
+			applyPIDUpdate(u)
+			dirty = true
+		case u := <-restrictions:
+			applyRestriction(u)
+			dirty = true
+		case u := <-processUpdates:
+			applyProcessUpdate(u)
+			dirty = true
+		case message := <-exportResults:
+			statusMessage = message
+			dirty = true
+		case <-nextFrame:
+			nextFrame = nil
+		case <-backTabTimeout:
+			backTabTimeout = nil
+			if flushBackTab() {
+				break mainloop
+			}
+			dirty = true
+		}
+
+	drain:
+		for {
+			select {
+			case ev := <-events:
+				if handleEvent(ev) {
+					break mainloop
 				}
+			case <-ping:
+				eventCount++
+			case <-splitPing:
+				eventCount++
+			default:
+				break drain
+			}
+		}
+		if !pendingBackTab {
+			backTabTimeout = nil
+		} else if backTabTimeout == nil {
+			backTabTimeout = time.After(backTabWait)
+		}
+
+		if dirty && nextFrame == nil {
+			if wait := limiter.Wait(time.Now()); wait > 0 {
+				nextFrame = time.After(wait)
+			} else {
+				render()
+				dirty = false
 			}
-			updateCurrentView()
-			render()
-		case <-devices[deviceIndex].ping:
-			render()
 		}
 	}
 }
+
+// handleEvent handles a single event from termbox. Returns true if it was the key to quit.
+func handleEvent(ev termbox.Event) bool {
+	eventCount++
+	statusMessage = ""
+	if ev.Type != termbox.EventKey {
+		return false
+	}
+	if pendingBackTab {
+		if ev.Ch == 'Z' && ev.Mod == 0 {
+			pendingBackTab = false
+			return handleKey(termbox.Event{Type: termbox.EventKey, Key: KeyBackTab})
+		}
+		if flushBackTab() {
+			return true
+		}
+	} else if ev.Ch == '[' && ev.Mod == termbox.ModAlt {
+		pendingBackTab = true
+		return false
+	}
+	return handleKey(ev)
+}
+
+// pendingBackTab is set when we've just had Alt+[. The terminal sends "ESC [ Z" for Shift+Tab,
+// which termbox gives us as Alt+[ followed by Z, so we hold on to the Alt+[ until we see what
+// comes next, or backTabWait passes without anything coming.
+var pendingBackTab bool
+
+// backTabWait is how long we wait for the Z after an Alt+[ before deciding that it was just Alt+[.
+// The terminal sends the whole of "ESC [ Z" at once, so it doesn't need to be long.
+const backTabWait = 50 * time.Millisecond
+
+// flushBackTab handles the Alt+[ we've been holding on to as a key of its own, if there is one.
+// Returns true if it was the key to quit.
+func flushBackTab() bool {
+	if !pendingBackTab {
+		return false
+	}
+	pendingBackTab = false
+	return handleKey(termbox.Event{Type: termbox.EventKey, Ch: '[', Mod: termbox.ModAlt})
+}
@@ -0,0 +1,2597 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsf/termbox-go"
+)
+
+// testScreen is a Screen that draws into memory, so that tests can check what was rendered.
+type testScreen struct {
+	w, h  int
+	cells []termbox.Cell
+	bells int
+
+	// cursorX and cursorY are where the cursor was last put.
+	cursorX, cursorY int
+}
+
+func newTestScreen(w, h int) *testScreen {
+	return &testScreen{w: w, h: h, cells: make([]termbox.Cell, w*h)}
+}
+
+func (s *testScreen) Size() (int, int) {
+	return s.w, s.h
+}
+
+func (s *testScreen) Clear(fg, bg termbox.Attribute) {
+	for i := range s.cells {
+		s.cells[i] = termbox.Cell{Ch: ' ', Fg: fg, Bg: bg}
+	}
+}
+
+func (s *testScreen) SetCell(x, y int, ch rune, fg, bg termbox.Attribute) {
+	if x < 0 || x >= s.w || y < 0 || y >= s.h {
+		return
+	}
+	s.cells[y*s.w+x] = termbox.Cell{Ch: ch, Fg: fg, Bg: bg}
+}
+
+func (s *testScreen) SetCursor(x, y int) {
+	s.cursorX, s.cursorY = x, y
+}
+
+func (s *testScreen) Flush() {
+}
+
+func (s *testScreen) Bell() {
+	s.bells++
+}
+
+func (s *testScreen) PollEvent() termbox.Event {
+	panic("tests inject events with handleEvent instead")
+}
+
+// Row returns the text on the given row, without any trailing spaces.
+func (s *testScreen) Row(y int) string {
+	var sb strings.Builder
+	for _, cell := range s.cells[y*s.w : (y+1)*s.w] {
+		sb.WriteRune(cell.Ch)
+	}
+	return strings.TrimRight(sb.String(), " ")
+}
+
+// LogRows returns the text of every row in the log area (including any pinned lines), top to
+// bottom, skipping empty rows.
+func (s *testScreen) LogRows() []string {
+	var rows []string
+	for y := 1; y <= currentLayout().LogBottom(); y++ {
+		if row := s.Row(y); row != "" {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// setUp resets all of our global state and swaps in a testScreen, with a single device that has the
+// given lines in its buffer.
+func setUp(t *testing.T, lines ...string) *testScreen {
+	ts := newTestScreen(100, 10)
+	screen = ts
+
+	devices = nil
+	deviceIndex = 0
+	viewIndex = 0
+	editbox = EditBox{}
+	completion = nil
+	statusMessage = ""
+	selectedLineNo = 0
+	bottomLineNo = 0
+	historyLost = false
+	prompt = nil
+	overlay = nil
+	liveFilter = true
+	maxDevices = DefaultMaxDevices
+	showLaunchMarker = true
+	keywords = nil
+	pinnedTags = nil
+	pinnedRows = 0
+	sortByTime = false
+	columnar = false
+	hideRepeatedTags = false
+	showStatusRow = false
+	compactTabs = false
+	syncSelection = true
+	continuationColor = termbox.ColorDarkGray
+	savedContinuationColor = termbox.ColorDefault
+	freezeTrigger = nil
+	matchEngine = "regex"
+	markerMode = "styled"
+	halfPage = 0
+	wrappedLineNo = 0
+	splitDevice = nil
+	rateWarning = DefaultRateWarning
+	memoryBudget = 0
+	previousView = nil
+	glyphs = glyphPresets["unicode"]
+	linkSplit = true
+	pendingBackTab = false
+	levelColors = true
+	forgetAfter = DefaultForgetAfter
+	matchColor = termbox.ColorCyan
+	paused = false
+	wrapLines = false
+	adbPath = "adb"
+	devicesErr = nil
+	processNames = false
+	scrollX = 0
+	widestLogLine = 0
+	searchMatcher = nil
+	searchText = ""
+	presetsPath = ""
+	startupFilters = nil
+	restricting = map[*Device]string{}
+	deviceSettings = map[string]DeviceSettings{}
+	bufferLines = BufferLineCount
+	logcatBuffer = ""
+	keymap = map[KeyBinding]Action{}
+	if err := BindKeys(defaultBindings); err != nil {
+		t.Fatal(err)
+	}
+
+	// We never Open() the device, so nothing's streamed from adb.
+	d := NewDevice("emulator-5554", "Pixel")
+	for _, line := range lines {
+		d.appendLine(line)
+	}
+	devices = []*Device{d}
+	return ts
+}
+
+// press injects a key press for each of the given keys, which are in the same format as -bind.
+func press(t *testing.T, keys ...string) {
+	for _, key := range keys {
+		kb, err := ParseKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handleEvent(termbox.Event{Type: termbox.EventKey, Key: kb.key, Ch: kb.ch, Mod: kb.mod})
+	}
+}
+
+// typeText injects a key press for each character in the given text.
+func typeText(text string) {
+	for _, r := range text {
+		ev := termbox.Event{Type: termbox.EventKey, Ch: r}
+		if r == ' ' {
+			ev = termbox.Event{Type: termbox.EventKey, Key: termbox.KeySpace}
+		}
+		handleEvent(ev)
+	}
+}
+
+var testLines = []string{
+	"01-02 10:00:00.000   100   100 I ActivityManager: Start proc com.example",
+	"01-02 10:00:01.000   200   201 D WifiService: scanning",
+	"01-02 10:00:02.000   100   100 E ActivityManager: ANR in com.example",
+	"01-02 10:00:03.000   200   201 W WifiService: scan failed",
+}
+
+func TestNoFilterShowsEverything(t *testing.T) {
+	ts := setUp(t, testLines...)
+	render()
+
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(testLines, "\n") {
+		t.Errorf("log rows = %q, want %q", got, testLines)
+	}
+	if got := ts.Row(0); !strings.Contains(got, "Pixel") {
+		t.Errorf("device bar = %q, want it to contain the device name", got)
+	}
+}
+
+func TestNewViewFiltersAsYouType(t *testing.T) {
+	ts := setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("Wifi.*scan")
+	render()
+
+	want := []string{testLines[1], testLines[3]}
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("log rows = %q, want %q", got, want)
+	}
+	got := ts.Row(8)
+	if !strings.HasPrefix(got, " Wifi.*scan ") || !strings.HasSuffix(got, " 2 matches") {
+		t.Errorf("editbox row = %q, want the filter and 2 matches", got)
+	}
+	if got = ts.Row(9); !strings.Contains(got, "Wifi.*scan") {
+		t.Errorf("tab bar = %q, want it to contain the filter", got)
+	}
+}
+
+func TestColumnFilter(t *testing.T) {
+	ts := setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("tag:ActivityManager level:E")
+	render()
+
+	want := []string{testLines[2]}
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("log rows = %q, want %q", got, want)
+	}
+}
+
+func TestPIDAndTIDFilters(t *testing.T) {
+	digits := "01-02 10:00:04.000   300   300 I Test: waiting for pid 200 and thread 201"
+	ts := setUp(t, append(testLines, digits)...)
+	press(t, "Ctrl+T")
+	typeText("pid:200")
+	render()
+
+	want := []string{testLines[1], testLines[3]}
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("pid:200 log rows = %q, want %q", got, want)
+	}
+
+	press(t, "Ctrl+K")
+	for range "pid:200" {
+		press(t, "Backspace")
+	}
+	typeText("tid:~^30")
+	render()
+	want = []string{digits}
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("tid:~^30 log rows = %q, want %q", got, want)
+	}
+	if got := devices[0].DistinctValues("tid"); strings.Join(got, ",") != "100,201,300" {
+		t.Errorf("distinct tids = %q, want them in numerical order", got)
+	}
+}
+
+func TestColumnRegexFilter(t *testing.T) {
+	ts := setUp(t, append(testLines, "not a logcat line, scan failed")...)
+	press(t, "Ctrl+T")
+	typeText("tag:~^Wifi msg:~fail.*")
+	render()
+
+	want := []string{testLines[3]}
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("log rows = %q, want %q", got, want)
+	}
+
+	if _, err := ParseFilter("msg:~(unclosed"); err == nil {
+		t.Error("expected an error for an invalid column regex")
+	}
+	for _, filter := range []string{"pid:abc", "tid:abc"} {
+		if _, err := ParseFilter(filter); err == nil {
+			t.Errorf("ParseFilter(%q): expected an error for a column that has to be a number", filter)
+		}
+	}
+	if pf, err := ParseFilter("tag:~"); err != nil || len(pf.Columns) != 0 {
+		t.Errorf("ParseFilter(\"tag:~\") = %v, %v, want it ignored while it's being typed", pf.Columns, err)
+	}
+}
+
+func TestPreviewCountWhenNotLive(t *testing.T) {
+	ts := setUp(t, testLines...)
+	liveFilter = false
+	press(t, "Ctrl+T")
+	typeText("tag:WifiService")
+	updatePreview()
+	render()
+
+	if got := ts.Row(8); !strings.HasSuffix(got, " 2 lines would match") {
+		t.Errorf("editbox row = %q, want a preview of 2 matches", got)
+	}
+	devices[0].appendLine("01-02 10:00:04.000   200   201 I WifiService: connected")
+	render()
+	if got := ts.Row(8); !strings.HasSuffix(got, " 3 lines would match") {
+		t.Errorf("editbox row = %q, want the preview to count the new line", got)
+	}
+	if got := len(devices[0].logViews[0].index); got != 5 {
+		t.Errorf("got %d lines in the view before committing, want all 5", got)
+	}
+
+	press(t, "Enter")
+	render()
+	if got := ts.Row(8); !strings.HasSuffix(got, " 3 matches") {
+		t.Errorf("editbox row = %q, want 3 matches after committing", got)
+	}
+}
+
+func TestMoveBetweenViews(t *testing.T) {
+	setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("first")
+	press(t, "Ctrl+T")
+	typeText("second")
+
+	steps := []struct {
+		key       string
+		wantView  int
+		wantInBox string
+	}{
+		{"Ctrl+P", 1, "first"},
+		{"Ctrl+P", 0, ""},
+		{"Ctrl+P", 2, "second"},
+		{"Ctrl+N", 0, ""},
+		{"Alt+2", 1, "first"},
+		{"Shift+Tab", 0, ""},
+		{"Shift+Tab", 2, "second"},
+	}
+	for _, step := range steps {
+		press(t, step.key)
+		if viewIndex != step.wantView || string(editbox.text) != step.wantInBox {
+			t.Errorf("after %s: view %d with %q, want view %d with %q",
+				step.key, viewIndex, editbox.text, step.wantView, step.wantInBox)
+		}
+	}
+
+	// This is how Shift+Tab actually comes through from termbox.
+	handleEvent(termbox.Event{Type: termbox.EventKey, Ch: '[', Mod: termbox.ModAlt})
+	handleEvent(termbox.Event{Type: termbox.EventKey, Ch: 'Z'})
+	if viewIndex != 1 || string(editbox.text) != "first" {
+		t.Errorf("after ESC [ Z: view %d with %q, want view 1 with %q", viewIndex, editbox.text, "first")
+	}
+
+	// An Alt+[ with no Z after it is a key of its own, once we've stopped waiting for the Z.
+	if err := BindKeys([]string{"toggle-compact-tabs=Alt+["}); err != nil {
+		t.Fatal(err)
+	}
+	handleEvent(termbox.Event{Type: termbox.EventKey, Ch: '[', Mod: termbox.ModAlt})
+	if compactTabs {
+		t.Error("Alt+[ was handled before we knew whether a Z followed it")
+	}
+	flushBackTab()
+	if !compactTabs {
+		t.Error("a lone Alt+[ was swallowed")
+	}
+}
+
+func TestEditingKeys(t *testing.T) {
+	setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("abc")
+	press(t, "Left", "Backspace", "Ctrl+A", "Delete")
+
+	if got := string(editbox.text); got != "c" {
+		t.Errorf("editbox = %q, want %q", got, "c")
+	}
+	if got := devices[0].logViews[0].filterText; got != "c" {
+		t.Errorf("filter = %q, want %q", got, "c")
+	}
+}
+
+func TestWordKeys(t *testing.T) {
+	setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("tag:Wifi  日本語 scan")
+
+	steps := []struct {
+		key        string
+		wantCursor int
+	}{
+		{"Alt+Left", len("tag:Wifi  日本語 ")},
+		{"Alt+Left", len("tag:Wifi  ")},
+		{"Alt+Left", 0},
+		{"Alt+Left", 0},
+		{"Alt+Right", len("tag:Wifi  ")},
+		{"Alt+Right", len("tag:Wifi  日本語 ")},
+		{"Alt+Right", len("tag:Wifi  日本語 scan")},
+	}
+	for _, step := range steps {
+		press(t, step.key)
+		if editbox.cursorOffsetBytes != step.wantCursor {
+			t.Errorf("after %s: cursor at byte %d, want %d", step.key, editbox.cursorOffsetBytes, step.wantCursor)
+		}
+	}
+
+	press(t, "Alt+Left", "Left", "Ctrl+W")
+	if got := string(editbox.text); got != "tag:Wifi   scan" {
+		t.Errorf("editbox = %q after deleting a word, want %q", got, "tag:Wifi   scan")
+	}
+	if got := devices[0].logViews[0].filterText; got != "tag:Wifi   scan" {
+		t.Errorf("filter = %q, want it updated after deleting a word", got)
+	}
+}
+
+func TestMoveCursorTo(t *testing.T) {
+	ts := setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("ab日本c語")
+
+	// The wide runes take two cells each.
+	steps := []struct {
+		key       string
+		wantBytes int
+		wantRunes int
+		wantCells int
+	}{
+		{"End", 12, 6, 9},
+		{"Left", 9, 5, 7},
+		{"Left", 8, 4, 6},
+		{"Left", 5, 3, 4},
+		{"Home", 0, 0, 0},
+		{"Right", 1, 1, 1},
+		{"Right", 2, 2, 2},
+		{"Right", 5, 3, 4},
+	}
+	for _, step := range steps {
+		press(t, step.key)
+		eb := editbox
+		if eb.cursorOffsetBytes != step.wantBytes || eb.cursorOffsetRunes != step.wantRunes ||
+			eb.cursorOffsetCells != step.wantCells {
+			t.Errorf("after %s: cursor at byte %d, rune %d, cell %d, want %d, %d, %d", step.key,
+				eb.cursorOffsetBytes, eb.cursorOffsetRunes, eb.cursorOffsetCells,
+				step.wantBytes, step.wantRunes, step.wantCells)
+		}
+	}
+
+	// Once the text is too long to fit, the cursor's drawn where the text has scrolled to.
+	typeText(strings.Repeat("日", 100))
+	render()
+	x := ts.cursorX
+	if got := ts.cells[ts.cursorY*ts.w+x-2].Ch; got != '日' || x-editbox.CursorX() != 1 {
+		t.Errorf("cursor drawn at %d after %q, want it just after the last rune typed", x, got)
+	}
+}
+
+func TestTabCompletesTags(t *testing.T) {
+	setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("tag:Act")
+	press(t, "Tab")
+
+	if got := string(editbox.text); got != "tag:ActivityManager" {
+		t.Errorf("editbox = %q, want %q", got, "tag:ActivityManager")
+	}
+	if got := len(devices[0].logViews[0].index); got != 2 {
+		t.Errorf("got %d matches, want 2", got)
+	}
+}
+
+func TestSearchAllDevices(t *testing.T) {
+	ts := setUp(t, testLines...)
+	d := NewDevice("emulator-5556", "Tablet")
+	d.appendLine("01-02 10:00:04.000   300   300 E Tablet: ANR in com.other")
+	d.opened = true // so switching to it doesn't start adb
+	devices = append(devices, d)
+
+	press(t, "Ctrl+T")
+	typeText("Wifi")
+	press(t, "Alt+f")
+	typeText("ANR")
+	press(t, "Enter")
+	render()
+
+	if got := ts.Row(1); !strings.Contains(got, "Pixel 1, Tablet 1") {
+		t.Errorf("overlay title = %q, want the count for each device", got)
+	}
+	if got := string(editbox.text); got != "Wifi" {
+		t.Errorf("editbox = %q after the prompt, want the filter back", got)
+	}
+
+	press(t, "Down", "Enter")
+	if overlay != nil || deviceIndex != 1 || viewIndex != 0 || selectedLineNo != 1 {
+		t.Errorf("got device %d, view %d, line %d, want the Tablet's line 1 selected",
+			deviceIndex, viewIndex, selectedLineNo)
+	}
+}
+
+func TestPinnedTags(t *testing.T) {
+	ts := setUp(t)
+	pinnedTags = []string{"WifiService", "Heartbeat"}
+	for _, line := range testLines {
+		devices[0].appendLine(line)
+	}
+	render()
+
+	if got := ts.Row(1); got != testLines[3] {
+		t.Errorf("first pinned row = %q, want the latest WifiService line", got)
+	}
+	if got := ts.Row(2); got != "Heartbeat: nothing logged yet" {
+		t.Errorf("second pinned row = %q, want a placeholder", got)
+	}
+	if got := ts.Row(3); !strings.Contains(got, "pinned") {
+		t.Errorf("row 3 = %q, want the separator", got)
+	}
+	if got := ts.LogRows()[3:]; strings.Join(got, "\n") != strings.Join(testLines, "\n") {
+		t.Errorf("log rows = %q, want every line below the pinned ones", got)
+	}
+}
+
+func TestSortByTimestamp(t *testing.T) {
+	ts := setUp(t,
+		testLines[1],
+		testLines[0],
+		"--------- beginning of crash",
+		testLines[3],
+		testLines[2],
+	)
+	press(t, "Alt+t")
+	render()
+
+	// The marker is drawn as a separator.
+	marker := "──── beginning of crash " + strings.Repeat("─", 100-24)
+	want := []string{testLines[0], marker, testLines[1], testLines[2], testLines[3]}
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("log rows = %q, want %q", got, want)
+	}
+}
+
+func TestClearLocal(t *testing.T) {
+	ts := setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("Wifi")
+	press(t, "Alt+l")
+	devices[0].appendLine(testLines[3])
+	render()
+
+	want := []string{testLines[3]}
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("log rows = %q, want only the line after clearing", got)
+	}
+	press(t, "Ctrl+P")
+	render()
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("log rows = %q in the no filter view, want only the line after clearing", got)
+	}
+
+	last := devices[0].logBuffer.GetLastLineNo()
+	press(t, "Ctrl+L")
+	render()
+	if got := ts.LogRows(); len(got) != 0 {
+		t.Errorf("log rows = %q after Ctrl+L, want none", got)
+	}
+	if devices[0].logBuffer.HasLine(last) || devices[0].logBuffer.GetLastLineNo() != last {
+		t.Errorf("line %d is still there (or was renumbered) after clearing", last)
+	}
+}
+
+func TestPIDFallsBackToHostFiltering(t *testing.T) {
+	ts := setUp(t)
+	devices[0].SetPID("com.example", 100)
+	devices[0].pidUnsupported = true
+	for _, line := range testLines {
+		devices[0].appendLine(line)
+	}
+	render()
+
+	want := []string{testLines[0], testLines[2]}
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("log rows = %q, want only pid 100's lines", got)
+	}
+	if got := ts.Row(0); !strings.Contains(got, "Pixel (com.example)") {
+		t.Errorf("device bar = %q, want it to show the package", got)
+	}
+}
+
+func TestGoToLine(t *testing.T) {
+	setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("Wifi")
+
+	press(t, "Alt+g")
+	typeText("3")
+	press(t, "Enter")
+	if selectedLineNo != 2 {
+		t.Errorf("selected line %d, want the nearest match, 2", selectedLineNo)
+	}
+
+	press(t, "Alt+g")
+	typeText("9")
+	press(t, "Enter")
+	if statusMessage != "There's no line 9 yet" || selectedLineNo != 2 {
+		t.Errorf("got %q with line %d selected, want an error and no change", statusMessage, selectedLineNo)
+	}
+}
+
+func TestPageScrolling(t *testing.T) {
+	var lines []string
+	for i := 1; i <= 30; i++ {
+		lines = append(lines, fmt.Sprintf("01-02 10:00:%02d.000   100   100 I Test: line %d", i, i))
+	}
+	ts := setUp(t, lines...)
+	rows := int64(currentLayout().LogRows)
+	last := currentDevice().ViewBuffer(0).GetLastLineNo()
+
+	press(t, "PgUp")
+	if bottomLineNo != last-rows {
+		t.Errorf("after PgUp, bottom line %d, want %d", bottomLineNo, last-rows)
+	}
+	render()
+	if got, want := ts.Row(9), fmt.Sprintf("⇡ scrolled, %d newer", rows); !strings.Contains(got, want) {
+		t.Errorf("tab bar = %q, want it to contain %q", got, want)
+	}
+	halfPage = 2
+	press(t, "Alt+Down")
+	if bottomLineNo != last-rows+2 {
+		t.Errorf("after half a page down, bottom line %d, want %d", bottomLineNo, last-rows+2)
+	}
+	press(t, "PgUp", "PgUp", "PgUp", "PgUp", "PgUp")
+	if first := currentDevice().ViewBuffer(0).GetFirstLineNo(); bottomLineNo != first+rows-1 {
+		t.Errorf("scrolled past the oldest line, bottom line %d, want %d", bottomLineNo, first+rows-1)
+	}
+	press(t, "PgDn", "PgDn", "PgDn", "PgDn", "PgDn")
+	if bottomLineNo != 0 {
+		t.Errorf("bottom line %d, want 0 (following new lines) after scrolling to the end", bottomLineNo)
+	}
+	render()
+	if got := ts.Row(9); strings.Contains(got, "scrolled") {
+		t.Errorf("tab bar = %q, want no scrolled indicator at the bottom", got)
+	}
+
+	press(t, "Alt+Home")
+	if first := currentDevice().ViewBuffer(0).GetFirstLineNo(); bottomLineNo != first+rows-1 {
+		t.Errorf("after Alt+Home, bottom line %d, want %d", bottomLineNo, first+rows-1)
+	}
+	press(t, "Alt+Space", "Alt+End")
+	if bottomLineNo != 0 || paused {
+		t.Errorf("after Alt+End, bottom line %d and paused=%t, want to be following new lines", bottomLineNo, paused)
+	}
+}
+
+func TestPause(t *testing.T) {
+	ts := setUp(t, testLines...)
+	d := devices[0]
+	press(t, "Alt+Space")
+	// Only rendering pins the screen where it is, not just looking at what's on it.
+	press(t, "Up")
+	if bottomLineNo != 0 {
+		t.Errorf("moving the selection set the bottom line to %d, want it left to render", bottomLineNo)
+	}
+	render()
+	for _, line := range testLines {
+		d.appendLine(line)
+	}
+	render()
+
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(testLines, "\n") {
+		t.Errorf("log rows = %q while paused, want the lines from when we paused", got)
+	}
+	if got := ts.Row(9); !strings.Contains(got, "⏸ PAUSED, 4 newer") {
+		t.Errorf("tab bar = %q, want it to say we're paused", got)
+	}
+	if d.logBuffer.GetLastLineNo() != 8 {
+		t.Errorf("got %d lines, want the new ones still buffered", d.logBuffer.GetLastLineNo())
+	}
+
+	press(t, "Alt+Space")
+	render()
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(append(testLines[1:], testLines...), "\n") {
+		t.Errorf("log rows = %q after unpausing, want the newest lines", got)
+	}
+	if got := ts.Row(9); strings.Contains(got, "PAUSED") {
+		t.Errorf("tab bar = %q, want it to stop saying we're paused", got)
+	}
+}
+
+func TestCountAndPosition(t *testing.T) {
+	var lines []string
+	for i := 1; i <= 30; i++ {
+		lines = append(lines, fmt.Sprintf("01-02 10:00:%02d.000   100   100 I Test: line %d", i, i))
+	}
+	ts := setUp(t, lines...)
+	render()
+	if got := ts.Row(8); !strings.HasSuffix(got, " 30 lines") {
+		t.Errorf("editbox row = %q, want the number of lines in the buffer", got)
+	}
+	press(t, "PgUp")
+	render()
+	if got, want := ts.Row(8), fmt.Sprintf(" line %d of 30", bottomLineNo); !strings.HasSuffix(got, want) {
+		t.Errorf("editbox row = %q, want it to end with %q", got, want)
+	}
+
+	press(t, "PgDn", "PgDn", "PgDn", "PgDn", "PgDn", "Ctrl+T")
+	typeText("line 2")
+	press(t, "Enter")
+	render()
+	if got := ts.Row(8); !strings.HasSuffix(got, " 11 matches") {
+		t.Errorf("editbox row = %q, want 11 matches", got)
+	}
+	press(t, "PgUp")
+	render()
+	if got, want := ts.Row(8), fmt.Sprintf(" match %d of 11", 11-newerLineCount()); !strings.HasSuffix(got, want) {
+		t.Errorf("editbox row = %q, want it to end with %q", got, want)
+	}
+}
+
+func TestWrapSelected(t *testing.T) {
+	long := "01-02 10:00:04.000   100   100 I Test: " + strings.Repeat("x", 150)
+	ts := setUp(t, append(testLines, long)...)
+	press(t, "Up", "Alt+W")
+	render()
+
+	rows := ts.LogRows()
+	want := []string{long[:100], long[100:]}
+	if got := rows[len(rows)-2:]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("wrapped rows = %q, want %q", got, want)
+	}
+	if rows[len(rows)-3] != testLines[3] {
+		t.Errorf("row above the wrapped line = %q, want %q", rows[len(rows)-3], testLines[3])
+	}
+
+	press(t, "Alt+W")
+	render()
+	if rows := ts.LogRows(); rows[len(rows)-1] != long[:100] {
+		t.Errorf("after unwrapping, bottom row = %q, want %q", rows[len(rows)-1], long[:100])
+	}
+}
+
+func TestWrapLines(t *testing.T) {
+	long := "01-02 10:00:04.000   100   100 I Test: " + strings.Repeat("x", 150)
+	ts := setUp(t, append(testLines, long)...)
+	press(t, "Alt+=")
+	render()
+
+	rows := ts.LogRows()
+	want := []string{long[:100], "↪ " + long[100:]}
+	if got := rows[len(rows)-2:]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("wrapped rows = %q, want %q", got, want)
+	}
+	if rows[len(rows)-3] != testLines[3] {
+		t.Errorf("row above the wrapped line = %q, want %q", rows[len(rows)-3], testLines[3])
+	}
+
+	// A new filter starts out wrapping too, but can be toggled on its own.
+	press(t, "Ctrl+T")
+	press(t, "Alt+=")
+	render()
+	if rows := ts.LogRows(); rows[len(rows)-1] != long[:100] {
+		t.Errorf("after turning wrapping off, bottom row = %q, want %q", rows[len(rows)-1], long[:100])
+	}
+	press(t, "Ctrl+P")
+	render()
+	if rows := ts.LogRows(); rows[len(rows)-1] != "↪ "+long[100:] {
+		t.Errorf("back in the \"no filter\" view, bottom row = %q, want it still wrapped", rows[len(rows)-1])
+	}
+}
+
+func TestResolveOptions(t *testing.T) {
+	fs := flag.NewFlagSet("lolcat", flag.ContinueOnError)
+	poll := fs.String("poll", "2s", "")
+	live := fs.Bool("live", true, "")
+	pin := fs.String("pin", "", "")
+	match := fs.String("match", "regex", "")
+	var bindings listFlag
+	fs.Var(&bindings, "bind", "")
+	if err := fs.Parse([]string{"-poll", "5s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ReadConfig(strings.NewReader("# comment\npoll = 1s\nlive=false\npin=Foo\n\nbind=quit=Ctrl+Q\nbind=next-view=Tab\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"LOLCAT_PIN": "Bar", "LOLCAT_MATCH": "fixed"}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	if err := ResolveOptions(fs, lookupEnv, config.Options); err != nil {
+		t.Fatal(err)
+	}
+	if *poll != "5s" || *live || *pin != "Bar" || *match != "fixed" {
+		t.Errorf("got poll=%s live=%t pin=%s match=%s, want 5s (flag), false (config), Bar and fixed (env)",
+			*poll, *live, *pin, *match)
+	}
+	if strings.Join(bindings, " ") != "quit=Ctrl+Q next-view=Tab" {
+		t.Errorf("bindings = %q, want both from the config file", bindings)
+	}
+
+	if err := ResolveOptions(fs, lookupEnv, map[string][]string{"nope": {"1"}}); err == nil {
+		t.Error("expected an error for an unknown option in the config file")
+	}
+
+	// A config file value for a flag mustn't override its alias being given on the command line.
+	fs = flag.NewFlagSet("lolcat", flag.ContinueOnError)
+	var lines int
+	fs.IntVar(&lines, "lines", 1000, "")
+	fs.IntVar(&lines, "buffer-lines", 1000, "")
+	if err := fs.Parse([]string{"-buffer-lines", "50000"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResolveOptions(fs, lookupEnv, map[string][]string{"lines": {"2000"}}); err != nil {
+		t.Fatal(err)
+	}
+	if lines != 50000 {
+		t.Errorf("lines = %d, want 50000 from -buffer-lines", lines)
+	}
+
+	// Options from the config file or environment count as set, so that their defaults (like
+	// -freeze-after's half of -lines) don't replace them.
+	fs = flag.NewFlagSet("lolcat", flag.ContinueOnError)
+	var freezeAfter int
+	fs.IntVar(&freezeAfter, "freeze-after", 0, "")
+	fs.Int("lines", 1000, "")
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResolveOptions(fs, lookupEnv, map[string][]string{"freeze-after": {"10"}}); err != nil {
+		t.Fatal(err)
+	}
+	if freezeAfter != 10 || !IsSet(fs, "freeze-after") || IsSet(fs, "lines") {
+		t.Errorf("freeze-after = %d (set: %t), lines set: %t, want 10 and only freeze-after set",
+			freezeAfter, IsSet(fs, "freeze-after"), IsSet(fs, "lines"))
+	}
+}
+
+func TestSplitLinkedByTime(t *testing.T) {
+	ts := setUp(t, testLines...)
+	other := NewDevice("emulator-5556", "Tablet")
+	for _, line := range []string{
+		"01-02 10:00:00.500   300   300 I Other: first",
+		"01-02 10:00:01.500   300   300 I Other: second",
+		"01-02 10:00:02.500   300   300 I Other: third",
+	} {
+		other.appendLine(line)
+	}
+	other.opened = true // so splitting with it doesn't start adb
+	devices = append(devices, other)
+	press(t, "Alt+v")
+	l := currentLayout()
+	if l.SplitRows == 0 {
+		t.Fatal("the screen isn't split")
+	}
+
+	// Scrolled back to the line logged at 10:00:01, so the split pane should end at 10:00:00.500.
+	bottomLineNo = 2
+	render()
+	if got := ts.Row(l.SplitTop + l.SplitRows - 1); got != "01-02 10:00:00.500   300   300 I Other: first" {
+		t.Errorf("bottom of the split pane = %q, want the line before 10:00:01", got)
+	}
+
+	press(t, "Alt+V")
+	if currentDevice() != other || splitDevice != devices[0] || bottomLineNo != 1 {
+		t.Errorf("after swapping, current device %s scrolled to line %d, want Tablet at line 1",
+			currentDevice().Name, bottomLineNo)
+	}
+
+	press(t, "Alt+k")
+	bottomLineNo = 0
+	render()
+	if got := ts.Row(l.SplitTop + l.SplitRows - 1); got != testLines[3] {
+		t.Errorf("unlinked split pane's bottom row = %q, want the newest line %q", got, testLines[3])
+	}
+}
+
+func TestLineRate(t *testing.T) {
+	ts := setUp(t, testLines...)
+	d := devices[0]
+	now := time.Now()
+	if d.UpdateRate(now) || d.rate != 0 {
+		t.Errorf("rate = %d before we've caught up with logcat's history, want 0", d.rate)
+	}
+
+	for i := 0; i < 50; i++ {
+		d.appendLine(testLines[i%len(testLines)])
+	}
+	// We'd ping for every line once we're waiting, so only say we are now.
+	d.waiting = true
+	if !d.UpdateRate(now.Add(500*time.Millisecond)) || d.rate != 100 {
+		t.Errorf("rate = %d after 50 lines in half a second, want 100", d.rate)
+	}
+	render()
+	if got := ts.Row(0); !strings.Contains(got, "Pixel 100/s") {
+		t.Errorf("device bar = %q, want the rate", got)
+	}
+
+	rateWarning = 100
+	render()
+	if got := ts.Row(0); !strings.Contains(got, "100 lines/sec, display may lag") {
+		t.Errorf("device bar = %q, want a warning", got)
+	}
+}
+
+func TestConnectionState(t *testing.T) {
+	ts := setUp(t)
+	d := devices[0]
+	render()
+	if got := ts.Row(0); !strings.Contains(got, "‖ Pixel") {
+		t.Errorf("device bar = %q, want it suspended before it's opened", got)
+	}
+
+	// 'adb devices' knows best, until we get a line.
+	addDevices([]deviceInfo{{"emulator-5554", "Pixel", "offline"}, {"R58M", "R58M", "unauthorized"}})
+	if len(devices) != 2 || devices[1].opened || devices[1].state != StateUnauthorized {
+		t.Fatalf("unauthorized device = %+v, want it added but not opened", devices[1])
+	}
+	d.mutex.Lock()
+	d.setState(StateConnecting)
+	d.mutex.Unlock()
+	if d.state != StateOffline {
+		t.Errorf("state = %v after connecting while offline, want offline", d.state)
+	}
+	d.mutex.Lock()
+	d.setState(StateStreaming)
+	d.mutex.Unlock()
+	render()
+	if got := ts.Row(0); !strings.Contains(got, "● Pixel") || !strings.Contains(got, "⚠ R58M") {
+		t.Errorf("device bar = %q, want one streaming and one unauthorized", got)
+	}
+
+	// A device that's gone away is offline.
+	addDevices([]deviceInfo{{"R58M", "R58M", "unauthorized"}})
+	if d.state != StateOffline {
+		t.Errorf("state = %v after it's unplugged, want offline", d.state)
+	}
+}
+
+func TestMatchHighlights(t *testing.T) {
+	wide := "01-02 10:00:04.000   100   100 I Test: 日本語 ANR in 日本"
+	ts := setUp(t, wide)
+	press(t, "Ctrl+T")
+	typeText("ANR|日本")
+	render()
+
+	// The wide characters take up two cells each, so "ANR" starts 7 cells after "日本語".
+	y := 7
+	x := strings.Index(wide, "日本語")
+	bold := termbox.ColorCyan | termbox.AttrBold
+	want := map[int]termbox.Attribute{0: bold, 2: bold, 4: termbox.ColorDefault, 6: termbox.ColorDefault,
+		7: bold, 9: bold, 10: termbox.ColorDefault}
+	for i, color := range want {
+		if got := ts.cells[y*ts.w+x+i].Fg; got != color {
+			t.Errorf("cell %d (%q) drawn in %v, want %v", x+i, ts.cells[y*ts.w+x+i].Ch, got, color)
+		}
+	}
+
+	// Nothing's highlighted in the "no filter" view.
+	press(t, "Ctrl+P")
+	render()
+	if got := ts.cells[y*ts.w+x].Fg; got != termbox.ColorDefault {
+		t.Errorf("drawn in %v with no filter, want the default", got)
+	}
+
+	locs := fixedMatcher("ab").FindAllStringIndex("abcabab", -1)
+	if fmt.Sprint(locs) != "[[0 2] [3 5] [5 7]]" {
+		t.Errorf("fixed matches = %v", locs)
+	}
+}
+
+func TestNegatedFilter(t *testing.T) {
+	ts := setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("Wifi")
+	press(t, "Alt+i")
+	render()
+	want := []string{testLines[0], testLines[2]}
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("log rows = %q, want the lines without Wifi", got)
+	}
+	if got := ts.Row(9); !strings.Contains(got, "!Wifi") {
+		t.Errorf("tab bar = %q, want the view marked as negated", got)
+	}
+
+	// Editing the filter keeps it negated.
+	press(t, "Backspace", "Backspace", "Backspace", "Backspace")
+	typeText("ANR")
+	if got := len(devices[0].logViews[0].index); got != 3 {
+		t.Errorf("%d lines without ANR, want 3", got)
+	}
+	press(t, "Alt+i")
+	if got := len(devices[0].logViews[0].index); got != 1 {
+		t.Errorf("%d lines with ANR after toggling back, want 1", got)
+	}
+}
+
+func TestMinLevel(t *testing.T) {
+	ts := setUp(t, append(testLines, "--------- beginning of main")...)
+	press(t, "Ctrl+T")
+	typeText(".")
+	press(t, "Alt+M")
+	if got := len(devices[0].logViews[0].index); got != 4 {
+		t.Errorf("%d lines at debug and above, want the 4 log lines without the marker", got)
+	}
+	press(t, "Alt+M", "Alt+M")
+	render()
+	want := []string{testLines[2], testLines[3]}
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("log rows = %q, want just the warning and error", got)
+	}
+	if got := ts.Row(9); !strings.Contains(got, ".≥W") {
+		t.Errorf("tab bar = %q, want the view marked with its level", got)
+	}
+
+	// It's on top of the filter, whatever the filter is.
+	press(t, "Backspace")
+	typeText("Wifi")
+	if idx := devices[0].logViews[0].index; len(idx) != 1 || idx[0] != 4 {
+		t.Errorf("index = %v, want just the Wifi warning", idx)
+	}
+	press(t, "Alt+M", "Alt+M")
+	if got := len(devices[0].logViews[0].index); got != 2 {
+		t.Errorf("%d Wifi lines after cycling back to every level, want 2", got)
+	}
+}
+
+func TestProcessNames(t *testing.T) {
+	for _, out := range []string{
+		"  PID NAME\n    1 init\n  100 system_server\n  200 com.android.wifi\n",
+		"USER      PID   PPID  VSIZE  RSS   WCHAN            PC  NAME\n" +
+			"root      1     0     10632  1016  SyS_epoll_ 0000000000 S init\n" +
+			"system    100   1     1634600 81240 SyS_epoll_ 0000000000 S system_server\n" +
+			"wifi      200   1     1634600 81240 SyS_epoll_ 0000000000 S com.android.wifi\n",
+	} {
+		want := map[int]string{1: "init", 100: "system_server", 200: "com.android.wifi"}
+		if got := ParsePS(out); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("ParsePS(%q) = %v, want %v", out, got, want)
+		}
+	}
+
+	ts := setUp(t, testLines...)
+	applyProcessUpdate(processUpdate{device: devices[0], processes: ParsePS("PID NAME\n100 system_server\n")})
+	press(t, "Alt+A")
+	render()
+	want := []string{
+		"01-02 10:00:00.000   system_server   100 I ActivityManager: Start proc com.example",
+		testLines[1],
+	}
+	if got := ts.LogRows(); strings.Join(got[:2], "\n") != strings.Join(want, "\n") {
+		t.Errorf("log rows = %q, want %q", got[:2], want)
+	}
+	press(t, "Alt+A")
+	render()
+	if got := ts.LogRows(); got[0] != testLines[0] {
+		t.Errorf("top row = %q after turning names off, want %q", got[0], testLines[0])
+	}
+}
+
+func TestFilterToApp(t *testing.T) {
+	setUp(t, testLines...)
+	d := devices[0]
+	applyProcessUpdate(processUpdate{device: d, processes: map[int]string{100: "com.example"}})
+	press(t, "Up", "Up")
+	press(t, "Alt+O")
+	if prompt == nil || string(editbox.text) != "com.example" {
+		t.Fatalf("editbox = %q, want the selected line's package suggested", editbox.text)
+	}
+	press(t, "Enter")
+	if viewIndex != 1 || string(editbox.text) != "pkg:com.example" || d.logViews[0].pkg != "com.example" {
+		t.Fatalf("view %d with %q, want a new pkg:com.example view", viewIndex, editbox.text)
+	}
+	applyPIDUpdate(pidUpdate{d, "com.example", 100, nil})
+	if idx := d.logViews[0].index; len(idx) != 2 || idx[0] != 1 || idx[1] != 3 {
+		t.Errorf("index = %v, want the two lines from pid 100", idx)
+	}
+}
+
+func TestForgetDevices(t *testing.T) {
+	setUp(t, testLines...)
+	tablet := NewDevice("R58M", "Tablet")
+	devices = append(devices, tablet)
+	press(t, "Ctrl+T")
+	typeText("Wifi")
+	splitDevice = tablet
+
+	// The tablet's unplugged, but it might just be rebooting.
+	addDevices([]deviceInfo{{"emulator-5554", "Pixel", "unauthorized"}})
+	now := time.Now()
+	if forgetDevices(now) || len(devices) != 2 {
+		t.Fatalf("forgot a device straight away, have %d left", len(devices))
+	}
+	if !forgetDevices(now.Add(forgetAfter)) || len(devices) != 1 || devices[0].Name != "Pixel" {
+		t.Fatalf("devices = %v, want just the Pixel once the tablet's been gone for a while", devices)
+	}
+	if !tablet.closed || splitDevice != nil {
+		t.Errorf("tablet closed = %v, split device = %v, want it closed and out of the split", tablet.closed, splitDevice)
+	}
+	if deviceIndex != 0 || viewIndex != 1 || string(editbox.text) != "Wifi" {
+		t.Errorf("device %d, view %d with %q, want to stay where we were", deviceIndex, viewIndex, editbox.text)
+	}
+
+	// Now the current one goes too.
+	addDevices(nil)
+	forgetDevices(now.Add(2 * forgetAfter))
+	if len(devices) != 0 || currentDevice() != nil || viewIndex != 0 {
+		t.Errorf("%d devices, view %d, want none left", len(devices), viewIndex)
+	}
+	render()
+}
+
+func TestCloseFilter(t *testing.T) {
+	setUp(t, testLines...)
+	for _, filter := range []string{"Wifi", "ANR", "scan"} {
+		press(t, "Ctrl+T")
+		typeText(filter)
+	}
+	anr := devices[0].logViews[1]
+	anr.compareTo = devices[0].logViews[0]
+
+	steps := []struct {
+		key       string
+		wantView  int
+		wantInBox string
+		wantViews int
+	}{
+		{"Ctrl+X", 2, "ANR", 2}, // nothing's after "scan", so it's "ANR"
+		{"Alt+2", 1, "Wifi", 2},
+		{"Ctrl+X", 1, "ANR", 1}, // "ANR" takes the place of "Wifi"
+		{"Ctrl+X", 0, "", 0},    // and closing the only one leaves "no filter"
+		{"Ctrl+X", 0, "", 0},    // which can't be closed
+	}
+	for i, step := range steps {
+		press(t, step.key)
+		if viewIndex != step.wantView || string(editbox.text) != step.wantInBox || len(devices[0].logViews) != step.wantViews {
+			t.Errorf("after %s: view %d with %q of %d, want view %d with %q of %d", step.key, viewIndex,
+				editbox.text, len(devices[0].logViews), step.wantView, step.wantInBox, step.wantViews)
+		}
+		if i == 2 && anr.compareTo != nil {
+			t.Errorf("ANR is still being compared to the closed Wifi view")
+		}
+	}
+	views := devices[0].logViews
+	for i, lv := range views[:cap(views)] {
+		if lv != nil {
+			t.Errorf("slot %d of logViews still holds the closed view %q", i, lv.Name)
+		}
+	}
+	if anr.index != nil {
+		t.Errorf("closed view's index = %v, want it freed", anr.index)
+	}
+}
+
+func TestCloseAllFilters(t *testing.T) {
+	setUp(t, testLines...)
+	other := NewDevice("emulator-5556", "Tablet")
+	other.logViews = append(other.logViews, &LogView{lb: other.logBuffer})
+	devices = append(devices, other)
+	press(t, "Ctrl+T")
+	typeText("Wifi")
+	press(t, "Ctrl+T")
+	typeText("ANR")
+
+	press(t, "Alt+F")
+	typeText("n")
+	press(t, "Enter")
+	if len(devices[0].logViews) != 2 {
+		t.Fatalf("got %d views after saying no, want 2", len(devices[0].logViews))
+	}
+
+	press(t, "Alt+F")
+	typeText("y")
+	press(t, "Enter")
+	if len(devices[0].logViews) != 0 || viewIndex != 0 || string(editbox.text) != "" {
+		t.Errorf("got %d views, view %d and filter %q, want no filters left", len(devices[0].logViews),
+			viewIndex, editbox.text)
+	}
+	if len(other.logViews) != 1 {
+		t.Errorf("the other device has %d views, want its 1 left alone", len(other.logViews))
+	}
+
+	press(t, "Alt+F")
+	typeText("a")
+	press(t, "Enter")
+	if len(other.logViews) != 0 {
+		t.Errorf("the other device has %d views, want them all closed", len(other.logViews))
+	}
+}
+
+func TestRateAlert(t *testing.T) {
+	ts := setUp(t, testLines...)
+	d := devices[0]
+	press(t, "Ctrl+T")
+	typeText("Wifi")
+	press(t, "Alt+n")
+	typeText("2/1m")
+	press(t, "Enter")
+
+	lv := d.logViews[0]
+	if lv.rateAlert == nil || lv.rateAlert.Count != 2 || lv.rateAlert.Window != time.Minute {
+		t.Fatalf("rate alert = %+v, want more than 2 in 1m", lv.rateAlert)
+	}
+	// The history's matches don't count, only new ones.
+	d.appendLine(testLines[1])
+	d.appendLine(testLines[3])
+	render()
+	if ts.bells != 0 || lv.rateAlert.firing {
+		t.Errorf("alert went off after 2 new matches")
+	}
+	d.appendLine(testLines[0])
+	d.appendLine(testLines[3])
+	render()
+	if ts.bells != 1 || !strings.Contains(lv.Label(), "🔔") {
+		t.Errorf("rang %d times with label %q, want the alert to go off once", ts.bells, lv.Label())
+	}
+	if got := ts.Row(8); !strings.HasSuffix(got, ", 3 in 1m0s (alert over 2)") {
+		t.Errorf("editbox row = %q, want the rate", got)
+	}
+	d.appendLine(testLines[3])
+	render()
+	if ts.bells != 1 {
+		t.Errorf("rang %d times, want only when the alert first goes off", ts.bells)
+	}
+
+	if _, err := ParseRateAlert("5"); err == nil {
+		t.Error("expected an error for a rate alert without a window")
+	}
+}
+
+func TestAnnotateLine(t *testing.T) {
+	ts := setUp(t, testLines...)
+	press(t, "Up", "Up", "Alt+N")
+	typeText("this is where it freezes")
+	press(t, "Enter")
+	render()
+
+	if got := devices[0].notes[3]; got != "this is where it freezes" {
+		t.Errorf("note on line 3 = %q", got)
+	}
+	if got := ts.Row(6); !strings.HasSuffix(got, "✎") {
+		t.Errorf("annotated row = %q, want it marked", got)
+	}
+	if got := ts.Row(9); !strings.HasSuffix(got, "✎ this is where it freezes") {
+		t.Errorf("tab row = %q, want the selected line's note", got)
+	}
+
+	var buf strings.Builder
+	if n := devices[0].WriteNotes(&buf); n != 1 || !strings.Contains(buf.String(), testLines[2]+"\n    ✎ this is") {
+		t.Errorf("WriteNotes wrote %d notes: %q", n, buf.String())
+	}
+
+	press(t, "Alt+N")
+	if string(editbox.text) != "this is where it freezes" {
+		t.Errorf("prompt starts with %q, want the existing note", editbox.text)
+	}
+	press(t, "Ctrl+A", "Ctrl+K", "Enter")
+	if len(devices[0].notes) != 0 {
+		t.Errorf("notes = %v, want the note removed", devices[0].notes)
+	}
+}
+
+// archiveTestLine returns a realistic looking line for the given line number.
+func archiveTestLine(lineNo int) string {
+	return fmt.Sprintf("01-02 10:%02d:%02d.%03d   100   %3d I ActivityManager: line %d, process com.example",
+		lineNo/60000%60, lineNo/1000%60, lineNo%1000, lineNo%7, lineNo)
+}
+
+func TestArchive(t *testing.T) {
+	setUp(t)
+	memoryBudget = 64 << 10
+	d := NewDevice("emulator-5554", "Pixel")
+	devices = []*Device{d}
+	for i := 1; i <= 20000; i++ {
+		d.appendLine(archiveTestLine(i))
+	}
+
+	lb := d.logBuffer
+	first := lb.GetFirstLineNo()
+	if first >= 20000-BufferLineCount || first == 1 {
+		t.Fatalf("first line is %d, want some but not all of the older lines archived", first)
+	}
+	if lb.archive.Size() > memoryBudget {
+		t.Errorf("archive holds %d bytes, more than the budget of %d", lb.archive.Size(), memoryBudget)
+	}
+	for _, lineNo := range []int64{first, first + 1, 20000 - BufferLineCount, 20000 - BufferLineCount + 1, 20000} {
+		if got, want := lb.GetLine(lineNo), archiveTestLine(int(lineNo)); got != want {
+			t.Errorf("line %d = %q, want %q", lineNo, got, want)
+		}
+	}
+	if lb.HasLine(first - 1) {
+		t.Errorf("line %d should have been dropped from the archive", first-1)
+	}
+
+	press(t, "Ctrl+T")
+	typeText(fmt.Sprintf("line %d,", first+10))
+	if idx := d.logViews[0].index; len(idx) != 1 || idx[0] != first+10 {
+		t.Errorf("filter's index = %v, want the archived line %d", idx, first+10)
+	}
+}
+
+func TestLogEntry(t *testing.T) {
+	setUp(t)
+	memoryBudget = 64 << 10
+	bufferLines = 10
+	d := NewDevice("emulator-5554", "Pixel")
+	d.appendLine("--------- beginning of main")
+	for _, line := range testLines {
+		d.appendLine(line)
+	}
+	for i := 0; i < 20; i++ {
+		d.appendLine(testLines[0])
+	}
+
+	lb := d.logBuffer
+	if e := lb.GetEntry(1); e.Parsed || e.Line != "--------- beginning of main" || e.Message != e.Line {
+		t.Errorf("GetEntry(1) = %+v, want the unparsed marker from the archive", e)
+	}
+	if e := lb.GetEntry(4); !e.Parsed || e.Line != testLines[2] || e.Level != 'E' || e.Tag != "ActivityManager" {
+		t.Errorf("GetEntry(4) = %+v, want the parsed line %q from the archive", e, testLines[2])
+	}
+	last := lb.GetLastLineNo()
+	if e := lb.GetEntry(last); !e.Parsed || e.Line != testLines[0] || e.PID != 100 {
+		t.Errorf("GetEntry(%d) = %+v, want the parsed line %q", last, e, testLines[0])
+	}
+	if e := lb.GetEntry(last + 1); e.Parsed || e.Line != "" {
+		t.Errorf("GetEntry past the end = %+v, want an empty entry", e)
+	}
+}
+
+func BenchmarkArchive(b *testing.B) {
+	lines := make([]string, ArchiveBlockLines*16)
+	raw := 0
+	for i := range lines {
+		lines[i] = archiveTestLine(i)
+		raw += len(lines[i])
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		a := NewArchive(1 << 30)
+		for i, line := range lines {
+			a.Add(int64(i+1), line)
+		}
+		for i := range lines {
+			a.GetLine(int64(i + 1))
+		}
+		b.ReportMetric(float64(raw)/float64(a.Size()), "ratio")
+	}
+}
+
+func BenchmarkGetViewLineNos(b *testing.B) {
+	d := NewDevice("emulator-5554", "Phone")
+	for i := 0; i < 1000; i++ {
+		d.appendLine(fmt.Sprintf("01-02 10:00:00.000   100   100 I Test: line %d", i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		d.mutex.Lock()
+		d.GetViewLineNos(0, 0, 50)
+		d.mutex.Unlock()
+	}
+}
+
+func TestCompareViews(t *testing.T) {
+	ts := setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("scan")
+	press(t, "Ctrl+T")
+	typeText("Wifi|ANR")
+
+	press(t, "Alt+D")
+	if overlay == nil || overlay.Items[overlay.selected] != "scan" {
+		t.Fatalf("overlay = %+v, want the previous filter chosen", overlay)
+	}
+	press(t, "Enter")
+	render()
+	want := []string{testLines[2]}
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("log rows = %q, want %q", got, want)
+	}
+	if got := ts.Row(8); !strings.HasSuffix(got, "3 matches, 1 not in scan") {
+		t.Errorf("editbox row = %q, want the count of differing lines", got)
+	}
+
+	press(t, "Alt+D")
+	render()
+	if got := ts.LogRows(); len(got) != 3 {
+		t.Errorf("log rows = %q, want all 3 matches after turning it off", got)
+	}
+}
+
+func TestGlyphs(t *testing.T) {
+	long := "01-02 10:00:04.000   100   100 I Test: " + strings.Repeat("x", 150)
+	ts := setUp(t, append(testLines, long)...)
+	var err error
+	if glyphs, err = ParseGlyphs("ascii,line-cut=>>"); err != nil {
+		t.Fatal(err)
+	}
+	press(t, "Ctrl+T")
+	typeText(strings.Repeat("x", 120))
+	render()
+
+	if got := ts.Row(7); !strings.HasSuffix(got, "xx>>") || len(got) != 100 {
+		t.Errorf("long line's row = %q, want it to end with the line-cut glyph", got)
+	}
+	if got := ts.Row(8); !strings.HasPrefix(got, " <xxx") {
+		t.Errorf("editbox row = %q, want the ASCII more-left glyph", got)
+	}
+
+	for _, bad := range []string{"fancy", "more-left=<<", "ellipsis=", "nope=x"} {
+		if _, err := ParseGlyphs(bad); err == nil {
+			t.Errorf("ParseGlyphs(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestFollowPackage(t *testing.T) {
+	ts := setUp(t, testLines...)
+	d := devices[0]
+	press(t, "Ctrl+T")
+	typeText("pkg:com.example")
+	lv := d.logViews[0]
+	if len(lv.index) != 0 {
+		t.Errorf("got %d matches before the package's PID is known, want none", len(lv.index))
+	}
+
+	applyPIDUpdate(pidUpdate{d, "com.example", 100, nil})
+	if len(lv.index) != 2 {
+		t.Errorf("got %d matches for pid 100, want 2", len(lv.index))
+	}
+
+	// It crashes, and restarts as pid 300. The new process's lines are picked up once we notice,
+	// in place of the old process's.
+	d.appendLine("01-02 10:00:04.000   300   300 I ActivityManager: Restarted")
+	applyPIDUpdate(pidUpdate{d, "com.example", 300, nil})
+	render()
+	if len(lv.index) != 1 {
+		t.Errorf("got %d matches after restarting, want 1", len(lv.index))
+	}
+	if got := ts.Row(8); !strings.HasSuffix(got, "1 match, com.example is pid 300") {
+		t.Errorf("editbox row = %q, want the current pid", got)
+	}
+
+	typeText(" Restarted")
+	if len(lv.index) != 1 || !lv.pkgPIDs[300] || lv.pkgPIDs[100] {
+		t.Errorf("got %d matches and pids %v after editing the filter, want just pid 300 kept", len(lv.index), lv.pkgPIDs)
+	}
+}
+
+func TestHideRepeatedTags(t *testing.T) {
+	ts := setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("tag:ActivityManager")
+	press(t, "Alt+o", "Alt+r")
+	render()
+
+	want := []string{
+		"01-02 10:00:00.000   100   100 I ActivityManager      Start proc com.example",
+		"01-02 10:00:02.000   100   100 E                      ANR in com.example",
+	}
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("log rows = %q, want %q", got, want)
+	}
+}
+
+func TestStatusRow(t *testing.T) {
+	ts := setUp(t, testLines...)
+	showStatusRow = true
+	press(t, "Ctrl+T")
+	typeText("Wifi(")
+	render()
+
+	if got := ts.Row(7); !strings.Contains(got, "missing closing )") {
+		t.Errorf("status row = %q, want the filter's error", got)
+	}
+	press(t, "Backspace")
+	render()
+	if got := ts.Row(7); !strings.HasSuffix(got, " 2 matches") {
+		t.Errorf("status row = %q, want the match count", got)
+	}
+	if got := ts.Row(8); strings.Contains(got, "matches") {
+		t.Errorf("editbox row = %q, want no match count", got)
+	}
+	if got := len(ts.LogRows()); got != 2 {
+		t.Errorf("got %d log rows, want 2", got)
+	}
+}
+
+func TestStackFilter(t *testing.T) {
+	lines := []string{
+		"01-02 10:00:00.000   100   100 E AndroidRuntime: java.lang.NullPointerException",
+		"01-02 10:00:00.000   100   100 E AndroidRuntime:     at com.example.Foo.bar(Foo.java:12)",
+		"01-02 10:00:00.000   100   100 E AndroidRuntime:     at android.os.Looper.loop(Native Method)",
+		"01-02 10:00:01.000   300   300 F DEBUG   :       #00 pc 00089abc  /system/lib/libc.so (abort+4)",
+		"01-02 10:00:02.000   200   201 I WifiService: at home (not a frame)",
+	}
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"stack:", lines[1:4]},
+		{"stack:java", lines[1:3]},
+		{"stack:native pid:300", lines[3:4]},
+	}
+	for _, test := range tests {
+		ts := setUp(t, lines...)
+		press(t, "Ctrl+T")
+		typeText(test.filter)
+		render()
+		if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: log rows = %q, want %q", test.filter, got, test.want)
+		}
+	}
+
+	if _, err := ParseFilter("stack:cobol"); err == nil {
+		t.Error("stack:cobol parsed, want an error")
+	}
+}
+
+func TestAutoExport(t *testing.T) {
+	setUp(t, testLines...)
+	exportFormat = "raw"
+	press(t, "Ctrl+T")
+	typeText("tag:WifiService")
+	path := filepath.Join(t.TempDir(), "auto.log")
+	lv := devices[0].logViews[0]
+	if err := lv.StartAutoExport(path, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file's written in the background, so wait a while for what we expect.
+	read := func(want string) string {
+		var data []byte
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			var err error
+			if data, err = os.ReadFile(path); err != nil {
+				t.Fatal(err)
+			}
+			if string(data) == want {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return string(data)
+	}
+	devices[0].appendLine(testLines[1])
+	devices[0].appendLine(testLines[0])
+	time.Sleep(10 * time.Millisecond)
+	if got := read(""); got != "" {
+		t.Errorf("after one match, file = %q, want nothing until there's 2", got)
+	}
+	devices[0].appendLine(testLines[3])
+	want := testLines[1] + "\n" + testLines[3] + "\n"
+	if got := read(want); got != want {
+		t.Errorf("after two matches, file = %q, want %q", got, want)
+	}
+
+	devices[0].appendLine(testLines[1])
+	press(t, "Alt+x")
+	if lv.autoExport != nil || !strings.HasPrefix(statusMessage, "Auto-exported 3 lines") {
+		t.Errorf("status = %q, want auto-export stopped after 3 lines", statusMessage)
+	}
+}
+
+func TestAdbPath(t *testing.T) {
+	setUp(t)
+	adbPath = "/opt/android/platform-tools/adb"
+	d := NewDevice("192.168.1.20:5555", "Pixel 6")
+	cmd := adbCommand(d.logcatArgs()...)
+	want := []string{adbPath, "-s", "192.168.1.20:5555", "logcat", "-v", "threadtime"}
+	if cmd.Path != adbPath || strings.Join(cmd.Args, " ") != strings.Join(want, " ") {
+		t.Errorf("got %s %q, want %s %q", cmd.Path, cmd.Args, adbPath, want)
+	}
+	if got, _ := d.AdbCommand(0); !strings.HasPrefix(got, adbPath+" -s 192.168.1.20:5555 logcat ") {
+		t.Errorf("AdbCommand(0) = %q, want it to use %s", got, adbPath)
+	}
+}
+
+func TestAdbErrors(t *testing.T) {
+	ts := setUp(t, testLines...)
+	d := currentDevice()
+	d.mutex.Lock()
+	d.err = adbError(errors.New("exit status 1"), "- waiting for device -\nerror: device offline\n")
+	d.setState(StateReconnecting)
+	d.mutex.Unlock()
+	render()
+	if got := ts.Row(0); !strings.Contains(got, "error: device offline") {
+		t.Errorf("device bar = %q, want it to show adb's error", got)
+	}
+	if err := adbError(errors.New("exit status 1"), ""); err.Error() != "exit status 1" {
+		t.Errorf("with nothing on stderr, got %q, want the exit status", err)
+	}
+
+	devices = nil
+	adbPath = "/nonexistent/adb"
+	refreshDevices()
+	render()
+	if got := ts.Row(0); devicesErr == nil || !strings.Contains(got, "'adb devices' failed") {
+		t.Errorf("device bar = %q, want it to say 'adb devices' failed", got)
+	}
+}
+
+func TestReadTrackedDevices(t *testing.T) {
+	list := "emulator-5554\tdevice product:sdk model:Pixel_6\n192.168.1.20:5555\toffline\n"
+	input := fmt.Sprintf("%04x%s0000", len(list), list)
+	var got [][]deviceInfo
+	err := readTrackedDevices(strings.NewReader(input), func(infos []deviceInfo) {
+		got = append(got, infos)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]deviceInfo{
+		{{"emulator-5554", "Pixel 6", "device"}, {"192.168.1.20:5555", "192.168.1.20:5555", "offline"}},
+		nil,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := readTrackedDevices(strings.NewReader("zzzz"), func([]deviceInfo) {}); err == nil {
+		t.Error("expected an error for a bad length")
+	}
+}
+
+func TestJumpToDevice(t *testing.T) {
+	ts := setUp(t, testLines...)
+	other := NewDevice("emulator-5556", "Tablet")
+	other.appendLine("01-02 10:00:00.500   300   300 I Other: hello")
+	// Neither device should start adb when we switch to it.
+	devices[0].opened = true
+	other.opened = true
+	devices = append(devices, other)
+	press(t, "Ctrl+T")
+	typeText("Wifi")
+	press(t, "Enter")
+
+	press(t, "F2")
+	render()
+	if deviceIndex != 1 || viewIndex != 0 {
+		t.Errorf("after F2, device %d view %d, want the second device's \"no filter\" view", deviceIndex, viewIndex)
+	}
+	if got := ts.LogRows(); got[len(got)-1] != "01-02 10:00:00.500   300   300 I Other: hello" {
+		t.Errorf("bottom row = %q, want the second device's line", got[len(got)-1])
+	}
+	press(t, "F9")
+	if deviceIndex != 1 {
+		t.Errorf("F9 with two devices moved to device %d, want to stay on 1", deviceIndex)
+	}
+	press(t, "F1", "Alt+2")
+	if deviceIndex != 0 || viewIndex != 1 {
+		t.Errorf("device %d view %d, want the first device's own filter back", deviceIndex, viewIndex)
+	}
+}
+
+func TestParseDeviceLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want deviceInfo
+		ok   bool
+	}{
+		{"List of devices attached", deviceInfo{}, false},
+		{"* daemon started successfully", deviceInfo{}, false},
+		{"", deviceInfo{}, false},
+		{"emulator-5554\tdevice", deviceInfo{"emulator-5554", "emulator-5554", "device"}, true},
+		{"emulator-5554          device product:sdk_gphone64_x86_64 model:sdk_gphone64_x86_64 device:emu64xa transport_id:1",
+			deviceInfo{"emulator-5554", "sdk gphone64 x86 64", "device"}, true},
+		{"0A141FDD4003PX         device usb:1-1 product:oriole model:Pixel_6 device:oriole transport_id:3",
+			deviceInfo{"0A141FDD4003PX", "Pixel 6", "device"}, true},
+		{"192.168.1.20:5555      device product:oriole model:Pixel_6 device:oriole transport_id:4",
+			deviceInfo{"192.168.1.20:5555", "Pixel 6", "device"}, true},
+		{"0A141FDD4003PX         device model:Odd:Name usb: transport_id",
+			deviceInfo{"0A141FDD4003PX", "Odd:Name", "device"}, true},
+		{"0A141FDD4003PX         device model: product:oriole",
+			deviceInfo{"0A141FDD4003PX", "0A141FDD4003PX", "device"}, true},
+		{"0A141FDD4003PX         unauthorized usb:1-1 transport_id:5",
+			deviceInfo{"0A141FDD4003PX", "0A141FDD4003PX", "unauthorized"}, true},
+		{"emulator-5556          offline transport_id:6",
+			deviceInfo{"emulator-5556", "emulator-5556", "offline"}, true},
+	}
+	for _, test := range tests {
+		got, ok := parseDeviceLine(test.line)
+		if got != test.want || ok != test.ok {
+			t.Errorf("parseDeviceLine(%q) = %+v, %v, want %+v, %v", test.line, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestHexDump(t *testing.T) {
+	binary := "01-02 10:00:05.000   300   300 D Usb     : \x01\x02\x03\x04\xff\xfe\x00\x10\x11\x12\x13\x14\x15\x16\x17"
+	ts := setUp(t, testLines[0], binary)
+	press(t, "Up")
+	if !strings.Contains(statusMessage, "binary") {
+		t.Errorf("status = %q, want a hint that the line looks binary", statusMessage)
+	}
+	render()
+	if got := ts.Row(7); strings.ContainsAny(got, "\x00\x01\xff") || !strings.Contains(got, "Usb     : ····") {
+		t.Errorf("row = %q, want non-printable characters drawn as dots", got)
+	}
+
+	press(t, "Alt+h")
+	render()
+	if got := ts.Row(1); !strings.Contains(got, "Line 2, 58 bytes") {
+		t.Errorf("overlay title = %q", got)
+	}
+	if got := ts.Row(5); !strings.Contains(got, "fe 00 10 11 12 13 14 15") {
+		t.Errorf("overlay row = %q, want the hex of the message", got)
+	}
+	if LooksBinary(testLines[0]) {
+		t.Errorf("LooksBinary(%q) = true", testLines[0])
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	ts := setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("Wifi")
+	press(t, "Alt+b")
+	devices[0].appendLine(testLines[0])
+	devices[0].appendLine(testLines[3])
+	render()
+
+	want := []string{testLines[3]}
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("log rows = %q, want only the match after the baseline", got)
+	}
+	if got := ts.Row(8); !strings.HasSuffix(got, " 1 match after line 4") {
+		t.Errorf("editbox row = %q, want the count since the baseline", got)
+	}
+
+	press(t, "Alt+b")
+	if got := len(devices[0].logViews[0].index); got != 3 {
+		t.Errorf("got %d matches after clearing the baseline, want 3", got)
+	}
+}
+
+func TestCompactTabs(t *testing.T) {
+	ts := setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("first")
+	press(t, "Ctrl+T")
+	typeText("second")
+	render()
+	if got := ts.Row(9); got != " no filter  first  second  +filter" {
+		t.Errorf("tab bar = %q", got)
+	}
+
+	press(t, "Alt+w")
+	render()
+	if got := ts.Row(9); got != "no filter first second +filter" {
+		t.Errorf("compact tab bar = %q", got)
+	}
+}
+
+func TestCountUnique(t *testing.T) {
+	ts := setUp(t, testLines...)
+	devices[0].appendLine(testLines[1])
+	press(t, "Alt+u")
+	typeText(` [VDIWEF] (\w+):`)
+	press(t, "Enter")
+	render()
+
+	want := []string{
+		`2 distinct values of " [VDIWEF] (\\w+):" in 5 lines (Enter to count again, Ctrl+S to export)`,
+		"3  WifiService",
+		"2  ActivityManager",
+	}
+	for i, w := range want {
+		if got := strings.TrimSpace(ts.Row(1 + i)); got != w {
+			t.Errorf("row %d = %q, want %q", 1+i, got, w)
+		}
+	}
+
+	// The title names whichever key export has been bound to.
+	if err := BindKeys([]string{"export=none", "export=F2"}); err != nil {
+		t.Fatal(err)
+	}
+	press(t, "Enter")
+	render()
+	if got, want := strings.TrimSpace(ts.Row(1)), "(Enter to count again, F2 to export)"; !strings.HasSuffix(got, want) {
+		t.Errorf("title after -bind export=F2 = %q, want it to end with %q", got, want)
+	}
+}
+
+func TestExportSummary(t *testing.T) {
+	setUp(t, testLines...)
+	press(t, "Alt+u")
+	typeText(` [VDIWEF] (\w+):`)
+	press(t, "Enter")
+	if overlay == nil || overlay.Summary == nil {
+		t.Fatal("count-unique's overlay has no summary to export")
+	}
+	s := overlay.Summary
+
+	var csv, json strings.Builder
+	if err := s.Write(&csv, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "count,value\n2,ActivityManager\n2,WifiService\n"; csv.String() != want {
+		t.Errorf("csv = %q, want %q", csv.String(), want)
+	}
+	if err := s.Write(&json, "json"); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"count":"2","value":"ActivityManager"}`; !strings.HasPrefix(json.String(), want+"\n") {
+		t.Errorf("json = %q, want it to start with %s", json.String(), want)
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(dir)
+	exportFormat = "csv"
+	defer func() { exportFormat = "raw" }()
+	press(t, "Ctrl+S")
+	files, _ := filepath.Glob("lolcat-emulator-5554-*-counts.csv")
+	if len(files) != 1 || !strings.HasPrefix(statusMessage, "Exported 2 rows to ") {
+		t.Errorf("exported %v with status %q, want one counts file", files, statusMessage)
+	}
+}
+
+func TestExportCurrentView(t *testing.T) {
+	setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("Wifi")
+
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(dir)
+	press(t, "Ctrl+S")
+	if !strings.HasPrefix(statusMessage, "Exporting 2 lines to ") {
+		t.Errorf("status %q while exporting, want it to say it's started", statusMessage)
+	}
+	// The file's written in the background, and this is what the main loop would show.
+	if message := <-exportResults; !strings.HasPrefix(message, "Exported 2 lines to lolcat-emulator-5554-") {
+		t.Errorf("status %q when it's done, want the lines exported", message)
+	}
+	files, _ := filepath.Glob("lolcat-emulator-5554-*.log")
+	if len(files) != 1 {
+		t.Fatalf("exported %v, want one file", files)
+	}
+	data, _ := os.ReadFile(files[0])
+	if want := testLines[1] + "\n" + testLines[3] + "\n"; string(data) != want {
+		t.Errorf("exported %q, want %q", data, want)
+	}
+
+	press(t, "Alt+E")
+	if prompt == nil || !strings.HasPrefix(string(editbox.text), "lolcat-emulator-5554-") {
+		t.Fatalf("editbox = %q, want a prompt with the default filename in it", editbox.text)
+	}
+	editbox.SetText("")
+	typeText("wifi.log")
+	press(t, "Enter")
+	if message := <-exportResults; message != "Exported 2 lines to wifi.log" {
+		t.Errorf("status %q, want the lines exported to wifi.log", message)
+	}
+	if data, _ := os.ReadFile("wifi.log"); string(data) != testLines[1]+"\n"+testLines[3]+"\n" {
+		t.Errorf("exported %q to wifi.log, want the view's lines", data)
+	}
+	if string(editbox.text) != "Wifi" {
+		t.Errorf("editbox = %q after exporting, want the filter back", editbox.text)
+	}
+}
+
+func TestSelectionSyncedAcrossViews(t *testing.T) {
+	setUp(t, testLines...)
+	press(t, "Ctrl+T")
+	typeText("tag:ActivityManager")
+	press(t, "Alt+1", "Up", "Up")
+	if selectedLineNo != 3 {
+		t.Fatalf("selected line %d, want 3", selectedLineNo)
+	}
+
+	press(t, "Alt+2")
+	if selectedLineNo != 3 {
+		t.Errorf("selected line %d after switching to the filter, want 3 (it matches)", selectedLineNo)
+	}
+	press(t, "Alt+1", "Up")
+	press(t, "Alt+2")
+	if selectedLineNo != 1 {
+		t.Errorf("selected line %d after switching to the filter, want the nearest match, 1", selectedLineNo)
+	}
+}
+
+func TestScrolledBackLinesExpire(t *testing.T) {
+	ts := setUp(t)
+	d := devices[0]
+	d.logBuffer.lines = make([]LogEntry, 10)
+	line := func(n int) string {
+		return fmt.Sprintf("01-02 10:00:%02d.000   100   100 I Counter : %d", n, n)
+	}
+	for n := 1; n <= 12; n++ {
+		d.appendLine(line(n))
+	}
+	press(t, "Alt+g")
+	typeText("6")
+	press(t, "Enter")
+	render()
+	if got := ts.LogRows()[0]; got != line(3) {
+		t.Fatalf("top row = %q, want %q", got, line(3))
+	}
+
+	for n := 13; n <= 16; n++ {
+		d.appendLine(line(n))
+	}
+	statusMessage = ""
+	render()
+	if got := ts.LogRows(); got[0] != line(7) || got[len(got)-1] != line(13) {
+		t.Errorf("log rows = %q, want lines 7 to 13", got)
+	}
+	if got := ts.Row(9); !strings.HasSuffix(got, historyLostMessage) {
+		t.Errorf("tab bar = %q, want it to say history was lost", got)
+	}
+
+	press(t, "Esc")
+	render()
+	if historyLost || ts.LogRows()[6] != line(16) {
+		t.Errorf("after Esc, want to be following new lines again")
+	}
+}
+
+func TestAdbCommand(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+		exact  bool
+	}{
+		{"", "adb -s emulator-5554 logcat -v threadtime", true},
+		{"tag:WifiService level:WEF", "adb -s emulator-5554 logcat -v threadtime WifiService:W '*:S'", true},
+		{"level:E", "adb -s emulator-5554 logcat -v threadtime '*:E'", false},
+		{"pid:100 ANR in 'com", `adb -s emulator-5554 logcat -v threadtime --pid=100 | grep -E 'ANR in '\''com'`, true},
+		// grep -E doesn't know \d, or about flags.
+		{`ANR in \d`, `adb -s emulator-5554 logcat -v threadtime | grep -E 'ANR in \d'`, false},
+		{`(?i)anr`, `adb -s emulator-5554 logcat -v threadtime | grep -E '(?i)anr'`, false},
+		{`ANR [a-z]+ com\.example$`, `adb -s emulator-5554 logcat -v threadtime | grep -E 'ANR [a-z]+ com\.example$'`, true},
+	}
+	for _, test := range tests {
+		setUp(t)
+		press(t, "Ctrl+T")
+		typeText(test.filter)
+		got, exact := devices[0].AdbCommand(1)
+		if got != test.want || exact != test.exact {
+			t.Errorf("%q: got %s (exact %v), want %s (exact %v)", test.filter, got, exact, test.want, test.exact)
+		}
+	}
+
+	// A glob is translated into the regex it stands for.
+	setUp(t)
+	matchEngine = "glob"
+	press(t, "Ctrl+T")
+	typeText("Foo.(*)?")
+	want := `adb -s emulator-5554 logcat -v threadtime | grep -E 'Foo\.\(.*\).'`
+	if got, exact := devices[0].AdbCommand(1); got != want || !exact {
+		t.Errorf("with a glob: got %s (exact %v), want %s (exact)", got, exact, want)
+	}
+
+	// When the device is already restricted to a process, logcat still only gets one --pid.
+	setUp(t)
+	devices[0].pid = 100
+	press(t, "Ctrl+T")
+	typeText("pid:100")
+	want = "adb -s emulator-5554 logcat -v threadtime --pid=100"
+	if got, exact := devices[0].AdbCommand(1); got != want || !exact {
+		t.Errorf("restricted to the same pid: got %s (exact %v), want %s (exact)", got, exact, want)
+	}
+	typeText("0")
+	want = "adb -s emulator-5554 logcat -v threadtime --pid=100"
+	if got, exact := devices[0].AdbCommand(1); got != want || exact {
+		t.Errorf("restricted to another pid: got %s (exact %v), want %s (not exact)", got, exact, want)
+	}
+
+	devices[0].pid = 0
+	logcatBuffer = "main,crash"
+	want = "adb -s emulator-5554 logcat -v threadtime -b main,crash"
+	if got, _ := devices[0].AdbCommand(0); got != want {
+		t.Errorf("with -buffer: got %s, want %s", got, want)
+	}
+}
+
+func TestBufferFlags(t *testing.T) {
+	tests := []struct {
+		buffer string
+		want   string
+		ok     bool
+	}{
+		{"", "", true},
+		{"crash", "crash", true},
+		{"Main, system", "main,system", true},
+		{"mian", "", false},
+	}
+	for _, test := range tests {
+		got, err := ParseLogcatBuffer(test.buffer)
+		if got != test.want || (err == nil) != test.ok {
+			t.Errorf("ParseLogcatBuffer(%q) = %q, %v, want %q (ok %v)", test.buffer, got, err, test.want, test.ok)
+		}
+	}
+
+	// A small buffer wraps around many times over.
+	setUp(t)
+	bufferLines = 7
+	d := NewDevice("emulator-5556", "Tablet")
+	for i := 1; i <= 100; i++ {
+		d.appendLine(fmt.Sprintf("line %d", i))
+	}
+	lb := d.logBuffer
+	if lb.GetFirstLineNo() != 94 || lb.GetLine(94) != "line 94" || lb.GetLine(100) != "line 100" || lb.HasLine(93) {
+		t.Errorf("first line %d, want the last 7 of 100 lines", lb.GetFirstLineNo())
+	}
+}
+
+func TestContinuationColor(t *testing.T) {
+	ts := setUp(t,
+		"01-02 10:00:00.000   100   100 E AndroidRuntime: java.lang.NullPointerException",
+		"01-02 10:00:00.000   100   100 E AndroidRuntime:     at com.example.Foo.bar(Foo.java:12)",
+		testLines[1],
+	)
+	levelColors = false
+	render()
+	fgAt := func(y int) termbox.Attribute { return ts.cells[y*ts.w].Fg }
+	if fgAt(5) != termbox.ColorDefault || fgAt(6) != termbox.ColorDarkGray || fgAt(7) != termbox.ColorDefault {
+		t.Errorf("got colors %v, %v, %v, want only the stack frame in gray", fgAt(5), fgAt(6), fgAt(7))
+	}
+
+	press(t, "Alt+d")
+	render()
+	if fgAt(6) != termbox.ColorDefault {
+		t.Errorf("got color %v after toggling it off, want the default", fgAt(6))
+	}
+}
+
+func TestLevelColors(t *testing.T) {
+	ts := setUp(t, append(testLines, "adb: device offline")...)
+	render()
+	fgAt := func(y int) termbox.Attribute { return ts.cells[y*ts.w].Fg }
+	want := []termbox.Attribute{
+		termbox.ColorDefault, termbox.AttrDim, termbox.ColorRed, termbox.ColorYellow, termbox.ColorDefault,
+	}
+	for i, color := range want {
+		if got := fgAt(3 + i); got != color {
+			t.Errorf("line %d drawn in %v, want %v", i+1, got, color)
+		}
+	}
+
+	press(t, "Alt+P")
+	render()
+	if got := fgAt(5); got != termbox.ColorDefault {
+		t.Errorf("error line drawn in %v with level colors turned off, want the default", got)
+	}
+}
+
+func TestFreezeOnTrigger(t *testing.T) {
+	ts := setUp(t)
+	freezeTrigger = regexp.MustCompile("ANR")
+	freezeAfter = 1
+	d := devices[0]
+	for _, line := range testLines {
+		d.appendLine(line)
+	}
+	d.appendLine(testLines[0])
+	render()
+
+	if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(testLines, "\n") {
+		t.Errorf("log rows = %q, want the lines up to 1 after the trigger", got)
+	}
+	if got := ts.Row(0); !strings.Contains(got, "frozen, 1 dropped") {
+		t.Errorf("device bar = %q, want a frozen indicator", got)
+	}
+
+	press(t, "Alt+z")
+	d.appendLine(testLines[0])
+	if d.frozen || d.logBuffer.GetLastLineNo() != 5 {
+		t.Errorf("after resuming, got frozen %v with %d lines, want 5 lines", d.frozen, d.logBuffer.GetLastLineNo())
+	}
+}
+
+func TestMatchEngines(t *testing.T) {
+	lines := []string{
+		"01-02 10:00:00.000   100   100 I Foo     : a.b",
+		"01-02 10:00:00.000   100   100 I Foo     : axb",
+		"01-02 10:00:00.000   100   100 I Foo     : a.xyz.b",
+	}
+	tests := []struct {
+		engine string
+		filter string
+		want   []string
+	}{
+		{"regex", "a.b", lines[:2]},
+		{"fixed", "a.b", lines[:1]},
+		{"glob", "a.*.b", lines[2:]},
+		{"glob", ": a?b", lines[:2]},
+	}
+	for _, test := range tests {
+		ts := setUp(t, lines...)
+		matchEngine = test.engine
+		press(t, "Ctrl+T")
+		typeText(test.filter)
+		render()
+		if got := ts.LogRows(); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s %q: log rows = %q, want %q", test.engine, test.filter, got, test.want)
+		}
+	}
+
+	setUp(t, lines...)
+	press(t, "Ctrl+T")
+	typeText("a.b")
+	press(t, "Alt+e")
+	if got := len(devices[0].logViews[0].index); got != 1 || statusMessage != "Filter engine: fixed" {
+		t.Errorf("after switching to fixed, got %d matches and %q", got, statusMessage)
+	}
+}
+
+func TestHideBufferMarkers(t *testing.T) {
+	ts := setUp(t)
+	markerMode = "hide"
+	devices[0].appendLine("--------- beginning of main")
+	devices[0].appendLine(testLines[0])
+	render()
+	if got := ts.LogRows(); len(got) != 1 || got[0] != testLines[0] {
+		t.Errorf("log rows = %q, want just the log line", got)
+	}
+}
+
+func TestQuit(t *testing.T) {
+	setUp(t)
+	kb, _ := ParseKey("Ctrl+C")
+	if !handleEvent(termbox.Event{Type: termbox.EventKey, Key: kb.key}) {
+		t.Error("Ctrl+C didn't quit")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ts := setUp(t, testLines...)
+	d := currentDevice()
+	d.opened = true
+	d.mutex.Lock()
+	d.setState(StateReconnecting)
+	d.mutex.Unlock()
+	adbPath = "/nonexistent/adb"
+	press(t, "Alt+y")
+	select {
+	case <-d.retry:
+	default:
+		t.Error("expected the device to be told to retry")
+	}
+	// 'adb devices' runs in the background, so the UI doesn't wait for it.
+	if statusMessage != "Retrying 1 device" {
+		t.Errorf("status = %q", statusMessage)
+	}
+	select {
+	case update := <-deviceUpdates:
+		applyDeviceUpdate(update, time.Now())
+	case <-time.After(5 * time.Second):
+		t.Fatal("'adb devices' didn't finish")
+	}
+	if !strings.HasPrefix(statusMessage, "Retrying 1 device, but 'adb devices' failed") {
+		t.Errorf("status = %q", statusMessage)
+	}
+
+	applyDeviceUpdate(deviceUpdate{err: errors.New("'adb devices' failed: server died")}, time.Now())
+	render()
+	if got := ts.Row(0); !strings.Contains(got, "server died") || len(devices) != 1 {
+		t.Errorf("device bar = %q with %d devices, want the error and the device kept", got, len(devices))
+	}
+	applyDeviceUpdate(deviceUpdate{infos: []deviceInfo{{d.ID, d.Name, "device"}}}, time.Now())
+	if devicesErr != nil {
+		t.Errorf("devicesErr = %v, want it cleared", devicesErr)
+	}
+
+	// Only new devices we can stream from count as found. (The limit keeps them from starting adb.)
+	maxDevices = 1
+	applyDeviceUpdate(deviceUpdate{infos: []deviceInfo{
+		{d.ID, d.Name, "device"},
+		{"new", "new", "device"},
+		{"locked", "locked", "unauthorized"},
+		{"gone", "gone", "offline"},
+	}, status: "Retrying 0 devices"}, time.Now())
+	if statusMessage != "Retrying 0 devices, found 1 new" {
+		t.Errorf("status = %q, want only the new device in the device state counted", statusMessage)
+	}
+}
+
+func TestReconnectedMarker(t *testing.T) {
+	setUp(t, testLines...)
+	d := currentDevice()
+	adbPath = filepath.Join(t.TempDir(), "adb")
+	script := "#!/bin/sh\necho '01-02 10:00:09.000   100   100 I Test: back again'\n"
+	if err := os.WriteFile(adbPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	d.err = errors.New("adb logcat exited")
+	if n, err := d.stream(); n != 1 || err != nil {
+		t.Fatalf("stream() = %d, %v", n, err)
+	}
+	last := d.logBuffer.GetLastLineNo()
+	if got := d.logBuffer.GetLine(last - 1); got != reconnectedMarker {
+		t.Errorf("line before the new one = %q, want the reconnected marker", got)
+	}
+	if d.err != nil || d.state != StateStreaming {
+		t.Errorf("err = %v, state = %v, want streaming again", d.err, d.state)
+	}
+
+	// Without a lost connection (e.g. the first time we connect), there's no marker.
+	if _, err := d.stream(); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.logBuffer.GetLine(d.logBuffer.GetLastLineNo() - 1); got == reconnectedMarker {
+		t.Error("didn't expect another marker")
+	}
+}
+
+func TestLaunchLineKeptOnReconnect(t *testing.T) {
+	setUp(t, testLines...)
+	d := currentDevice()
+	adbPath = filepath.Join(t.TempDir(), "adb")
+	// logcat's history, then a pause before the lines that are logged while we're watching.
+	script := "#!/bin/sh\necho '01-02 10:00:09.000   100   100 I Test: history'\nsleep 0.6\n" +
+		"echo '01-02 10:00:10.000   100   100 I Test: new'\n"
+	if err := os.WriteFile(adbPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.stream(); err != nil {
+		t.Fatal(err)
+	}
+	launch := d.launchLineNo
+	if launch != int64(len(testLines)+1) {
+		t.Fatalf("launchLineNo = %d, want %d, the end of the history", launch, len(testLines)+1)
+	}
+	d.err = errors.New("adb logcat exited")
+	if _, err := d.stream(); err != nil {
+		t.Fatal(err)
+	}
+	if d.launchLineNo != launch {
+		t.Errorf("after reconnecting, launchLineNo = %d, want it kept at %d", d.launchLineNo, launch)
+	}
+}
+
+func TestChooseBuffers(t *testing.T) {
+	setUp(t, testLines...)
+	d := currentDevice()
+	d.opened = true
+	logcatBuffer = "main"
+	press(t, "Alt+B")
+	if got := string(editbox.text); got != "main" {
+		t.Errorf("prompt = %q, want the current buffers", got)
+	}
+	editbox.SetText("")
+	typeText("Main, crash")
+	press(t, "Enter")
+	if logcatBuffer != "main,crash" || statusMessage != "Reading the main,crash buffers" {
+		t.Errorf("got %q (%q), want main,crash", logcatBuffer, statusMessage)
+	}
+	if got := strings.Join(d.logcatArgs(), " "); !strings.HasSuffix(got, "-b main,crash") {
+		t.Errorf("logcat args = %q", got)
+	}
+	if n := d.logBuffer.Len(); n != 0 {
+		t.Errorf("%d lines left, want the logs cleared", n)
+	}
+
+	setLogcatBuffer("bogus")
+	if logcatBuffer != "main,crash" || !strings.Contains(statusMessage, "unknown logcat buffer") {
+		t.Errorf("got %q (%q), want no change and an error", logcatBuffer, statusMessage)
+	}
+}
+
+func TestFrameLimiter(t *testing.T) {
+	start := time.Now()
+	f := FrameLimiter{Interval: 50 * time.Millisecond}
+	if wait := f.Wait(start); wait != 0 {
+		t.Errorf("first frame: wait %v, want 0", wait)
+	}
+	if wait := f.Wait(start.Add(20 * time.Millisecond)); wait != 30*time.Millisecond {
+		t.Errorf("20ms later: wait %v, want 30ms", wait)
+	}
+	if wait := f.Wait(start.Add(50 * time.Millisecond)); wait != 0 {
+		t.Errorf("50ms later: wait %v, want 0", wait)
+	}
+	if wait := f.Wait(start.Add(60 * time.Millisecond)); wait != 40*time.Millisecond {
+		t.Errorf("60ms later: wait %v, want 40ms since the last frame", wait)
+	}
+
+	unlimited := FrameLimiter{}
+	if unlimited.Wait(start) != 0 || unlimited.Wait(start) != 0 {
+		t.Error("with no interval, expected to never wait")
+	}
+}
+
+func TestPingNeverBlocks(t *testing.T) {
+	setUp(t)
+	d := devices[0]
+	d.mutex.Lock()
+	d.waiting = true
+	d.mutex.Unlock()
+
+	// Nothing's listening, but a burst of lines still goes straight into the buffer, and leaves a
+	// single ping for the main loop to pick up.
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			d.appendLine(testLines[i%len(testLines)])
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("appendLine blocked with nothing listening for pings")
+	}
+	if n := d.logBuffer.Len(); n != 100 {
+		t.Errorf("got %d lines, want 100", n)
+	}
+	if len(d.ping) != 1 {
+		t.Errorf("got %d pings waiting, want 1", len(d.ping))
+	}
+}
+
+func TestScrollHorizontally(t *testing.T) {
+	long := "01-02 10:00:04.000   100   100 I Test: " + strings.Repeat("0123456789", 15)
+	ts := setUp(t, append(testLines, long)...)
+	render()
+
+	press(t, "Alt+>")
+	render()
+	rows := ts.LogRows()
+	if want := "←" + long[51:149] + "→"; rows[len(rows)-1] != want {
+		t.Errorf("scrolled half a screen, bottom row = %q, want %q", rows[len(rows)-1], want)
+	}
+
+	// We stop once the end of the widest line is on screen.
+	press(t, "Alt+>", "Alt+>")
+	render()
+	rows = ts.LogRows()
+	if want := "←" + long[len(long)-99:]; scrollX != len(long)-100 || rows[len(rows)-1] != want {
+		t.Errorf("scrolled to the end (%d), bottom row = %q, want %q", scrollX, rows[len(rows)-1], want)
+	}
+
+	press(t, "Alt+<", "Alt+<")
+	render()
+	if rows := ts.LogRows(); scrollX != 0 || rows[len(rows)-1] != long[:100] {
+		t.Errorf("scrolled back (%d), bottom row = %q, want %q", scrollX, rows[len(rows)-1], long[:100])
+	}
+
+	// Switching views starts from the beginning of the lines again.
+	press(t, "Ctrl+T", "Ctrl+P", "Alt+>", "Ctrl+N")
+	if viewIndex != 1 || scrollX != 0 {
+		t.Errorf("after switching to view %d, scrollX = %d, want 0", viewIndex, scrollX)
+	}
+	press(t, "Ctrl+P")
+
+	// Control characters are drawn as dots, so they take up a cell even though they've no width.
+	if got := DisplayWidth("a\x01\tb"); got != 4 {
+		t.Errorf("DisplayWidth = %d, want 4", got)
+	}
+
+	press(t, "Alt+=", "Alt+>")
+	if scrollX != 0 || !strings.Contains(statusMessage, "wrapped") {
+		t.Errorf("with wrapping on, got scrollX = %d (%q), want no scrolling", scrollX, statusMessage)
+	}
+}
+
+func TestSearchView(t *testing.T) {
+	ts := setUp(t, testLines...)
+	press(t, "Alt+/")
+	typeText("ActivityManager")
+	press(t, "Enter")
+	if selectedLineNo != 3 {
+		t.Errorf("selected line %d, want 3, the newest match", selectedLineNo)
+	}
+	render()
+	if rows := ts.LogRows(); !strings.Contains(strings.Join(rows, "\n"), "WifiService") {
+		t.Errorf("rows = %q, want lines that don't match to still be shown", rows)
+	}
+
+	press(t, "Alt+j")
+	if selectedLineNo != 1 {
+		t.Errorf("after search-next, selected line %d, want 1", selectedLineNo)
+	}
+	press(t, "Alt+j")
+	if selectedLineNo != 1 || statusMessage != `No older lines match "ActivityManager"` {
+		t.Errorf("past the oldest match, selected line %d (%q), want no change", selectedLineNo, statusMessage)
+	}
+	press(t, "Alt+J")
+	if selectedLineNo != 3 {
+		t.Errorf("after search-previous, selected line %d, want 3", selectedLineNo)
+	}
+
+	// The prompt starts with the last search.
+	press(t, "Alt+/")
+	if got := string(editbox.text); got != "ActivityManager" {
+		t.Errorf("prompt = %q, want the last search", got)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	setUp(t, testLines...)
+	presetsPath = filepath.Join(t.TempDir(), "lolcat", "filters.json")
+	press(t, "Alt+G")
+	if overlay != nil || !strings.HasPrefix(statusMessage, "No saved presets") {
+		t.Errorf("got %q, want no presets yet", statusMessage)
+	}
+
+	press(t, "Ctrl+T")
+	typeText("Wifi")
+	press(t, "Enter", "Alt+K")
+	typeText("wifi stuff")
+	press(t, "Enter")
+	presets, err := LoadPresets(presetsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := presets["wifi stuff"]; got.Filter != "Wifi" || got.Engine != "regex" {
+		t.Errorf("saved %+v, want the Wifi filter", got)
+	}
+
+	press(t, "Alt+G")
+	if overlay == nil || overlay.Items[0] != "wifi stuff: Wifi" {
+		t.Fatalf("overlay = %+v, want the saved preset", overlay)
+	}
+	press(t, "Enter")
+	d := currentDevice()
+	if viewIndex != 2 || d.logViews[1].Name != "wifi stuff" || len(d.logViews[1].index) != 2 {
+		t.Errorf("got view %d %q matching %d lines, want a new view with the preset's 2 matches",
+			viewIndex, d.logViews[viewIndex-1].Name, len(d.logViews[viewIndex-1].index))
+	}
+
+	// Negating the filter and raising its level are saved with it too.
+	press(t, "Alt+i", "Alt+M", "Alt+M", "Alt+M", "Alt+K")
+	typeText("not wifi")
+	press(t, "Enter", "Alt+G")
+	press(t, "Enter") // "not wifi" sorts first
+	lv := d.logViews[viewIndex-1]
+	if lv.Name != "not wifi" || !lv.negate || lv.minLevel != 'W' || len(lv.index) != 1 {
+		t.Errorf("got %q negated=%t level=%q matching %d lines, want the negated W+ filter's 1 match",
+			lv.Name, lv.negate, lv.minLevel, len(lv.index))
+	}
+}
+
+func TestStartupFilters(t *testing.T) {
+	setUp(t)
+	startupFilters = []string{"Wifi", "level:E"}
+	d := NewDevice("emulator-5556", "Tablet")
+	for _, line := range testLines {
+		d.appendLine(line)
+	}
+	if len(d.logViews) != 2 {
+		t.Fatalf("got %d views, want one for each -filter", len(d.logViews))
+	}
+	if d.logViews[0].Name != "Wifi" || len(d.logViews[0].index) != 2 || len(d.logViews[1].index) != 1 {
+		t.Errorf("got %q matching %d and %q matching %d, want Wifi matching 2 and level:E matching 1",
+			d.logViews[0].Name, len(d.logViews[0].index), d.logViews[1].Name, len(d.logViews[1].index))
+	}
+}
+
+func TestDeviceSettings(t *testing.T) {
+	setUp(t)
+	config, err := ReadConfig(strings.NewReader("lines=5000\nfilter=level:E\n\n[192.168.1.20:5555]\n" +
+		"name=Kitchen tablet\nlines=100\nfilter=Wifi\n[emulator-5554]\nfilter=tag:Foo\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(config.Options["lines"], " "); got != "5000" || len(config.Options["name"]) != 0 {
+		t.Errorf("options = %v, want the device sections kept out of them", config.Options)
+	}
+	if deviceSettings, err = ParseDeviceSettings(config.Devices); err != nil {
+		t.Fatal(err)
+	}
+	startupFilters = config.Options["filter"]
+
+	d := NewDevice("192.168.1.20:5555", "SM-T510")
+	if d.Name != "Kitchen tablet" || len(d.logBuffer.lines) != 100 {
+		t.Errorf("got %q with %d lines, want the device's own name and size", d.Name, len(d.logBuffer.lines))
+	}
+	if len(d.logViews) != 2 || d.logViews[0].Name != "level:E" || d.logViews[1].Name != "Wifi" {
+		t.Errorf("got %d views, want -filter's and then the device's own", len(d.logViews))
+	}
+	// Other devices don't get its settings.
+	other := NewDevice("emulator-5556", "Pixel")
+	if other.Name != "Pixel" || len(other.logBuffer.lines) != bufferLines || len(other.logViews) != 1 {
+		t.Errorf("got %q with %d lines and %d views, want the defaults",
+			other.Name, len(other.logBuffer.lines), len(other.logViews))
+	}
+
+	for _, bad := range []string{"[]\n", "[x]\nlines=0\n", "[x]\nmatch-color=red\n"} {
+		config, err := ReadConfig(strings.NewReader(bad))
+		if err == nil {
+			_, err = ParseDeviceSettings(config.Devices)
+		}
+		if err == nil {
+			t.Errorf("%q should have failed", bad)
+		}
+	}
+}
+
+func TestKeyName(t *testing.T) {
+	setUp(t)
+	for kb, action := range keymap {
+		name := KeyName(kb)
+		if got, err := ParseKey(name); err != nil || got != kb {
+			t.Errorf("%s: KeyName gave %q, which parses as %+v (%v), want %+v", action, name, got, err, kb)
+		}
+	}
+	for name, want := range map[string]string{"Alt+PgUp": "Alt+PgUp", "ctrl+t": "Ctrl+T", "Shift+Tab": "Shift+Tab", "x": "x"} {
+		kb, _ := ParseKey(name)
+		if got := KeyName(kb); got != want {
+			t.Errorf("KeyName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestUnbindAndShowKeys(t *testing.T) {
+	setUp(t)
+	if err := BindKeys([]string{"toggle-pause=none", "toggle-pause=F12"}); err != nil {
+		t.Fatal(err)
+	}
+	space, _ := ParseKey("Alt+Space")
+	if _, ok := keymap[space]; ok {
+		t.Error("expected Alt+Space to be unbound")
+	}
+
+	press(t, "Alt+?")
+	if overlay == nil {
+		t.Fatal("expected the keys to be shown")
+	}
+	want := fmt.Sprintf("%-22s %s", "toggle-pause", "F12")
+	found := false
+	for _, item := range overlay.Items {
+		found = found || item == want
+	}
+	if !found {
+		t.Errorf("items = %q, want %q", overlay.Items, want)
+	}
+}
+
+func TestLineAtTime(t *testing.T) {
+	setUp(t, append([]string{"--------- beginning of main"}, testLines...)...)
+	lb := devices[0].logBuffer
+	devices[0].appendLine("\tat com.example.Foo.bar(Foo.java:1)")
+	tests := []struct {
+		timestamp string
+		want      int64
+	}{
+		{"01-02 09:00:00.000", 0},
+		{"01-02 10:00:00.000", 2},
+		{"01-02 10:00:01.500", 3},
+		{"01-02 10:00:03.000", 6},
+		{"01-03 00:00:00.000", 6},
+	}
+	for _, test := range tests {
+		if got := LineAtTime(lb, test.timestamp); got != test.want {
+			t.Errorf("LineAtTime(%q) = %d, want %d", test.timestamp, got, test.want)
+		}
+	}
+}
+
+func TestCopyToClipboardSafeMode(t *testing.T) {
+	safeMode = true
+	defer func() { safeMode = false }()
+
+	// Even with no clipboard tool installed, -safe should be the reason we give.
+	defer func(commands [][]string) { clipboardCommands = commands }(clipboardCommands)
+	clipboardCommands = [][]string{{"no-such-clipboard-tool"}}
+	if err := CopyToClipboard("hello"); err != errSafeMode {
+		t.Errorf("CopyToClipboard() = %v, want %v", err, errSafeMode)
+	}
+}
+
+func TestRestrictToPackage(t *testing.T) {
+	setUp(t, testLines...)
+	d := currentDevice()
+	adbPath = "/nonexistent/adb"
+
+	// 'adb shell pidof' runs in the background, so the UI doesn't wait for it.
+	restrictToPackage("com.example")
+	if statusMessage != "Looking up com.example's pid" {
+		t.Errorf("status = %q", statusMessage)
+	}
+	select {
+	case u := <-restrictions:
+		applyRestriction(u)
+	case <-time.After(5 * time.Second):
+		t.Fatal("'adb shell pidof' didn't finish")
+	}
+	if statusMessage != "com.example isn't running" || d.pid != 0 {
+		t.Errorf("status = %q with pid %d, want the package not running", statusMessage, d.pid)
+	}
+
+	// A lookup that's been overtaken by going back to every process is ignored.
+	restrictToPackage("com.example")
+	restrictToPackage("")
+	applyRestriction(<-restrictions)
+	if d.pid != 0 || statusMessage != "Streaming logs from every process" {
+		t.Errorf("status = %q with pid %d, want the late lookup ignored", statusMessage, d.pid)
+	}
+
+	restricting[d] = "com.example"
+	applyRestriction(pidUpdate{d, "com.example", 100, nil})
+	if d.pid != 100 || statusMessage != "Streaming logs from com.example (pid 100)" {
+		t.Errorf("status = %q with pid %d, want pid 100", statusMessage, d.pid)
+	}
+}